@@ -57,6 +57,8 @@ func (sa *ShardAccessor) Shard() shard.Key {
 func (sa *ShardAccessor) Blockstore() (ReadBlockstore, error) {
 	var r io.ReaderAt = sa.data
 
+	// only plain files can be mmapped; other readers, such as those that
+	// decrypt encrypted transients, are read from as-is.
 	sa.lk.Lock()
 	if f, ok := sa.data.(*os.File); ok {
 		if mmapr, err := mmap.Open(f.Name()); err != nil {
@@ -101,7 +101,7 @@ func TestMmap(t *testing.T) {
 
 	t.Run("upgrader-mmap", func(t *testing.T) {
 		// An upgraded FS mount will mmap its local transient.
-		var mnt mount.Mount = &mount.FSMount{FS: testdata.FS, Path: testdata.FSPathCarV2}
+		var mnt mount.Mount = &mount.FSMount{FS: testdata.SequentialFS, Path: testdata.FSPathCarV2}
 		tempdir := t.TempDir()
 
 		var err error
@@ -0,0 +1,162 @@
+package dagstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+	"github.com/filecoin-project/dagstore/transform"
+)
+
+// ErrAdmissionRejected is returned by RegisterShard when an admission check
+// rejects the shard.
+var ErrAdmissionRejected = errors.New("shard admission rejected")
+
+// AdmissionCheck validates a shard before its registration is accepted.
+// Returning a non-nil error rejects the registration.
+type AdmissionCheck func(ctx context.Context, a *Admission) error
+
+// Admission describes a shard that is about to be registered. It is supplied
+// to AdmissionChecks.
+type Admission struct {
+	// Key is the key of the shard.
+	Key shard.Key
+	// Mount is the mount supplied by the application.
+	Mount mount.Mount
+	// URL is the URL representation of the mount, or nil if the mount type is
+	// not registered in the mount registry.
+	URL *url.URL
+	// Stat is the result of calling Stat on the mount.
+	Stat mount.Stat
+
+	// transform is applied to the data read from the mount, if set.
+	transform transform.Transform
+
+	hdrOnce sync.Once
+	hdr     *CARHeader
+	hdrErr  error
+}
+
+// Header returns the header of the CAR behind the mount. It is read upon the
+// first call by fetching from the mount, which may be expensive for remote
+// mounts, so checks should only call it when necessary.
+func (a *Admission) Header(ctx context.Context) (*CARHeader, error) {
+	a.hdrOnce.Do(func() {
+		r, err := fetchTransformed(ctx, a.Mount, a.transform)
+		if err != nil {
+			a.hdrErr = fmt.Errorf("failed to fetch from mount: %w", err)
+			return
+		}
+		defer r.Close()
+		a.hdr, a.hdrErr = readCARHeader(r)
+	})
+	return a.hdr, a.hdrErr
+}
+
+// admit runs the configured admission checks against a shard about to be
+// registered.
+func (d *DAGStore) admit(ctx context.Context, key shard.Key, mnt mount.Mount, tf transform.Transform) error {
+	if len(d.config.Admission) == 0 {
+		return nil
+	}
+
+	stat, err := mnt.Stat(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: failed to stat mount: %s", ErrAdmissionRejected, err)
+	}
+	if !stat.Exists {
+		return fmt.Errorf("%w: mount target does not exist", ErrAdmissionRejected)
+	}
+
+	a := &Admission{Key: key, Mount: mnt, Stat: stat, transform: tf}
+	if u, err := d.mounts.Represent(mnt); err == nil {
+		a.URL = u
+	}
+
+	for _, check := range d.config.Admission {
+		if err := check(ctx, a); err != nil {
+			return fmt.Errorf("%w: %s", ErrAdmissionRejected, err)
+		}
+	}
+	return nil
+}
+
+// AdmitMaxSize rejects shards whose mount reports a size larger than max.
+func AdmitMaxSize(max int64) AdmissionCheck {
+	return func(_ context.Context, a *Admission) error {
+		if a.Stat.Size > max {
+			return fmt.Errorf("shard size %d exceeds maximum size %d", a.Stat.Size, max)
+		}
+		return nil
+	}
+}
+
+// AdmitSchemes rejects shards whose mount is not registered under one of the
+// supplied schemes.
+func AdmitSchemes(schemes ...string) AdmissionCheck {
+	allowed := make(map[string]struct{}, len(schemes))
+	for _, s := range schemes {
+		allowed[s] = struct{}{}
+	}
+	return func(_ context.Context, a *Admission) error {
+		if a.URL == nil {
+			return fmt.Errorf("mount of type %T is not registered", a.Mount)
+		}
+		if _, ok := allowed[a.URL.Scheme]; !ok {
+			return fmt.Errorf("mount scheme %q is not allowed", a.URL.Scheme)
+		}
+		return nil
+	}
+}
+
+// AdmitCAR rejects shards that are not backed by a valid CARv1 or CARv2.
+func AdmitCAR() AdmissionCheck {
+	return func(ctx context.Context, a *Admission) error {
+		_, err := a.Header(ctx)
+		return err
+	}
+}
+
+// AdmitRoots rejects shards whose CAR roots differ from the roots returned by
+// expected for the shard key. If expected returns nil, the check is skipped.
+func AdmitRoots(expected func(key shard.Key) []cid.Cid) AdmissionCheck {
+	return func(ctx context.Context, a *Admission) error {
+		want := expected(a.Key)
+		if want == nil {
+			return nil
+		}
+		hdr, err := a.Header(ctx)
+		if err != nil {
+			return err
+		}
+		if !equalRoots(want, hdr.Roots) {
+			return fmt.Errorf("unexpected CAR roots; expected: %v, actual: %v", want, hdr.Roots)
+		}
+		return nil
+	}
+}
+
+// equalRoots returns whether two lists of roots contain the same CIDs, in any
+// order, and as many times each.
+func equalRoots(a, b []cid.Cid) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[cid.Cid]int, len(a))
+	for _, c := range a {
+		counts[c]++
+	}
+	for _, c := range b {
+		if counts[c] == 0 {
+			return false
+		}
+		counts[c]--
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package dagstore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+	"github.com/filecoin-project/dagstore/testdata"
+)
+
+func TestReadCARHeader(t *testing.T) {
+	hdr, err := readCARHeader(bytes.NewReader(testdata.CarV1))
+	require.NoError(t, err)
+	require.EqualValues(t, 1, hdr.Version)
+	require.Equal(t, []cid.Cid{testdata.RootCID}, hdr.Roots)
+
+	hdr, err = readCARHeader(bytes.NewReader(testdata.CarV2))
+	require.NoError(t, err)
+	require.EqualValues(t, 2, hdr.Version)
+	require.Equal(t, []cid.Cid{testdata.RootCID}, hdr.Roots)
+
+	_, err = readCARHeader(bytes.NewReader(testdata.Junk))
+	require.Error(t, err)
+}
+
+func TestEqualRoots(t *testing.T) {
+	x, err := cid.Decode("bafkqaaa")
+	require.NoError(t, err)
+	y := testdata.RootCID
+
+	require.True(t, equalRoots(nil, nil))
+	require.True(t, equalRoots([]cid.Cid{x, y}, []cid.Cid{y, x}))
+	require.True(t, equalRoots([]cid.Cid{x, x, y}, []cid.Cid{x, y, x}))
+	require.False(t, equalRoots([]cid.Cid{x}, []cid.Cid{y}))
+	require.False(t, equalRoots([]cid.Cid{x}, []cid.Cid{x, x}))
+	require.False(t, equalRoots([]cid.Cid{x, y}, []cid.Cid{x, x}))
+	require.False(t, equalRoots([]cid.Cid{x, x}, []cid.Cid{x, y}))
+}
+
+func TestAdmission(t *testing.T) {
+	v1mnt := &mount.FSMount{FS: testdata.SequentialFS, Path: testdata.FSPathCarV1}
+
+	register := func(t *testing.T, mnt mount.Mount, checks ...AdmissionCheck) error {
+		dagst, err := NewDAGStore(Config{
+			MountRegistry: testRegistry(t),
+			TransientsDir: t.TempDir(),
+			Datastore:     datastore.NewMapDatastore(),
+			Admission:     checks,
+		})
+		require.NoError(t, err)
+		err = dagst.Start(context.Background())
+		require.NoError(t, err)
+		defer dagst.Close()
+
+		ch := make(chan ShardResult, 1)
+		err = dagst.RegisterShard(context.Background(), shard.KeyFromString("foo"), mnt, ch, RegisterOpts{})
+		if err != nil {
+			// the shard was never added.
+			require.Empty(t, dagst.AllShardsInfo())
+			return err
+		}
+		res := <-ch
+		require.NoError(t, res.Error)
+		return nil
+	}
+
+	expectRoot := func(c cid.Cid) func(shard.Key) []cid.Cid {
+		return func(shard.Key) []cid.Cid { return []cid.Cid{c} }
+	}
+
+	t.Run("accepted", func(t *testing.T) {
+		err := register(t, carv2mnt,
+			AdmitMaxSize(int64(len(testdata.CarV2))),
+			AdmitSchemes("fs"),
+			AdmitCAR(),
+			AdmitRoots(expectRoot(testdata.RootCID)),
+		)
+		require.NoError(t, err)
+	})
+
+	t.Run("inexistent", func(t *testing.T) {
+		err := register(t, &mount.FSMount{FS: testdata.SequentialFS, Path: "nope"}, AdmitCAR())
+		require.ErrorIs(t, err, ErrAdmissionRejected)
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		err := register(t, carv2mnt, AdmitMaxSize(int64(len(testdata.CarV2))-1))
+		require.ErrorIs(t, err, ErrAdmissionRejected)
+	})
+
+	t.Run("scheme", func(t *testing.T) {
+		err := register(t, carv2mnt, AdmitSchemes("file"))
+		require.ErrorIs(t, err, ErrAdmissionRejected)
+
+		// unregistered mount types are rejected.
+		err = register(t, &mount.BytesMount{Bytes: testdata.CarV1}, AdmitSchemes("fs"))
+		require.ErrorIs(t, err, ErrAdmissionRejected)
+	})
+
+	t.Run("not a car", func(t *testing.T) {
+		err := register(t, junkmnt, AdmitCAR())
+		require.ErrorIs(t, err, ErrAdmissionRejected)
+	})
+
+	t.Run("unexpected roots", func(t *testing.T) {
+		other, err := cid.Decode("bafkqaaa")
+		require.NoError(t, err)
+		err = register(t, v1mnt, AdmitRoots(expectRoot(other)))
+		require.ErrorIs(t, err, ErrAdmissionRejected)
+	})
+}
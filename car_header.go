@@ -0,0 +1,140 @@
+package dagstore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/ipld/go-car/v2"
+	"github.com/multiformats/go-varint"
+
+	"github.com/filecoin-project/dagstore/internal/carv1"
+)
+
+// maxCARHeaderSize is the maximum size of a CARv1 header we're willing to
+// read; it guards against reading huge amounts of data from a junk file.
+const maxCARHeaderSize = 32 << 20 // 32MiB
+
+// CARHeader describes a CAR file, as read from its header.
+type CARHeader struct {
+	// Version is the CAR version (1 or 2).
+	Version uint64
+	// Roots are the root CIDs of the CAR. For CARv2, these are the roots of
+	// the inner CARv1 payload.
+	Roots []cid.Cid
+}
+
+// readCARHeader reads the header of a CARv1 or CARv2 from r, consuming r
+// sequentially. It doesn't require r to be seekable, so it can be used
+// directly on the Reader returned by any mount.
+func readCARHeader(r io.Reader) (*CARHeader, error) {
+	br := bufio.NewReader(r)
+	h, err := readCARv1Header(br)
+	if err != nil {
+		return nil, err
+	}
+
+	switch h.Version {
+	case 1:
+		return &CARHeader{Version: 1, Roots: h.Roots}, nil
+	case 2:
+		// we have just read the pragma; the fixed-size CARv2 header follows.
+		var v2h car.Header
+		if _, err := v2h.ReadFrom(br); err != nil {
+			return nil, fmt.Errorf("failed to read CARv2 header: %w", err)
+		}
+		// skip to the start of the CARv1 payload.
+		if skip := int64(v2h.DataOffset) - car.PragmaSize - car.HeaderSize; skip > 0 {
+			if _, err := io.CopyN(io.Discard, br, skip); err != nil {
+				return nil, fmt.Errorf("failed to skip to CARv2 data payload: %w", err)
+			}
+		}
+		inner, err := readCARv1Header(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read header of CARv2 data payload: %w", err)
+		}
+		return &CARHeader{Version: 2, Roots: inner.Roots}, nil
+	default:
+		return nil, fmt.Errorf("unsupported CAR version: %d", h.Version)
+	}
+}
+
+// byteReader is satisfied by buffered readers.
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func readCARv1Header(br byteReader) (*carv1.Header, error) {
+	l, err := varint.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CAR header length: %w", err)
+	}
+	if l == 0 || l > maxCARHeaderSize {
+		return nil, fmt.Errorf("invalid CAR header length: %d", l)
+	}
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return nil, fmt.Errorf("failed to read CAR header: %w", err)
+	}
+	var h carv1.Header
+	if err := cbor.DecodeInto(buf, &h); err != nil {
+		return nil, fmt.Errorf("invalid CAR header: %w", err)
+	}
+	return &h, nil
+}
+
+// ContentMismatchError is the error a shard fails with when its CAR doesn't
+// match the roots or size supplied in RegisterOpts. Only the fields of the
+// check that failed are populated.
+type ContentMismatchError struct {
+	ExpectedRoots []cid.Cid
+	ActualRoots   []cid.Cid
+	ExpectedSize  int64
+	ActualSize    int64
+}
+
+func (e *ContentMismatchError) Error() string {
+	if e.ExpectedRoots != nil {
+		return fmt.Sprintf("unexpected CAR roots; expected: %v, actual: %v", e.ExpectedRoots, e.ActualRoots)
+	}
+	return fmt.Sprintf("unexpected CAR size; expected: %d, actual: %d", e.ExpectedSize, e.ActualSize)
+}
+
+// verifyContents verifies that the CAR in r has the expected roots and size,
+// if any were supplied, returning a *ContentMismatchError on mismatch. It
+// rewinds r to the start before returning.
+func verifyContents(r io.ReadSeeker, expectedRoots []cid.Cid, expectedSize int64) error {
+	if expectedRoots == nil && expectedSize == 0 {
+		return nil
+	}
+
+	if expectedSize != 0 {
+		size, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return fmt.Errorf("failed to determine CAR size: %w", err)
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind CAR: %w", err)
+		}
+		if size != expectedSize {
+			return &ContentMismatchError{ExpectedSize: expectedSize, ActualSize: size}
+		}
+	}
+
+	if expectedRoots != nil {
+		hdr, err := readCARHeader(r)
+		if err != nil {
+			return err
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind CAR: %w", err)
+		}
+		if !equalRoots(expectedRoots, hdr.Roots) {
+			return &ContentMismatchError{ExpectedRoots: expectedRoots, ActualRoots: hdr.Roots}
+		}
+	}
+	return nil
+}
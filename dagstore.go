@@ -2,21 +2,26 @@ package dagstore
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"sync"
+	"time"
 
+	"github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/namespace"
 	"github.com/ipfs/go-datastore/query"
 	dssync "github.com/ipfs/go-datastore/sync"
 	logging "github.com/ipfs/go-log/v2"
+	carindex "github.com/ipld/go-car/v2/index"
 
 	"github.com/filecoin-project/dagstore/index"
 	"github.com/filecoin-project/dagstore/mount"
 	"github.com/filecoin-project/dagstore/shard"
 	"github.com/filecoin-project/dagstore/throttle"
+	"github.com/filecoin-project/dagstore/transform"
 )
 
 var (
@@ -56,9 +61,18 @@ var (
 	// ErrShardInitializationFailed is returned when shard initialization fails.
 	ErrShardInitializationFailed = errors.New("shard initialization failed")
 
-	// ErrShardInUse is returned when the user attempts to destroy a shard that
-	// is in use.
+	// ErrShardInUse is returned when the user attempts to destroy a shard, or
+	// to update its mount, while it is in use.
 	ErrShardInUse = errors.New("shard in use")
+
+	// ErrMountMismatch is returned when the user attempts to update the mount
+	// of a shard with a mount that doesn't match the current one.
+	ErrMountMismatch = errors.New("mount mismatch")
+
+	// ErrShardUnavailable is returned when the user attempts to acquire a
+	// shard in ShardStateUnavailable, unless AcquireOpts.WaitUnavailable is
+	// set.
+	ErrShardUnavailable = errors.New("shard unavailable")
 )
 
 // DAGStore is the central object of the DAG store.
@@ -69,6 +83,7 @@ type DAGStore struct {
 	config  Config
 	indices index.FullIndexRepo
 	store   ds.Datastore
+	started bool // guarded by lk
 
 	// Channels owned by us.
 	//
@@ -89,6 +104,9 @@ type DAGStore struct {
 	dispatchFailuresCh chan *dispatch
 	// gcCh is where requests for GC are sent.
 	gcCh chan chan *GCResult
+	// exclusiveCh is where jobs that must run with exclusivity from the event
+	// loop are sent (e.g. backups).
+	exclusiveCh chan *exclusive
 
 	// Channels not owned by us.
 	//
@@ -102,6 +120,9 @@ type DAGStore struct {
 	throttleReaadyFetch throttle.Throttler
 	throttleIndex       throttle.Throttler
 
+	// transientsEnc encrypts transients at rest, if TransientsKey is set.
+	transientsEnc *transform.AESGCM
+
 	// Lifecycle.
 	//
 	ctx      context.Context
@@ -122,6 +143,13 @@ type task struct {
 	op    OpType
 	shard *Shard
 	err   error
+
+	// mount and keepIndex are only set for OpShardUpdateMount.
+	mount     *mount.Upgrader
+	keepIndex bool
+
+	// waitUnavailable is only set for OpShardAcquire.
+	waitUnavailable bool
 }
 
 // ShardResult encapsulates a result from an asynchronous operation.
@@ -171,9 +199,76 @@ type Config struct {
 	// immediate fetch. 0 (default) disables throttling.
 	MaxConcurrentReadyFetches int
 
+	// StreamingTransients enables streaming of transient copies of remote
+	// mounts. Shards whose index is available can then be acquired without
+	// waiting for the transient to be fully downloaded; reads from the
+	// accessor block until the data they require has been downloaded.
+	StreamingTransients bool
+
+	// SparseTransients replaces full transient copies with sparse caches for
+	// mounts that support ranged reads (see mount.RangeFetcher). Only the
+	// chunks of the CAR that are actually read are fetched and stored.
+	SparseTransients bool
+
+	// TransientsKey is the AES key (16, 24 or 32 bytes long) with which
+	// transient copies are encrypted at rest, using transform.AESGCM. A nil
+	// key disables encryption. It can't be combined with StreamingTransients
+	// or SparseTransients.
+	//
+	// Every transient is encrypted with its own key, derived from this key
+	// and a random salt, so a single key can be used for any number of
+	// transients over the lifetime of the DAG store.
+	//
+	// Existing transients that weren't encrypted with this key, including
+	// those supplied through RegisterOpts.ExistingTransient, are ignored,
+	// and the data is refetched from the mount.
+	TransientsKey []byte
+
 	// RecoverOnStart specifies whether failed shards should be recovered
 	// on start.
 	RecoverOnStart RecoverOnStartPolicy
+
+	// Hooks are invoked before and after every shard operation, and can
+	// reject operations requested by the application. See OpHook.
+	Hooks []OpHook
+
+	// Admission are the checks that shards must pass before their
+	// registration is accepted. See AdmissionCheck.
+	Admission []AdmissionCheck
+
+	// Indexing are the default options for generating shard indices. They
+	// can be overridden per shard through RegisterOpts.Indexing.
+	Indexing IndexingOpts
+
+	// IndexingProgressCh is a channel to be notified of the progress of
+	// indexing jobs. A nil value will send no progress notifications.
+	//
+	// Note: Not actively consuming from this channel will stall indexing.
+	IndexingProgressCh chan<- IndexingProgress
+
+	// IndexingProgressInterval is the interval at which indexing progress is
+	// reported. Defaults to 5 seconds.
+	IndexingProgressInterval time.Duration
+
+	// TransformRegistry contains the set of transforms that shards can refer
+	// to by name through RegisterOpts.Transform.
+	TransformRegistry *transform.Registry
+
+	// TransitionCh is a channel to be notified every time that an operation
+	// changes the state of a shard. A nil value will send no transition
+	// notifications. Operations that are illegal in the current state of
+	// the shard are rejected with a *TransitionError instead.
+	//
+	// Note: Not actively consuming from this channel will make the event
+	// loop block.
+	TransitionCh chan<- ShardTransition
+
+	// MountCheckInterval is the interval at which the mounts of available
+	// shards without a transient copy are checked through Mount.Stat. Shards
+	// whose mount is unreachable are moved to ShardStateUnavailable, and back
+	// to ShardStateAvailable once it's reachable again. 0 (default) disables
+	// mount checks.
+	MountCheckInterval time.Duration
 }
 
 // NewDAGStore constructs a new DAG store with the supplied configuration.
@@ -188,6 +283,10 @@ func NewDAGStore(cfg Config) (*DAGStore, error) {
 		return nil, fmt.Errorf("failed to create scratch root dir: %w", err)
 	}
 
+	if cfg.IndexingProgressInterval <= 0 {
+		cfg.IndexingProgressInterval = defaultIndexingProgressInterval
+	}
+
 	// instantiate the index repo.
 	if cfg.IndexRepo == nil {
 		log.Info("using in-memory index store")
@@ -207,6 +306,21 @@ func NewDAGStore(cfg Config) (*DAGStore, error) {
 		cfg.MountRegistry = mount.NewRegistry()
 	}
 
+	if cfg.TransformRegistry == nil {
+		cfg.TransformRegistry = transform.NewRegistry()
+	}
+
+	var transientsEnc *transform.AESGCM
+	if cfg.TransientsKey != nil {
+		if cfg.StreamingTransients || cfg.SparseTransients {
+			return nil, fmt.Errorf("encrypted transients can't be combined with streaming or sparse transients")
+		}
+		var err error
+		if transientsEnc, err = transform.NewAESGCM(cfg.TransientsKey, 0); err != nil {
+			return nil, fmt.Errorf("invalid transients key: %w", err)
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	dagst := &DAGStore{
 		mounts:              cfg.MountRegistry,
@@ -219,10 +333,12 @@ func NewDAGStore(cfg Config) (*DAGStore, error) {
 		completionCh:        make(chan *task, 64),      // len=64, hitting this limit will just make async tasks wait.
 		dispatchResultsCh:   make(chan *dispatch, 128), // len=128, same as externalCh.
 		gcCh:                make(chan chan *GCResult, 8),
+		exclusiveCh:         make(chan *exclusive, 8),
 		traceCh:             cfg.TraceCh,
 		failureCh:           cfg.FailureCh,
 		throttleIndex:       throttle.Noop(),
 		throttleReaadyFetch: throttle.Noop(),
+		transientsEnc:       transientsEnc,
 		ctx:                 ctx,
 		cancelFn:            cancel,
 	}
@@ -240,6 +356,10 @@ func NewDAGStore(cfg Config) (*DAGStore, error) {
 
 // Start starts a DAG store.
 func (d *DAGStore) Start(ctx context.Context) error {
+	d.lk.Lock()
+	d.started = true
+	d.lk.Unlock()
+
 	if err := d.restoreState(); err != nil {
 		// TODO add a lenient mode.
 		return fmt.Errorf("failed to restore dagstore state: %w", err)
@@ -273,6 +393,11 @@ func (d *DAGStore) Start(ctx context.Context) error {
 		case ShardStateServing:
 			// reset to available, as we have no active acquirers at start.
 			s.state = ShardStateAvailable
+		case ShardStateUnavailable:
+			// reset to available; mount checks will find out if the mount is
+			// still unreachable.
+			s.state = ShardStateAvailable
+			s.err = nil
 		case ShardStateAvailable:
 			// Noop: An available shard whose index has disappeared across restarts
 			// will fail on the first acquisition.
@@ -305,6 +430,12 @@ func (d *DAGStore) Start(ctx context.Context) error {
 		go d.dispatcher(d.dispatchFailuresCh)
 	}
 
+	// spawn the mount checker, if enabled.
+	if d.config.MountCheckInterval > 0 {
+		d.wg.Add(1)
+		go d.monitorMounts()
+	}
+
 	// release the queued registrations before we return.
 	for _, s := range toRegister {
 		_ = d.queueTask(&task{op: OpShardRegister, shard: s, waiter: &waiter{ctx: ctx}}, d.externalCh)
@@ -332,14 +463,83 @@ type RegisterOpts struct {
 	// has acknowledged the inclusion of the shard, without waiting for any
 	// indexing to happen.
 	LazyInitialization bool
+
+	// ExpectedRoots are the root CIDs that the CAR is expected to have, in any
+	// order. If set, the roots in the CAR header are verified upon
+	// initialization, and the shard fails with a *ContentMismatchError on
+	// mismatch.
+	ExpectedRoots []cid.Cid
+
+	// ExpectedSize is the size in bytes that the CAR is expected to have. If
+	// non-zero, it is verified upon initialization, and the shard fails with a
+	// *ContentMismatchError on mismatch.
+	ExpectedSize int64
+
+	// ExistingIndex can be supplied when registering a shard whose full index
+	// has already been computed elsewhere. It is stored in the index repo as
+	// is, and the shard becomes available without fetching or indexing.
+	//
+	// The index is checked lightly against the CAR, but only if the CAR can
+	// be read locally (i.e. through ExistingTransient, or a local mount
+	// supporting random access). ErrIndexMismatch is returned if the check
+	// fails. Indices with a codec other than multicodec.CarIndexSorted, the
+	// only one the DAG store generates, are rejected.
+	ExistingIndex carindex.Index
+
+	// ExistingIndexPath is like ExistingIndex, but it points to a file
+	// containing the serialized index. It is ignored if ExistingIndex is set.
+	ExistingIndexPath string
+
+	// Indexing overrides the indexing options set in Config.Indexing for this
+	// shard. They're persisted, and apply to reindexing upon recovery too.
+	Indexing *IndexingOpts
+
+	// Transform is the name of a transform registered in
+	// Config.TransformRegistry, which is applied to the data fetched from the
+	// mount whenever the shard is read, e.g. to decrypt it. Transient copies
+	// hold the untransformed data. The name is persisted.
+	Transform string
 }
 
 // RegisterShard initiates the registration of a new shard.
 //
-// This method returns an error synchronously if preliminary validation fails.
-// Otherwise, it queues the shard for registration. The caller should monitor
-// supplied channel for a result.
+// This method returns an error synchronously if preliminary validation fails,
+// including any admission checks configured in Config.Admission. Otherwise, it
+// queues the shard for registration. The caller should monitor supplied
+// channel for a result.
 func (d *DAGStore) RegisterShard(ctx context.Context, key shard.Key, mnt mount.Mount, out chan ShardResult, opts RegisterOpts) error {
+	d.lk.RLock()
+	_, exists := d.shards[key]
+	d.lk.RUnlock()
+	if exists {
+		return fmt.Errorf("%s: %w", key.String(), ErrShardExists)
+	}
+
+	var tf transform.Transform
+	if opts.Transform != "" {
+		var err error
+		if tf, err = d.config.TransformRegistry.Get(opts.Transform); err != nil {
+			return fmt.Errorf("%s: %w", key.String(), err)
+		}
+	}
+
+	// run admission checks outside the lock, as they may perform I/O.
+	if err := d.admit(ctx, key, mnt, tf); err != nil {
+		return fmt.Errorf("%s: %w", key.String(), err)
+	}
+
+	// refuse mounts that can't be persisted, including those whose secrets
+	// would be persisted in plain text.
+	if err := d.checkPersistable(mnt); err != nil {
+		return fmt.Errorf("%s: %w", key.String(), err)
+	}
+
+	// load and check the existing index, if one was supplied.
+	idx, err := loadExistingIndex(ctx, mnt, tf, opts)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key.String(), err)
+	}
+
 	d.lk.Lock()
 	if _, ok := d.shards[key]; ok {
 		d.lk.Unlock()
@@ -347,32 +547,73 @@ func (d *DAGStore) RegisterShard(ctx context.Context, key shard.Key, mnt mount.M
 	}
 
 	// wrap the original mount in an upgrader.
-	upgraded, err := mount.Upgrade(mnt, d.throttleReaadyFetch, d.config.TransientsDir, key.String(), opts.ExistingTransient)
+	upgraded, err := d.upgradeMount(mnt, key, opts.ExistingTransient)
 	if err != nil {
 		d.lk.Unlock()
 		return err
 	}
 
+	// add the existing index before the shard is visible; initialization will
+	// find it, and make the shard available without fetching it.
+	if idx != nil {
+		if err := d.indices.AddFullIndex(key, idx); err != nil {
+			d.lk.Unlock()
+			return fmt.Errorf("failed to add existing index for shard: %w", err)
+		}
+	}
+
 	w := &waiter{outCh: out, ctx: ctx}
 
 	// add the shard to the shard catalogue, and drop the lock.
 	s := &Shard{
-		d:     d,
-		key:   key,
-		state: ShardStateNew,
-		mount: upgraded,
-		lazy:  opts.LazyInitialization,
+		d:             d,
+		key:           key,
+		state:         ShardStateNew,
+		mount:         upgraded,
+		lazy:          opts.LazyInitialization,
+		expectedRoots: opts.ExpectedRoots,
+		expectedSize:  opts.ExpectedSize,
+		indexing:      opts.Indexing,
+		transform:     opts.Transform,
 	}
 	d.shards[key] = s
 	d.lk.Unlock()
 
 	tsk := &task{op: OpShardRegister, shard: s, waiter: w}
-	return d.queueTask(tsk, d.externalCh)
+	if err := d.queueTask(tsk, d.externalCh); err != nil {
+		// the shard never reached the event loop; forget it, along with the
+		// index we added for it.
+		d.lk.Lock()
+		delete(d.shards, key)
+		d.lk.Unlock()
+		if idx != nil {
+			if _, err := d.indices.DropFullIndex(key); err != nil {
+				log.Warnw("failed to drop existing index of unregistered shard", "shard", key, "error", err)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// checkPersistable checks that the mount registry can represent mnt, so that
+// shards using it can be persisted, and revived on restart.
+func (d *DAGStore) checkPersistable(mnt mount.Mount) error {
+	if _, err := d.mounts.Represent(mnt); err != nil {
+		err = mount.RedactError(err, d.mounts.Secrets(mnt)...)
+		return fmt.Errorf("mount can't be persisted: %w", err)
+	}
+	return nil
 }
 
 type DestroyOpts struct {
 }
 
+// DestroyShard removes a shard from the DAG store, along with its index,
+// its transient copy, and its persisted state, so that it isn't revived on
+// restart, and a shard registered later with the same key starts afresh.
+// Shards in use can't be destroyed. The result is delivered on the supplied
+// channel.
 func (d *DAGStore) DestroyShard(ctx context.Context, key shard.Key, out chan ShardResult, _ DestroyOpts) error {
 	d.lk.Lock()
 	s, ok := d.shards[key]
@@ -386,7 +627,156 @@ func (d *DAGStore) DestroyShard(ctx context.Context, key shard.Key, out chan Sha
 	return d.queueTask(tsk, d.externalCh)
 }
 
+type UpdateMountOpts struct {
+	// KeepIndex retains the existing index of the shard, and carries over any
+	// existing transient copy, instead of reindexing from the new mount. Only
+	// set this when the new mount is known to serve the exact same CAR.
+	KeepIndex bool
+
+	// ExistingTransient can be supplied to indicate that there's already an
+	// existing local transient copy of the data behind the new mount.
+	ExistingTransient string
+}
+
+// UpdateMount replaces the mount of an existing shard, e.g. after its data has
+// been relocated, or to switch from a remote to a local mount.
+//
+// The new mount is validated synchronously against the current one: the
+// target must exist, and its size must match that of the current mount, as
+// must its ETag and modification time if both mounts report them (so
+// relocated files must keep their modification time). If the current mount is
+// unreachable, the new mount is validated against the local data of the shard
+// instead. ErrMountMismatch is returned on mismatch.
+//
+// The update is then queued, and the result is delivered on the supplied
+// channel. Shards that are currently being served, initialized, or recovered
+// cannot be updated. Unless UpdateMountOpts.KeepIndex is set, the existing
+// index and transient are dropped, and the shard is reinitialized from the new
+// mount as if it had been registered again.
+func (d *DAGStore) UpdateMount(ctx context.Context, key shard.Key, mnt mount.Mount, out chan ShardResult, opts UpdateMountOpts) error {
+	d.lk.Lock()
+	s, ok := d.shards[key]
+	if !ok {
+		d.lk.Unlock()
+		return fmt.Errorf("%s: %w", key.String(), ErrShardUnknown)
+	}
+	d.lk.Unlock()
+
+	s.lk.RLock()
+	curr := s.mount
+	s.lk.RUnlock()
+
+	if err := d.checkPersistable(mnt); err != nil {
+		return fmt.Errorf("%s: %w", key.String(), err)
+	}
+	if err := d.validateMountUpdate(ctx, s, curr, mnt); err != nil {
+		return fmt.Errorf("%s: %w", key.String(), err)
+	}
+
+	// carry over the current transient if we're keeping the index, as it
+	// contains the same data.
+	initial := opts.ExistingTransient
+	if initial == "" && opts.KeepIndex {
+		initial = curr.TransientPath()
+	}
+
+	upgraded, err := d.upgradeMount(mnt, key, initial)
+	if err != nil {
+		return err
+	}
+
+	tsk := &task{op: OpShardUpdateMount, shard: s, waiter: &waiter{ctx: ctx, outCh: out}, mount: upgraded, keepIndex: opts.KeepIndex}
+	return d.queueTask(tsk, d.externalCh)
+}
+
+// validateMountUpdate checks that the new mount exists, and that it serves the
+// same data as the current mount (see compareMountStats).
+//
+// If the current mount is no longer reachable, which is usually the very
+// reason for the update, the new mount is validated against the local data of
+// the shard instead: the size of its transient, the expected size recorded at
+// registration, or its index if the new mount is local, in this order of
+// preference. The update is only accepted unchecked if none of them applies.
+func (d *DAGStore) validateMountUpdate(ctx context.Context, s *Shard, curr *mount.Upgrader, mnt mount.Mount) error {
+	nstat, err := mnt.Stat(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to stat new mount: %w", err)
+	}
+	if !nstat.Exists {
+		return fmt.Errorf("new mount target does not exist")
+	}
+
+	cstat, err := curr.Underlying().Stat(ctx)
+	if err == nil && cstat.Exists {
+		return compareMountStats(cstat, nstat)
+	}
+	log.Warnw("update mount: current mount is unreachable; validating against local data", "shard", s.key, "error", err)
+
+	// the Upgrader stats the transient if there is one.
+	if curr.TransientPath() != "" {
+		if tstat, err := curr.Stat(ctx); err == nil && tstat.Exists {
+			if tstat.Size != nstat.Size {
+				return fmt.Errorf("%w: size of transient: %d, size of new mount: %d", ErrMountMismatch, tstat.Size, nstat.Size)
+			}
+			return nil
+		}
+	}
+
+	s.lk.RLock()
+	expected := s.expectedSize
+	s.lk.RUnlock()
+	if expected != 0 {
+		if expected != nstat.Size {
+			return fmt.Errorf("%w: expected size: %d, size of new mount: %d", ErrMountMismatch, expected, nstat.Size)
+		}
+		return nil
+	}
+
+	// checking the index requires random access to the new mount, which we
+	// only perform locally.
+	info := mnt.Info()
+	if istat, err := d.indices.StatFullIndex(s.key); err == nil && istat.Exists && info.Kind == mount.KindLocal && info.AccessRandom {
+		idx, err := d.indices.GetFullIndex(s.key)
+		if err != nil {
+			return fmt.Errorf("failed to get index to validate new mount: %w", err)
+		}
+		r, err := d.fetch(ctx, s, mnt)
+		if err != nil {
+			return fmt.Errorf("failed to fetch from new mount to validate it: %w", err)
+		}
+		defer r.Close()
+		if err := checkIndex(r, idx, indexCheckSamples); err != nil {
+			return fmt.Errorf("%w: new mount doesn't match the index: %s", ErrMountMismatch, err)
+		}
+		return nil
+	}
+
+	log.Warnw("update mount: no local data to validate new mount against; accepting unchecked", "shard", s.key)
+	return nil
+}
+
+// compareMountStats checks that the stats of two mounts describe the same
+// data. Sizes must match, and so must ETags and modification times, where
+// both mounts report them.
+func compareMountStats(curr, next mount.Stat) error {
+	if curr.Size != next.Size {
+		return fmt.Errorf("%w: size of current mount: %d, size of new mount: %d", ErrMountMismatch, curr.Size, next.Size)
+	}
+	if curr.ETag != "" && next.ETag != "" && curr.ETag != next.ETag {
+		return fmt.Errorf("%w: ETag of current mount: %s, ETag of new mount: %s", ErrMountMismatch, curr.ETag, next.ETag)
+	}
+	if !curr.ModTime.IsZero() && !next.ModTime.IsZero() && !curr.ModTime.Equal(next.ModTime) {
+		return fmt.Errorf("%w: modification time of current mount: %s, modification time of new mount: %s", ErrMountMismatch, curr.ModTime, next.ModTime)
+	}
+	return nil
+}
+
 type AcquireOpts struct {
+	// WaitUnavailable makes the acquisition of a shard in
+	// ShardStateUnavailable wait until its mount is reachable again, or until
+	// the context is cancelled, instead of failing immediately with
+	// ErrShardUnavailable.
+	WaitUnavailable bool
 }
 
 // AcquireShard acquires access to the specified shard, and returns a
@@ -396,10 +786,13 @@ type AcquireOpts struct {
 // This operation may resolve near-instantaneously if the shard is available
 // locally. If not, the shard data may be fetched from its mount.
 //
+// Shards whose mount is unreachable (ShardStateUnavailable) can't be acquired
+// until it's reachable again; see AcquireOpts.WaitUnavailable.
+//
 // This method returns an error synchronously if preliminary validation fails.
 // Otherwise, it queues the shard for acquisition. The caller should monitor
 // supplied channel for a result.
-func (d *DAGStore) AcquireShard(ctx context.Context, key shard.Key, out chan ShardResult, _ AcquireOpts) error {
+func (d *DAGStore) AcquireShard(ctx context.Context, key shard.Key, out chan ShardResult, opts AcquireOpts) error {
 	d.lk.Lock()
 	s, ok := d.shards[key]
 	if !ok {
@@ -408,7 +801,7 @@ func (d *DAGStore) AcquireShard(ctx context.Context, key shard.Key, out chan Sha
 	}
 	d.lk.Unlock()
 
-	tsk := &task{op: OpShardAcquire, shard: s, waiter: &waiter{ctx: ctx, outCh: out}}
+	tsk := &task{op: OpShardAcquire, shard: s, waiter: &waiter{ctx: ctx, outCh: out}, waitUnavailable: opts.WaitUnavailable}
 	return d.queueTask(tsk, d.externalCh)
 }
 
@@ -511,10 +904,33 @@ func (d *DAGStore) GC(ctx context.Context) (*GCResult, error) {
 func (d *DAGStore) Close() error {
 	d.cancelFn()
 	d.wg.Wait()
+
+	// abort streaming downloads.
+	d.lk.RLock()
+	for _, s := range d.shards {
+		_ = s.mount.Close()
+	}
+	d.lk.RUnlock()
+
 	_ = d.store.Sync(ds.Key{})
 	return nil
 }
 
+// upgradeMount wraps a mount in an upgrader configured for this DAG store.
+func (d *DAGStore) upgradeMount(mnt mount.Mount, key shard.Key, initial string) (*mount.Upgrader, error) {
+	var opts []mount.UpgradeOption
+	if d.config.StreamingTransients {
+		opts = append(opts, mount.WithStreaming())
+	}
+	if d.config.SparseTransients {
+		opts = append(opts, mount.WithSparseCache(0))
+	}
+	if d.transientsEnc != nil {
+		opts = append(opts, mount.WithEncryption(d.transientsEnc))
+	}
+	return mount.Upgrade(mnt, d.throttleReaadyFetch, d.config.TransientsDir, key.String(), initial, opts...)
+}
+
 func (d *DAGStore) queueTask(tsk *task, ch chan<- *task) error {
 	select {
 	case <-d.ctx.Done():
@@ -529,13 +945,21 @@ func (d *DAGStore) restoreState() error {
 	if err != nil {
 		return fmt.Errorf("failed to recover dagstore state from store: %w", err)
 	}
+	// shards whose records carry mount URLs in a legacy representation;
+	// they're rewritten once the query is done.
+	var outdated []*Shard
 	for {
 		res, ok := results.NextSync()
 		if !ok {
-			return nil
+			break
 		}
+		var ps PersistedShard
 		s := &Shard{d: d}
-		if err := s.UnmarshalJSON(res.Value); err != nil {
+		if err := json.Unmarshal(res.Value, &ps); err != nil {
+			log.Warnf("failed to recover state of shard %s: %s; skipping", shard.KeyFromString(res.Key), err)
+			continue
+		}
+		if err := s.restore(&ps); err != nil {
 			log.Warnf("failed to recover state of shard %s: %s; skipping", shard.KeyFromString(res.Key), err)
 			continue
 		}
@@ -543,7 +967,21 @@ func (d *DAGStore) restoreState() error {
 		log.Debugw("restored shard state on dagstore startup", "shard", s.key, "shard state", s.state, "shard error", s.err,
 			"shard lazy", s.lazy)
 		d.shards[s.key] = s
+
+		if mount.IsLegacyURL(ps.URL) {
+			outdated = append(outdated, s)
+		}
 	}
+	_ = results.Close()
+
+	for _, s := range outdated {
+		if err := s.persist(d.store); err != nil {
+			log.Warnw("failed to migrate persisted shard state", "shard", s.key, "error", err)
+			continue
+		}
+		log.Debugw("migrated persisted shard state", "shard", s.key)
+	}
+	return nil
 }
 
 // ensureDir checks whether the specified path is a directory, and if not it
@@ -3,7 +3,6 @@ package dagstore
 import (
 	"context"
 
-	"github.com/ipld/go-car/v2"
 	"github.com/ipld/go-car/v2/index"
 
 	"github.com/filecoin-project/dagstore/mount"
@@ -19,7 +18,7 @@ import (
 func (d *DAGStore) acquireAsync(ctx context.Context, w *waiter, s *Shard, mnt mount.Mount) {
 	k := s.key
 
-	reader, err := mnt.Fetch(ctx)
+	reader, err := d.fetch(ctx, s, mnt)
 
 	if err := ctx.Err(); err != nil {
 		log.Warnw("context cancelled while fetching shard; releasing", "shard", s.key, "error", err)
@@ -102,7 +101,7 @@ func (d *DAGStore) acquireAsync(ctx context.Context, w *waiter, s *Shard, mnt mo
 // initializeShard initializes a shard asynchronously by fetching its data and
 // performing indexing.
 func (d *DAGStore) initializeShard(ctx context.Context, s *Shard, mnt mount.Mount) {
-	reader, err := mnt.Fetch(ctx)
+	reader, err := d.fetch(ctx, s, mnt)
 	if err != nil {
 		log.Warnw("initialize: failed to fetch from mount upgrader", "shard", s.key, "error", err)
 
@@ -113,11 +112,20 @@ func (d *DAGStore) initializeShard(ctx context.Context, s *Shard, mnt mount.Moun
 
 	log.Debugw("initialize: successfully fetched from mount upgrader", "shard", s.key)
 
+	// verify the contents, if the application told us what to expect.
+	if err := verifyContents(reader, s.expectedRoots, s.expectedSize); err != nil {
+		log.Warnw("initialize: failed to verify shard contents", "shard", s.key, "error", err)
+
+		_ = d.failShard(s, d.completionCh, "failed to verify shard contents: %w", err)
+		return
+	}
+
 	// works for both CARv1 and CARv2.
+	ix := d.indexer(s)
 	var idx index.Index
-	err = d.throttleIndex.Do(ctx, func(_ context.Context) error {
+	err = d.throttleIndex.Do(ctx, func(ctx context.Context) error {
 		var err error
-		idx, err = car.ReadOrGenerateIndex(reader, car.ZeroLengthSectionAsEOF(true))
+		idx, err = ix.generate(ctx, s.key, reader)
 		if err == nil {
 			log.Debugw("initialize: finished generating index for shard", "shard", s.key)
 		} else {
@@ -136,3 +144,42 @@ func (d *DAGStore) initializeShard(ctx context.Context, s *Shard, mnt mount.Moun
 
 	_ = d.queueTask(&task{op: OpShardMakeAvailable, shard: s}, d.completionCh)
 }
+
+// startInitialize launches the initialization of a shard in a goroutine. The
+// job is cancelled if the requester's context is cancelled, if the DAG store
+// is closed, or if the shard is destroyed in the meantime.
+func (d *DAGStore) startInitialize(ctx context.Context, s *Shard) {
+	ctx, cancel := context.WithCancel(ctx)
+	s.cancelInit = cancel
+
+	mnt := s.mount
+	go func() {
+		defer cancel()
+		d.initializeShard(ctx, s, mnt)
+	}()
+	go func() {
+		select {
+		case <-d.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// indexer returns the indexer for a shard, configured with the store-wide
+// indexing options, or the shard's own if it has them.
+func (d *DAGStore) indexer(s *Shard) *indexer {
+	ix := &indexer{opts: d.config.Indexing, interval: d.config.IndexingProgressInterval}
+	if s.indexing != nil {
+		ix.opts = *s.indexing
+	}
+	if ch := d.config.IndexingProgressCh; ch != nil {
+		ix.progress = func(p IndexingProgress) {
+			select {
+			case ch <- p:
+			case <-d.ctx.Done():
+			}
+		}
+	}
+	return ix
+}
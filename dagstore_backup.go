@@ -0,0 +1,602 @@
+package dagstore
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	carindex "github.com/ipld/go-car/v2/index"
+
+	"github.com/filecoin-project/dagstore/index"
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+	"github.com/filecoin-project/dagstore/transform"
+)
+
+//
+// This file contains the logic to back up and restore the complete state of
+// the DAG store: the shard catalogue, the full indices, and optionally the
+// transients.
+//
+// Backups are tar archives with the following layout, in this order:
+//
+//   manifest.json             BackupManifest
+//   shards/<key>.json         PersistedShard, one per shard
+//   indices/<key>.full.idx    full index, one per shard that has one
+//   transients/<key>          transient copy, one per shard that has one (optional)
+//
+// where <key> is the path-escaped shard key. Transients are stored in
+// plaintext, and encrypted on restore if the destination encrypts transients
+// at rest (see Config.TransientsKey). Placing all shard records before the
+// bulk data allows us to validate the backup and detect conflicts before
+// writing anything on restore.
+//
+
+const (
+	// BackupVersion is the version of the backup format produced by this
+	// version of the DAG store.
+	BackupVersion = 1
+
+	backupManifestEntry = "manifest.json"
+	backupShardsDir     = "shards/"
+	backupIndicesDir    = "indices/"
+	backupTransientsDir = "transients/"
+
+	backupShardSuffix = ".json"
+	backupIndexSuffix = ".full.idx"
+)
+
+var (
+	// ErrInvalidBackup is returned when restoring a backup that is malformed,
+	// or whose version is not supported.
+	ErrInvalidBackup = errors.New("invalid backup")
+
+	// ErrRestoreConflict is returned when restoring a backup containing
+	// shards that already exist, and the RestoreAbort policy is in use.
+	ErrRestoreConflict = errors.New("backup conflicts with existing shards")
+)
+
+// BackupManifest is the first entry of a backup, and describes its contents.
+type BackupManifest struct {
+	Version    int       `json:"version"`
+	Created    time.Time `json:"created"`
+	Shards     int       `json:"shards"`
+	Transients bool      `json:"transients"`
+}
+
+type BackupOpts struct {
+	// IncludeTransients includes the transient copies of shards in the
+	// backup. Beware that this can make the backup very large.
+	IncludeTransients bool
+}
+
+// Backup writes a consistent snapshot of the DAG store state to w, comprising
+// the persisted state of every shard and every full index, and optionally
+// the transients.
+//
+// The snapshot is taken with exclusivity from the event loop, which is only
+// paused while the shard records are serialized, and the indices and
+// transients are opened. The bulk data is then streamed from the opened
+// files while the DAG store keeps operating; later changes to the shards
+// don't make it into the backup.
+func (d *DAGStore) Backup(ctx context.Context, w io.Writer, opts BackupOpts) error {
+	snaps, err := d.snapshot(ctx, func() ([]*Shard, error) {
+		d.lk.RLock()
+		defer d.lk.RUnlock()
+		shards := make([]*Shard, 0, len(d.shards))
+		for _, s := range d.shards {
+			shards = append(shards, s)
+		}
+		return shards, nil
+	}, opts.IncludeTransients)
+	defer closeSnapshots(snaps)
+	if err != nil {
+		return err
+	}
+
+	return d.writeArchive(ctx, w, snaps, opts.IncludeTransients)
+}
+
+// snapshot captures the state of the shards returned by sel, with exclusivity
+// from the event loop (see snapshotShards). The caller must release the
+// returned snapshots with closeSnapshots.
+func (d *DAGStore) snapshot(ctx context.Context, sel func() ([]*Shard, error), transients bool) ([]*shardSnapshot, error) {
+	// the job may complete after we've given up waiting for it, in which
+	// case it releases the snapshots itself.
+	var (
+		lk        sync.Mutex
+		snaps     []*shardSnapshot
+		abandoned bool
+	)
+	err := d.runExclusive(ctx, func() error {
+		shards, err := sel()
+		if err != nil {
+			return err
+		}
+		taken, err := d.snapshotShards(shards, transients)
+		lk.Lock()
+		defer lk.Unlock()
+		if abandoned {
+			closeSnapshots(taken)
+		} else {
+			snaps = taken
+		}
+		return err
+	})
+
+	lk.Lock()
+	defer lk.Unlock()
+	abandoned = true
+	if err != nil {
+		closeSnapshots(snaps)
+		return nil, err
+	}
+	return snaps, nil
+}
+
+// shardSnapshot is the state of a shard captured by snapshotShards. The index
+// and the transient are pinned by holding them open, so that they can be
+// read after the event loop resumes.
+type shardSnapshot struct {
+	key    shard.Key
+	record []byte
+
+	// index is the serialized full index, if the index repo supports opening
+	// indices; otherwise, idx is the full index. Both are nil if the shard
+	// has no index.
+	index     io.ReadCloser
+	indexSize int64
+	idx       carindex.Index
+
+	// transient is the plaintext of the transient copy, if requested and
+	// present.
+	transient mount.Reader
+}
+
+// snapshotShards captures the state of the supplied shards. It must be called
+// with exclusivity from the event loop, and it's meant to be quick: the bulk
+// data is opened, but not read.
+func (d *DAGStore) snapshotShards(shards []*Shard, transients bool) (snaps []*shardSnapshot, err error) {
+	defer func() {
+		if err != nil {
+			closeSnapshots(snaps)
+			snaps = nil
+		}
+	}()
+
+	opener, _ := d.indices.(index.FullIndexOpener)
+	for _, s := range shards {
+		snap := &shardSnapshot{key: s.key}
+		snaps = append(snaps, snap)
+
+		s.lk.RLock()
+		snap.record, err = s.MarshalJSON()
+		s.lk.RUnlock()
+		if err != nil {
+			return snaps, fmt.Errorf("failed to serialize shard %s: %w", s.key, err)
+		}
+
+		if istat, err := d.indices.StatFullIndex(s.key); err != nil || !istat.Exists {
+			log.Debugw("backup: no index for shard; skipping", "shard", s.key, "error", err)
+		} else if opener != nil {
+			if snap.index, snap.indexSize, err = opener.OpenFullIndex(s.key); err != nil {
+				return snaps, fmt.Errorf("failed to open index for shard %s: %w", s.key, err)
+			}
+		} else if snap.idx, err = d.indices.GetFullIndex(s.key); err != nil {
+			return snaps, fmt.Errorf("failed to get index for shard %s: %w", s.key, err)
+		}
+
+		if !transients {
+			continue
+		}
+		p := s.mount.TransientPath()
+		if p == "" {
+			continue
+		}
+		// the transient may be encrypted at rest; back up the plaintext, so
+		// that the backup can be restored with a different key.
+		if snap.transient, err = s.mount.OpenTransient(); err != nil {
+			log.Warnw("backup: failed to open transient; skipping", "shard", s.key, "path", p, "error", err)
+			err = nil
+		}
+	}
+	return snaps, nil
+}
+
+// closeSnapshots releases the data pinned by the supplied snapshots.
+func closeSnapshots(snaps []*shardSnapshot) {
+	for _, snap := range snaps {
+		if snap.index != nil {
+			_ = snap.index.Close()
+		}
+		if snap.transient != nil {
+			_ = snap.transient.Close()
+		}
+	}
+}
+
+// writeArchive writes an archive containing the supplied shard snapshots to w.
+func (d *DAGStore) writeArchive(ctx context.Context, w io.Writer, snaps []*shardSnapshot, transients bool) error {
+	aw, err := newArchiveWriter(w, len(snaps), transients)
+	if err != nil {
+		return err
+	}
+
+	// write the shard records.
+	for _, snap := range snaps {
+		if err := aw.writeShard(snap.key, snap.record); err != nil {
+			return err
+		}
+	}
+
+	// write the indices.
+	for _, snap := range snaps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		switch {
+		case snap.index != nil:
+			err = aw.writeSerializedIndex(snap.key, snap.index, snap.indexSize)
+		case snap.idx != nil:
+			err = aw.writeIndex(snap.key, snap.idx)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// write the transients.
+	for _, snap := range snaps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if snap.transient == nil {
+			continue
+		}
+		if err := aw.writeTransient(snap.key, snap.transient); err != nil {
+			return err
+		}
+	}
+
+	return aw.Close()
+}
+
+// RestoreConflictPolicy determines what happens when restoring a backup that
+// contains shards that already exist in the DAG store.
+type RestoreConflictPolicy int
+
+const (
+	// RestoreAbort aborts the restore before anything is written if any
+	// shard in the backup already exists.
+	RestoreAbort RestoreConflictPolicy = iota
+
+	// RestoreSkip skips shards that already exist, retaining their
+	// current state.
+	RestoreSkip
+
+	// RestoreOverwrite replaces shards that already exist with the state
+	// contained in the backup.
+	RestoreOverwrite
+)
+
+type RestoreOpts struct {
+	// OnConflict determines what happens with shards that already exist.
+	OnConflict RestoreConflictPolicy
+}
+
+// RestoreResult summarizes the outcome of a restore.
+type RestoreResult struct {
+	// Restored contains the keys of shards that were restored.
+	Restored []shard.Key
+	// Skipped contains the keys of shards that were skipped because they
+	// already existed.
+	Skipped []shard.Key
+}
+
+// Restore restores a backup created by Backup into this DAG store. It must be
+// called before Start, and the restored shards will be loaded by Start.
+//
+// All shard records are validated before anything is written: the backup
+// version must be supported, and every mount must be recognized by the mount
+// registry. Transients are only restored if they are present in the backup;
+// otherwise, restored shards will refetch from their mounts when needed.
+func (d *DAGStore) Restore(ctx context.Context, r io.Reader, opts RestoreOpts) (*RestoreResult, error) {
+	d.lk.RLock()
+	started := d.started
+	d.lk.RUnlock()
+	if started {
+		return nil, fmt.Errorf("cannot restore a backup into a started dag store")
+	}
+
+	ar, err := d.readArchive(r)
+	if err != nil {
+		return nil, err
+	}
+
+	res := new(RestoreResult)
+	restore := make(map[string]*PersistedShard, len(ar.shards))
+	for _, ps := range ar.shards {
+		k := ds.NewKey(ps.Key)
+		exists, err := d.store.Has(k)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check for existing shard %s: %w", ps.Key, err)
+		}
+		if exists {
+			switch opts.OnConflict {
+			case RestoreAbort:
+				return nil, fmt.Errorf("%w: shard %s", ErrRestoreConflict, ps.Key)
+			case RestoreSkip:
+				res.Skipped = append(res.Skipped, shard.KeyFromString(ps.Key))
+				continue
+			}
+		}
+		// transient paths in the backup refer to the source filesystem; they
+		// will be replaced with restored transients, if any.
+		ps.TransientPath = ""
+		restore[ps.Key] = ps
+	}
+
+	// restore the bulk data.
+	err = ar.forEachData(func(dir string, key string, r io.Reader) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ps, ok := restore[key]
+		if !ok {
+			return nil // skipped.
+		}
+		switch dir {
+		case backupIndicesDir:
+			idx, err := carindex.ReadFrom(r)
+			if err != nil {
+				return fmt.Errorf("failed to read index for shard %s: %w", key, err)
+			}
+			if err := d.indices.AddFullIndex(shard.KeyFromString(key), idx); err != nil {
+				return fmt.Errorf("failed to add index for shard %s: %w", key, err)
+			}
+		case backupTransientsDir:
+			p, err := d.restoreTransient(r, d.transientsEnc)
+			if err != nil {
+				return fmt.Errorf("failed to restore transient for shard %s: %w", key, err)
+			}
+			ps.TransientPath = p
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// finally, persist the shard records.
+	for _, ps := range ar.shards {
+		if _, ok := restore[ps.Key]; !ok {
+			continue
+		}
+		bz, err := json.Marshal(ps)
+		if err != nil {
+			return nil, fmt.Errorf("failed to serialize shard %s: %w", ps.Key, err)
+		}
+		if err := d.store.Put(ds.NewKey(ps.Key), bz); err != nil {
+			return nil, fmt.Errorf("failed to put shard %s: %w", ps.Key, err)
+		}
+		res.Restored = append(res.Restored, shard.KeyFromString(ps.Key))
+	}
+	if err := d.store.Sync(ds.Key{}); err != nil {
+		return nil, fmt.Errorf("failed to sync restored shards to store: %w", err)
+	}
+	return res, nil
+}
+
+// restoreTransient copies a transient from the archive into the transients
+// directory, returning its path. If enc is not nil, the data is encrypted with
+// it on the way.
+func (d *DAGStore) restoreTransient(r io.Reader, enc *transform.AESGCM) (string, error) {
+	f, err := os.CreateTemp(d.config.TransientsDir, "transient-restored-*")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if enc != nil {
+		err = enc.Encrypt(f, r)
+	} else {
+		_, err = io.Copy(f, r)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// archiveReader reads an archive written by writeArchive. The manifest and the
+// shard records are read and validated eagerly; the bulk data is streamed
+// through forEachData.
+type archiveReader struct {
+	tr       *tar.Reader
+	manifest BackupManifest
+	shards   []*PersistedShard
+
+	// next is the first data entry, which we read while consuming shard records.
+	next *tar.Header
+}
+
+func (d *DAGStore) readArchive(r io.Reader) (*archiveReader, error) {
+	ar := &archiveReader{tr: tar.NewReader(r)}
+
+	hdr, err := ar.tr.Next()
+	if err != nil || hdr.Name != backupManifestEntry {
+		return nil, fmt.Errorf("%w: missing manifest", ErrInvalidBackup)
+	}
+	if err := json.NewDecoder(ar.tr).Decode(&ar.manifest); err != nil {
+		return nil, fmt.Errorf("%w: failed to decode manifest: %s", ErrInvalidBackup, err)
+	}
+	if v := ar.manifest.Version; v != BackupVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidBackup, v)
+	}
+
+	for {
+		hdr, err := ar.tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidBackup, err)
+		}
+		if !strings.HasPrefix(hdr.Name, backupShardsDir) {
+			ar.next = hdr
+			break
+		}
+
+		ps := new(PersistedShard)
+		if err := json.NewDecoder(ar.tr).Decode(ps); err != nil {
+			return nil, fmt.Errorf("%w: failed to decode shard record %s: %s", ErrInvalidBackup, hdr.Name, err)
+		}
+		if err := d.validatePersistedShard(ps); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidBackup, err)
+		}
+		ar.shards = append(ar.shards, ps)
+	}
+
+	if len(ar.shards) != ar.manifest.Shards {
+		return nil, fmt.Errorf("%w: manifest announced %d shards; found %d", ErrInvalidBackup, ar.manifest.Shards, len(ar.shards))
+	}
+	return ar, nil
+}
+
+// forEachData calls the callback for every index and transient in the archive,
+// with the directory the entry belongs to, and the shard key.
+func (ar *archiveReader) forEachData(cb func(dir string, key string, r io.Reader) error) error {
+	for hdr := ar.next; hdr != nil; {
+		var dir, name string
+		switch {
+		case strings.HasPrefix(hdr.Name, backupIndicesDir):
+			dir, name = backupIndicesDir, strings.TrimSuffix(strings.TrimPrefix(hdr.Name, backupIndicesDir), backupIndexSuffix)
+		case strings.HasPrefix(hdr.Name, backupTransientsDir):
+			dir, name = backupTransientsDir, strings.TrimPrefix(hdr.Name, backupTransientsDir)
+		default:
+			return fmt.Errorf("%w: unexpected entry %s", ErrInvalidBackup, hdr.Name)
+		}
+		key, err := url.PathUnescape(name)
+		if err != nil {
+			return fmt.Errorf("%w: invalid entry name %s", ErrInvalidBackup, hdr.Name)
+		}
+		if err := cb(dir, key, ar.tr); err != nil {
+			return err
+		}
+
+		hdr, err = ar.tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidBackup, err)
+		}
+	}
+	return nil
+}
+
+// validatePersistedShard checks that a persisted shard can be revived by this
+// DAG store.
+func (d *DAGStore) validatePersistedShard(ps *PersistedShard) error {
+	if ps.Key == "" {
+		return fmt.Errorf("shard record with empty key")
+	}
+	if _, err := d.instantiateMount(ps); err != nil {
+		return fmt.Errorf("shard %s: %w", ps.Key, err)
+	}
+	return nil
+}
+
+// archiveWriter writes archives in the format described at the top of this
+// file. Callers must write all shard records, then all indices, and finally
+// all transients.
+type archiveWriter struct {
+	tw  *tar.Writer
+	now time.Time
+}
+
+func newArchiveWriter(w io.Writer, shards int, transients bool) (*archiveWriter, error) {
+	aw := &archiveWriter{tw: tar.NewWriter(w), now: time.Now()}
+
+	manifest := BackupManifest{
+		Version:    BackupVersion,
+		Created:    aw.now,
+		Shards:     shards,
+		Transients: transients,
+	}
+	bz, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize backup manifest: %w", err)
+	}
+	if err := aw.writeEntry(backupManifestEntry, int64(len(bz)), bytes.NewReader(bz)); err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+func (aw *archiveWriter) writeShard(k shard.Key, bz []byte) error {
+	return aw.writeEntry(backupShardsDir+escapeKey(k)+backupShardSuffix, int64(len(bz)), bytes.NewReader(bz))
+}
+
+func (aw *archiveWriter) writeIndex(k shard.Key, idx carindex.Index) error {
+	// we don't know the size of the serialized index upfront, so buffer it.
+	var buf bytes.Buffer
+	if err := carindex.WriteTo(idx, &buf); err != nil {
+		return fmt.Errorf("failed to serialize index for shard %s: %w", k, err)
+	}
+	return aw.writeSerializedIndex(k, &buf, int64(buf.Len()))
+}
+
+// writeSerializedIndex writes an index that is already serialized.
+func (aw *archiveWriter) writeSerializedIndex(k shard.Key, r io.Reader, size int64) error {
+	return aw.writeEntry(backupIndicesDir+escapeKey(k)+backupIndexSuffix, size, r)
+}
+
+// writeTransient writes the shard data from r, which is fully consumed.
+func (aw *archiveWriter) writeTransient(k shard.Key, r io.ReadSeeker) error {
+	// determine the size by seeking to the end, and rewind.
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to determine size of data for shard %s: %w", k, err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind data for shard %s: %w", k, err)
+	}
+	return aw.writeEntry(backupTransientsDir+escapeKey(k), size, r)
+}
+
+func (aw *archiveWriter) writeEntry(name string, size int64, r io.Reader) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: aw.now,
+	}
+	if err := aw.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write archive entry %s: %w", name, err)
+	}
+	// copy exactly the announced size, in case the source grows under us.
+	if _, err := io.CopyN(aw.tw, r, size); err != nil {
+		return fmt.Errorf("failed to write archive entry %s: %w", name, err)
+	}
+	return nil
+}
+
+func (aw *archiveWriter) Close() error {
+	return aw.tw.Close()
+}
+
+// escapeKey escapes a shard key so that it can be used as a single archive
+// path segment.
+func escapeKey(k shard.Key) string {
+	return url.PathEscape(k.String())
+}
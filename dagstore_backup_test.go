@@ -0,0 +1,429 @@
+package dagstore
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore/index"
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+	"github.com/filecoin-project/dagstore/testdata"
+)
+
+func TestBackupRestore(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	keys := registerShards(t, dagst, 8, carv2mnt, RegisterOpts{})
+
+	ch := make(chan ShardResult, 1)
+	lazy := shard.KeyFromString("lazy")
+	err = dagst.RegisterShard(context.Background(), lazy, carv2mnt, ch, RegisterOpts{LazyInitialization: true})
+	require.NoError(t, err)
+	res := <-ch
+	require.NoError(t, res.Error)
+
+	var buf bytes.Buffer
+	err = dagst.Backup(context.Background(), &buf, BackupOpts{IncludeTransients: true})
+	require.NoError(t, err)
+	backup := buf.Bytes()
+
+	newStore := func(t *testing.T, store datastore.Batching) *DAGStore {
+		idx, err := index.NewFSRepo(t.TempDir())
+		require.NoError(t, err)
+		dagst, err := NewDAGStore(Config{
+			MountRegistry: testRegistry(t),
+			TransientsDir: t.TempDir(),
+			Datastore:     store,
+			IndexRepo:     idx,
+		})
+		require.NoError(t, err)
+		return dagst
+	}
+
+	t.Run("restore into fresh store", func(t *testing.T) {
+		restored := newStore(t, dssync.MutexWrap(datastore.NewMapDatastore()))
+		rres, err := restored.Restore(context.Background(), bytes.NewReader(backup), RestoreOpts{})
+		require.NoError(t, err)
+		require.Len(t, rres.Restored, 9)
+		require.Empty(t, rres.Skipped)
+
+		err = restored.Start(context.Background())
+		require.NoError(t, err)
+		defer restored.Close()
+
+		info := restored.AllShardsInfo()
+		require.Len(t, info, 9)
+		require.Equal(t, ShardStateNew, info[lazy].ShardState)
+
+		for _, k := range keys {
+			require.Equal(t, ShardStateAvailable, info[k].ShardState)
+
+			// transients were restored, and point to the new transients dir.
+			p := restored.shards[k].mount.TransientPath()
+			require.NotEmpty(t, p)
+			_, err := os.Stat(p)
+			require.NoError(t, err)
+
+			// we can acquire the shard without reindexing.
+			accessors := acquireShard(t, restored, k, 2)
+			releaseAll(t, restored, k, accessors)
+		}
+	})
+
+	t.Run("conflicts", func(t *testing.T) {
+		store := dssync.MutexWrap(datastore.NewMapDatastore())
+		existing := newStore(t, store)
+		err := existing.Start(context.Background())
+		require.NoError(t, err)
+		registerShards(t, existing, 1, carv2mnt, RegisterOpts{}) // shard-0
+		err = existing.Close()
+		require.NoError(t, err)
+
+		// abort: nothing is written.
+		restored := newStore(t, store)
+		_, err = restored.Restore(context.Background(), bytes.NewReader(backup), RestoreOpts{OnConflict: RestoreAbort})
+		require.ErrorIs(t, err, ErrRestoreConflict)
+		n, err := restored.indices.Len()
+		require.NoError(t, err)
+		require.Zero(t, n)
+
+		// skip: everything but the existing shard is restored.
+		rres, err := restored.Restore(context.Background(), bytes.NewReader(backup), RestoreOpts{OnConflict: RestoreSkip})
+		require.NoError(t, err)
+		require.Len(t, rres.Restored, 8)
+		require.Equal(t, []shard.Key{shard.KeyFromString("shard-0")}, rres.Skipped)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		restored := newStore(t, dssync.MutexWrap(datastore.NewMapDatastore()))
+		_, err := restored.Restore(context.Background(), bytes.NewReader([]byte("garbage")), RestoreOpts{})
+		require.ErrorIs(t, err, ErrInvalidBackup)
+
+		// cannot restore into a started store.
+		err = restored.Start(context.Background())
+		require.NoError(t, err)
+		defer restored.Close()
+		_, err = restored.Restore(context.Background(), bytes.NewReader(backup), RestoreOpts{})
+		require.Error(t, err)
+	})
+}
+
+func TestBackupRestoreEncryptedTransients(t *testing.T) {
+	newStore := func(t *testing.T, key []byte) *DAGStore {
+		dagst, err := NewDAGStore(Config{
+			MountRegistry: testRegistry(t),
+			TransientsDir: t.TempDir(),
+			TransientsKey: key,
+		})
+		require.NoError(t, err)
+		return dagst
+	}
+
+	for name, keys := range map[string][2][]byte{
+		"encrypted to plaintext": {bytes.Repeat([]byte{7}, 32), nil},
+		"plaintext to encrypted": {nil, bytes.Repeat([]byte{7}, 32)},
+		"different keys":         {bytes.Repeat([]byte{7}, 32), bytes.Repeat([]byte{8}, 32)},
+	} {
+		keys := keys
+		t.Run(name, func(t *testing.T) {
+			src := newStore(t, keys[0])
+			require.NoError(t, src.Start(context.Background()))
+			defer src.Close()
+			k := registerShards(t, src, 1, carv2mnt, RegisterOpts{})[0]
+
+			var buf bytes.Buffer
+			require.NoError(t, src.Backup(context.Background(), &buf, BackupOpts{IncludeTransients: true}))
+
+			dst := newStore(t, keys[1])
+			_, err := dst.Restore(context.Background(), bytes.NewReader(buf.Bytes()), RestoreOpts{})
+			require.NoError(t, err)
+			require.NoError(t, dst.Start(context.Background()))
+			defer dst.Close()
+
+			// the transient is stored as the destination expects it.
+			p := dst.shards[k].mount.TransientPath()
+			require.NotEmpty(t, p)
+			bz, err := os.ReadFile(p)
+			require.NoError(t, err)
+			if keys[1] == nil {
+				require.Equal(t, testdata.CarV2, bz)
+			} else {
+				require.NotEqual(t, testdata.CarV2[:64], bz[:64])
+			}
+
+			// and it's served without refetching.
+			ch := make(chan ShardResult, 1)
+			require.NoError(t, dst.AcquireShard(context.Background(), k, ch, AcquireOpts{}))
+			res := <-ch
+			require.NoError(t, res.Error)
+			defer res.Accessor.Close()
+			bs, err := res.Accessor.Blockstore()
+			require.NoError(t, err)
+			blk, err := bs.Get(testdata.RootCID)
+			require.NoError(t, err)
+			require.Equal(t, testdata.RootCID, blk.Cid())
+			require.Zero(t, dst.shards[k].mount.TimesFetched())
+		})
+	}
+}
+
+func TestExportImportShard(t *testing.T) {
+	newStore := func(t *testing.T) *DAGStore {
+		dagst, err := NewDAGStore(Config{
+			MountRegistry: testRegistry(t),
+			TransientsDir: t.TempDir(),
+		})
+		require.NoError(t, err)
+		err = dagst.Start(context.Background())
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = dagst.Close() })
+		return dagst
+	}
+
+	src := newStore(t)
+	opts := RegisterOpts{ExpectedRoots: []cid.Cid{testdata.RootCID}, Indexing: &IndexingOpts{VerifyHashes: true}}
+	k := registerShards(t, src, 1, carv2mnt, opts)[0]
+
+	var withData, withoutData bytes.Buffer
+	err := src.ExportShard(context.Background(), k, &withData, ExportShardOpts{IncludeData: true})
+	require.NoError(t, err)
+	err = src.ExportShard(context.Background(), k, &withoutData, ExportShardOpts{})
+	require.NoError(t, err)
+
+	// the shard is released after exporting.
+	require.Eventually(t, func() bool {
+		info, err := src.GetShardInfo(k)
+		return err == nil && info.ShardState == ShardStateAvailable && info.refs == 0
+	}, 5*time.Second, 100*time.Millisecond)
+
+	t.Run("with data", func(t *testing.T) {
+		dst := newStore(t)
+		counting := &mount.Counting{Mount: carv2mnt}
+		ch := make(chan ShardResult, 1)
+		err := dst.ImportShard(context.Background(), bytes.NewReader(withData.Bytes()), ch, ImportShardOpts{Mount: counting})
+		require.NoError(t, err)
+		res := <-ch
+		require.NoError(t, res.Error)
+		require.Equal(t, k, res.Key)
+
+		info, err := dst.GetShardInfo(k)
+		require.NoError(t, err)
+		require.Equal(t, ShardStateAvailable, info.ShardState)
+
+		// the settings of the shard are carried over.
+		s := dst.shards[k]
+		require.Equal(t, opts.ExpectedRoots, s.expectedRoots)
+		require.Equal(t, opts.Indexing, s.indexing)
+
+		// the bundled data is used as the transient, so the mount is never fetched.
+		accessors := acquireShard(t, dst, k, 2)
+		releaseAll(t, dst, k, accessors)
+		require.Zero(t, counting.Count())
+
+		// importing again fails.
+		err = dst.ImportShard(context.Background(), bytes.NewReader(withData.Bytes()), ch, ImportShardOpts{})
+		require.ErrorIs(t, err, ErrShardExists)
+	})
+
+	t.Run("without data", func(t *testing.T) {
+		dst := newStore(t)
+		ch := make(chan ShardResult, 1)
+		err := dst.ImportShard(context.Background(), bytes.NewReader(withoutData.Bytes()), ch, ImportShardOpts{})
+		require.NoError(t, err)
+		res := <-ch
+		require.NoError(t, res.Error)
+
+		info, err := dst.GetShardInfo(k)
+		require.NoError(t, err)
+		require.Equal(t, ShardStateAvailable, info.ShardState)
+
+		accessors := acquireShard(t, dst, k, 2)
+		releaseAll(t, dst, k, accessors)
+	})
+
+	t.Run("dropped if not queued", func(t *testing.T) {
+		// a closed DAG store whose queue is full.
+		dst := newStore(t)
+		require.NoError(t, dst.Close())
+		for len(dst.externalCh) < cap(dst.externalCh) {
+			dst.externalCh <- &task{}
+		}
+
+		err := dst.ImportShard(context.Background(), bytes.NewReader(withData.Bytes()), nil, ImportShardOpts{})
+		require.Error(t, err)
+
+		_, err = dst.GetShardInfo(k)
+		require.ErrorIs(t, err, ErrShardUnknown)
+		istat, err := dst.indices.StatFullIndex(k)
+		require.NoError(t, err)
+		require.False(t, istat.Exists)
+		entries, err := os.ReadDir(dst.config.TransientsDir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+
+	t.Run("without data doesn't acquire", func(t *testing.T) {
+		// a lazy shard isn't initialized by exporting it without data.
+		lazy := shard.KeyFromString("lazy")
+		err := src.RegisterShard(context.Background(), lazy, carv2mnt, nil, RegisterOpts{LazyInitialization: true})
+		require.NoError(t, err)
+
+		var bundle bytes.Buffer
+		err = src.ExportShard(context.Background(), lazy, &bundle, ExportShardOpts{})
+		require.NoError(t, err)
+
+		info, err := src.GetShardInfo(lazy)
+		require.NoError(t, err)
+		require.Equal(t, ShardStateNew, info.ShardState)
+		require.Zero(t, info.refs)
+
+		err = src.ExportShard(context.Background(), shard.KeyFromString("unknown"), &bundle, ExportShardOpts{})
+		require.ErrorIs(t, err, ErrShardUnknown)
+	})
+}
+
+func TestRunExclusiveCancelled(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started, release := make(chan struct{}), make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- dagst.runExclusive(ctx, func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+
+	// cancel the caller while the job is running in the event loop.
+	<-started
+	cancel()
+	require.ErrorIs(t, <-errCh, context.Canceled)
+	close(release)
+
+	// the event loop isn't blocked delivering the result to the caller that
+	// went away.
+	registerShards(t, dagst, 1, carv2mnt, RegisterOpts{})
+	var buf bytes.Buffer
+	err = dagst.Backup(context.Background(), &buf, BackupOpts{})
+	require.NoError(t, err)
+}
+
+// blockingWriter blocks the first write until released.
+type blockingWriter struct {
+	bytes.Buffer
+	once    sync.Once
+	writing chan struct{}
+	release chan struct{}
+}
+
+func newBlockingWriter() *blockingWriter {
+	return &blockingWriter{writing: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.writing)
+		<-w.release
+	})
+	return w.Buffer.Write(p)
+}
+
+func TestBackupStreamsOutsideEventLoop(t *testing.T) {
+	idx, err := index.NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		IndexRepo:     idx,
+	})
+	require.NoError(t, err)
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	keys := registerShards(t, dagst, 2, carv2mnt, RegisterOpts{})
+
+	t.Run("completes", func(t *testing.T) {
+		w := newBlockingWriter()
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- dagst.Backup(context.Background(), w, BackupOpts{IncludeTransients: true})
+		}()
+		<-w.writing
+
+		// the event loop keeps operating while the backup is written, and
+		// changes after the snapshot don't make it into the backup.
+		ch := make(chan ShardResult, 1)
+		err := dagst.RegisterShard(context.Background(), shard.KeyFromString("late"), carv2mnt, ch, RegisterOpts{})
+		require.NoError(t, err)
+		require.NoError(t, (<-ch).Error)
+		err = dagst.DestroyShard(context.Background(), keys[0], ch, DestroyOpts{})
+		require.NoError(t, err)
+		require.NoError(t, (<-ch).Error)
+
+		close(w.release)
+		require.NoError(t, <-errCh)
+
+		restored, err := NewDAGStore(Config{
+			MountRegistry: testRegistry(t),
+			TransientsDir: t.TempDir(),
+		})
+		require.NoError(t, err)
+		rres, err := restored.Restore(context.Background(), bytes.NewReader(w.Bytes()), RestoreOpts{})
+		require.NoError(t, err)
+		require.ElementsMatch(t, keys, rres.Restored)
+
+		// the data of the destroyed shard was pinned by the snapshot.
+		err = restored.Start(context.Background())
+		require.NoError(t, err)
+		defer restored.Close()
+		for _, k := range keys {
+			require.NotEmpty(t, restored.shards[k].mount.TransientPath())
+			accessors := acquireShard(t, restored, k, 1)
+			releaseAll(t, restored, k, accessors)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		w := newBlockingWriter()
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- dagst.Backup(ctx, w, BackupOpts{IncludeTransients: true})
+		}()
+		<-w.writing
+		cancel()
+		close(w.release)
+		require.ErrorIs(t, <-errCh, context.Canceled)
+
+		// the store is still operational.
+		var buf bytes.Buffer
+		err := dagst.Backup(context.Background(), &buf, BackupOpts{})
+		require.NoError(t, err)
+	})
+}
@@ -3,6 +3,11 @@ package dagstore
 import (
 	"context"
 	"fmt"
+	"os"
+
+	ds "github.com/ipfs/go-datastore"
+
+	"github.com/filecoin-project/dagstore/mount"
 )
 
 type OpType int
@@ -16,6 +21,9 @@ const (
 	OpShardFail
 	OpShardRelease
 	OpShardRecover
+	OpShardUpdateMount
+	OpShardMountUnreachable
+	OpShardMountReachable
 )
 
 func (o OpType) String() string {
@@ -27,7 +35,10 @@ func (o OpType) String() string {
 		"OpShardAcquire",
 		"OpShardFail",
 		"OpShardRelease",
-		"OpShardRecover"}[o]
+		"OpShardRecover",
+		"OpShardUpdateMount",
+		"OpShardMountUnreachable",
+		"OpShardMountReachable"}[o]
 }
 
 // control runs the DAG store's event loop.
@@ -42,7 +53,7 @@ func (d *DAGStore) control() {
 
 	for {
 		// consume the next task or GC request; if we're shutting down, this method will error.
-		tsk, gc, err := d.consumeNext()
+		tsk, gc, excl, err := d.consumeNext()
 		if err != nil {
 			if err == context.Canceled {
 				log.Infow("dagstore closed")
@@ -58,20 +69,45 @@ func (d *DAGStore) control() {
 			continue
 		}
 
+		if excl != nil {
+			// this was a job requiring exclusivity.
+			excl.run()
+			continue
+		}
+
 		s := tsk.shard
 		log.Debugw("processing task", "op", tsk.op, "shard", tsk.shard.key, "error", tsk.err)
 
 		s.lk.Lock()
 		prevState := s.state
 
-		switch tsk.op {
-		case OpShardRegister:
-			if s.state != ShardStateNew {
-				// sanity check failed
-				_ = d.failShard(s, d.internalCh, "%w: expected shard to be in 'new' state; was: %s", ErrShardInitializationFailed, s.state)
-				break
+		// drop tasks queued for the shard before it was destroyed, such as
+		// the failure of its interrupted initialization; the shard is gone,
+		// so it mustn't be persisted again, nor reported.
+		if s.destroyed {
+			log.Debugw("dropped task for destroyed shard", "op", tsk.op, "shard", s.key)
+			if tsk.waiter != nil {
+				d.dispatchResult(&ShardResult{Key: s.key, Error: ErrShardUnknown}, tsk.waiter)
 			}
+			s.lk.Unlock()
+			continue
+		}
+
+		if err := d.runBeforeHooks(tsk); err != nil {
+			d.rejectOp(tsk, err)
+			s.lk.Unlock()
+			continue
+		}
 
+		// reject operations that are illegal in the current state.
+		if err := checkTransition(tsk.op, s.state); err != nil {
+			d.rejectOp(tsk, err)
+			s.lk.Unlock()
+			continue
+		}
+
+		switch tsk.op {
+		case OpShardRegister:
 			// skip initialization if shard was registered with lazy init, and
 			// respond immediately to waiter.
 			if s.lazy {
@@ -98,7 +134,7 @@ func (d *DAGStore) control() {
 				break
 			}
 
-			go d.initializeShard(tsk.ctx, s, s.mount)
+			d.startInitialize(tsk.ctx, s)
 
 		case OpShardMakeAvailable:
 			// can arrive here after initializing a new shard,
@@ -156,6 +192,27 @@ func (d *DAGStore) control() {
 				break
 			}
 
+			// if the mount is unreachable, fail the acquire immediately, or
+			// make the acquirer wait until it's reachable again.
+			if s.state == ShardStateUnavailable {
+				if !tsk.waitUnavailable {
+					err := fmt.Errorf("%w: %s", ErrShardUnavailable, s.err)
+					res := &ShardResult{Key: s.key, Error: err}
+					d.dispatchResult(res, w)
+					break
+				}
+				log.Debugw("shard is unavailable, will queue acquire channel", "shard", s.key)
+				s.wAcquire = append(s.wAcquire, w)
+				// check right away, rather than waiting for the next round.
+				// Close waits for the check.
+				d.wg.Add(1)
+				go func() {
+					defer d.wg.Done()
+					d.checkMount(s)
+				}()
+				break
+			}
+
 			if s.state != ShardStateAvailable && s.state != ShardStateServing {
 				log.Debugw("shard isn't active yet, will queue acquire channel", "shard", s.key)
 				// shard state isn't active yet; make this acquirer wait.
@@ -187,8 +244,8 @@ func (d *DAGStore) control() {
 			go d.acquireAsync(tsk.ctx, w, s, s.mount)
 
 		case OpShardRelease:
-			if (s.state != ShardStateServing && s.state != ShardStateErrored) || s.refs <= 0 {
-				log.Warn("ignored illegal request to release shard")
+			if s.refs == 0 {
+				log.Warnw("ignored request to release shard with no references", "shard", s.key, "state", s.state)
 				break
 			}
 
@@ -197,11 +254,14 @@ func (d *DAGStore) control() {
 
 			// reset state back to available, if we were the last
 			// active acquirer.
-			if s.refs == 0 {
+			if s.refs == 0 && s.state == ShardStateServing {
 				s.state = ShardStateAvailable
 			}
 
 		case OpShardFail:
+			// keep the secrets of the mount out of the error, as it's
+			// persisted, traced, and reported through ShardInfo.
+			tsk.err = mount.RedactError(tsk.err, d.mounts.Secrets(s.mount)...)
 			s.state = ShardStateErrored
 			s.err = tsk.err
 
@@ -254,13 +314,6 @@ func (d *DAGStore) control() {
 			}
 
 		case OpShardRecover:
-			if s.state != ShardStateErrored {
-				err := fmt.Errorf("refused to recover shard in state other than errored; current state: %d", s.state)
-				res := &ShardResult{Key: s.key, Error: err}
-				d.dispatchResult(res, tsk.waiter)
-				break
-			}
-
 			// set the state to recovering.
 			s.state = ShardStateRecovering
 
@@ -285,70 +338,229 @@ func (d *DAGStore) control() {
 			}
 
 			// fetch again and reindex.
-			go d.initializeShard(tsk.ctx, s, s.mount)
+			d.startInitialize(tsk.ctx, s)
 
 		case OpShardDestroy:
-			if s.state == ShardStateServing || s.refs > 0 {
-				err := fmt.Errorf("failed to destroy shard; active references: %d", s.refs)
+			if s.refs > 0 {
+				err := fmt.Errorf("failed to destroy shard: %w; active references: %d", ErrShardInUse, s.refs)
 				res := &ShardResult{Key: s.key, Error: err}
 				d.dispatchResult(res, tsk.waiter)
 				break
 			}
 
+			// interrupt initialization, if it's ongoing.
+			if s.cancelInit != nil {
+				s.cancelInit()
+			}
+
 			d.lk.Lock()
 			delete(d.shards, s.key)
 			d.lk.Unlock()
-			// TODO are we guaranteed that there are no queued items for this shard?
+			s.destroyed = true
+
+			// the shard won't complete initialization or recovery anymore,
+			// so notify whoever is waiting for it.
+			if s.wRegister != nil {
+				d.dispatchResult(&ShardResult{Key: s.key, Error: fmt.Errorf("failed to register shard: %w", ErrShardUnknown)}, s.wRegister)
+				s.wRegister = nil
+			}
+			if s.wRecover != nil {
+				d.dispatchResult(&ShardResult{Key: s.key, Error: fmt.Errorf("failed to recover shard: %w", ErrShardUnknown)}, s.wRecover)
+				s.wRecover = nil
+			}
+			if len(s.wAcquire) > 0 {
+				res := &ShardResult{Key: s.key, Error: fmt.Errorf("failed to acquire shard: %w", ErrShardUnknown)}
+				d.dispatchResult(res, s.wAcquire...)
+				s.wAcquire = s.wAcquire[:0]
+			}
+
+			// abort any streaming download, and wait for it, so that it
+			// doesn't write files after we've deleted them.
+			if err := s.mount.Close(); err != nil {
+				log.Warnw("destroy: failed to close mount", "shard", s.key, "error", err)
+			}
+
+			// drop the data of the shard, so that a shard registered with the
+			// same key later on starts afresh.
+			if err := s.mount.DeleteTransient(); err != nil {
+				log.Warnw("destroy: failed to delete transient", "shard", s.key, "error", err)
+			}
+			// remove the files of partial downloads, and of sparse caches.
+			for _, p := range s.mount.ManagedFiles() {
+				if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+					log.Warnw("destroy: failed to remove transient file", "shard", s.key, "path", p, "error", err)
+				}
+			}
+			if _, err := d.indices.DropFullIndex(s.key); err != nil {
+				log.Warnw("destroy: failed to drop index for shard", "shard", s.key, "error", err)
+			}
+			if err := d.config.Datastore.Delete(ds.NewKey(s.key.String())); err != nil {
+				log.Warnw("destroy: failed to delete shard state", "shard", s.key, "error", err)
+			}
+			d.dispatchResult(&ShardResult{Key: s.key}, tsk.waiter)
+
+		case OpShardUpdateMount:
+			if s.refs > 0 {
+				err := fmt.Errorf("refused to update mount of shard: %w; active references: %d", ErrShardInUse, s.refs)
+				res := &ShardResult{Key: s.key, Error: err}
+				d.dispatchResult(res, tsk.waiter)
+				break
+			}
+
+			prev := s.mount
+			s.mount = tsk.mount
+
+			// abort any streaming download from the previous mount.
+			_ = prev.Close()
+
+			if tsk.keepIndex {
+				log.Debugw("updated shard mount; keeping index", "shard", s.key)
+				d.dispatchResult(&ShardResult{Key: s.key}, tsk.waiter)
+				break
+			}
+
+			// the shard will be reinitialized from the new mount, so drop the
+			// previous transient and index.
+			if err := prev.DeleteTransient(); err != nil {
+				log.Warnw("update mount: failed to delete previous transient", "shard", s.key, "error", err)
+			}
+			if _, err := d.indices.DropFullIndex(s.key); err != nil {
+				log.Warnw("update mount: failed to drop index for shard", "shard", s.key, "error", err)
+			}
+
+			// reset the shard as if it had been freshly registered.
+			s.state = ShardStateNew
+			s.err = nil
+			s.recoverOnNextAcquire = false
+
+			if s.lazy {
+				log.Debugw("updated shard mount; shard will be initialized on next acquire", "shard", s.key)
+				d.dispatchResult(&ShardResult{Key: s.key}, tsk.waiter)
+				break
+			}
+
+			s.wRegister = tsk.waiter
+			_ = d.queueTask(&task{op: OpShardInitialize, shard: s, waiter: tsk.waiter}, d.internalCh)
+
+		case OpShardMountUnreachable:
+			// only shards that are idle and have been checked with no
+			// transient copy become unavailable; the shard may have changed
+			// since the check.
+			if s.refs > 0 || s.mount.TransientPath() != "" {
+				log.Debugw("ignoring unreachable mount of shard", "shard", s.key, "state", s.state)
+				break
+			}
+			s.state = ShardStateUnavailable
+			s.err = tsk.err
+
+		case OpShardMountReachable:
+			// make the shard available, which also serves waiting acquirers.
+			_ = d.queueTask(&task{op: OpShardMakeAvailable, shard: s}, d.internalCh)
 
 		default:
 			panic(fmt.Sprintf("unrecognized shard operation: %d", tsk.op))
 
 		}
 
-		// persist the current shard state.
-		if err := s.persist(d.config.Datastore); err != nil { // TODO maybe fail shard?
-			log.Warnw("failed to persist shard", "shard", s.key, "error", err)
+		if !legalTransition(tsk.op, prevState, s.state) {
+			if panicOnIllegalTransition {
+				panic(fmt.Sprintf("shard %s performed a transition missing from the transition table: %s from %s to %s", s.key, tsk.op, prevState, s.state))
+			}
+			log.Errorw("shard performed a transition missing from the transition table", "op", tsk.op, "shard", s.key, "prev_state", prevState, "curr_state", s.state)
+		}
+
+		// persist the current shard state, unless it's gone.
+		if !s.destroyed {
+			if err := s.persist(d.config.Datastore); err != nil { // TODO maybe fail shard?
+				log.Warnw("failed to persist shard", "shard", s.key, "error", err)
+			}
+		}
+
+		after := ShardInfo{
+			ShardState: s.state,
+			Error:      s.err,
+			refs:       s.refs,
 		}
 
 		// send a notification if the user provided a notification channel.
 		if d.traceCh != nil {
 			log.Debugw("will write trace to the trace channel", "shard", s.key)
 			n := Trace{
-				Key: s.key,
-				Op:  tsk.op,
-				After: ShardInfo{
-					ShardState: s.state,
-					Error:      s.err,
-					refs:       s.refs,
-				},
+				Key:   s.key,
+				Op:    tsk.op,
+				After: after,
 			}
 			d.traceCh <- n
 			log.Debugw("finished writing trace to the trace channel", "shard", s.key)
 		}
 
+		// send a transition event if the state changed, and the user provided
+		// a transitions channel.
+		if ch := d.config.TransitionCh; ch != nil && prevState != s.state {
+			ch <- ShardTransition{Key: s.key, Op: tsk.op, From: prevState, To: s.state}
+		}
+
+		d.runAfterHooks(tsk, after)
+
 		log.Debugw("finished processing task", "op", tsk.op, "shard", tsk.shard.key, "prev_state", prevState, "curr_state", s.state, "error", tsk.err)
 
 		s.lk.Unlock()
 	}
 }
 
-func (d *DAGStore) consumeNext() (tsk *task, gc chan *GCResult, error error) {
+func (d *DAGStore) consumeNext() (tsk *task, gc chan *GCResult, excl *exclusive, error error) {
 	select {
 	case tsk = <-d.internalCh: // drain internal first; these are tasks emitted from the event loop.
-		return tsk, nil, nil
+		return tsk, nil, nil, nil
 	case <-d.ctx.Done():
-		return nil, nil, d.ctx.Err() // TODO drain and process before returning?
+		return nil, nil, nil, d.ctx.Err() // TODO drain and process before returning?
 	default:
 	}
 
 	select {
 	case tsk = <-d.externalCh:
-		return tsk, nil, nil
+		return tsk, nil, nil, nil
 	case tsk = <-d.completionCh:
-		return tsk, nil, nil
+		return tsk, nil, nil, nil
 	case gc := <-d.gcCh:
-		return nil, gc, nil
+		return nil, gc, nil, nil
+	case excl := <-d.exclusiveCh:
+		return nil, nil, excl, nil
 	case <-d.ctx.Done():
-		return nil, nil, d.ctx.Err() // TODO drain and process before returning?
+		return nil, nil, nil, d.ctx.Err() // TODO drain and process before returning?
+	}
+}
+
+// exclusive is a job that runs with exclusivity from the event loop, i.e. no
+// other tasks are processed while it runs.
+type exclusive struct {
+	fn    func() error
+	errCh chan error
+}
+
+func (e *exclusive) run() {
+	// errCh is buffered, so this never blocks the event loop, even if the
+	// caller has gone away.
+	e.errCh <- e.fn()
+}
+
+// runExclusive runs fn with exclusivity from the event loop, and returns its
+// error. If ctx is cancelled after fn has been handed to the event loop, fn
+// still runs to completion, but its error is discarded.
+func (d *DAGStore) runExclusive(ctx context.Context, fn func() error) error {
+	excl := &exclusive{fn: fn, errCh: make(chan error, 1)}
+	select {
+	case d.exclusiveCh <- excl:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.ctx.Done():
+		return fmt.Errorf("dag store closed")
+	}
+
+	select {
+	case err := <-excl.errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
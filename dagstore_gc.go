@@ -81,8 +81,9 @@ func (d *DAGStore) clearOrphaned() error {
 	referenced := make(map[string]struct{})
 
 	for _, s := range d.shards {
-		t := s.mount.TransientPath()
-		referenced[t] = struct{}{}
+		for _, p := range s.mount.ManagedFiles() {
+			referenced[p] = struct{}{}
+		}
 	}
 
 	// Walk the transients dir and delete unreferenced files.
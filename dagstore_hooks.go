@@ -0,0 +1,101 @@
+package dagstore
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// ErrOpRejected is returned when a hook rejects an operation.
+var ErrOpRejected = errors.New("operation rejected")
+
+// OpHook observes and intercepts the shard operations processed by the event
+// loop. Both callbacks are optional.
+//
+// Hooks run inside the event loop, so they must return promptly; a slow hook
+// stalls the entire DAG store.
+type OpHook struct {
+	// Before is called before the operation is processed, with the current
+	// state of the shard. Returning a non-nil error rejects the operation, and
+	// the error is delivered to the application.
+	//
+	// Only operations initiated by the application can be rejected:
+	// OpShardRegister, OpShardAcquire, OpShardRecover, OpShardDestroy and
+	// OpShardUpdateMount. Errors returned for any other operation are logged
+	// and ignored, as those operations are required to keep shards
+	// consistent. A rejected registration moves the shard to
+	// ShardStateErrored.
+	Before func(op OpType, key shard.Key, info ShardInfo) error
+
+	// After is called after the operation has been processed, with the
+	// resulting state of the shard.
+	After func(op OpType, key shard.Key, info ShardInfo)
+}
+
+// rejectable returns whether the operation can be rejected by a hook.
+func (o OpType) rejectable() bool {
+	switch o {
+	case OpShardRegister, OpShardAcquire, OpShardRecover, OpShardDestroy, OpShardUpdateMount:
+		return true
+	default:
+		return false
+	}
+}
+
+// runBeforeHooks runs the Before hooks for the task, returning the first
+// rejection, if any. It must be called from the event loop, with the shard lock
+// held.
+func (d *DAGStore) runBeforeHooks(tsk *task) error {
+	s := tsk.shard
+	for _, h := range d.config.Hooks {
+		if h.Before == nil {
+			continue
+		}
+		info := ShardInfo{ShardState: s.state, Error: s.err, refs: s.refs}
+		err := h.Before(tsk.op, s.key, info)
+		if err == nil {
+			continue
+		}
+		if !tsk.op.rejectable() {
+			log.Warnw("hook attempted to reject non-rejectable operation; ignoring", "op", tsk.op, "shard", s.key, "error", err)
+			continue
+		}
+		return fmt.Errorf("%w: %s: %s", ErrOpRejected, tsk.op, err)
+	}
+	return nil
+}
+
+// rejectOp notifies the application that an operation has been rejected, by a
+// hook or because it's illegal in the current state of the shard. Operations
+// that aren't rejectable are only logged. It must be called from the event
+// loop, with the shard lock held.
+func (d *DAGStore) rejectOp(tsk *task, err error) {
+	s := tsk.shard
+	if !tsk.op.rejectable() {
+		// the state of the shard changed since the operation was queued.
+		log.Warnw("ignored operation illegal in current shard state", "op", tsk.op, "shard", s.key, "error", err)
+		return
+	}
+	log.Infow("operation rejected", "op", tsk.op, "shard", s.key, "error", err)
+
+	if tsk.op == OpShardRegister {
+		// park the registration waiter so that it gets notified of the failure.
+		s.wRegister = tsk.waiter
+		_ = d.failShard(s, d.internalCh, "%w", err)
+		return
+	}
+	if tsk.waiter != nil {
+		d.dispatchResult(&ShardResult{Key: s.key, Error: err}, tsk.waiter)
+	}
+}
+
+// runAfterHooks runs the After hooks for the task. It must be called from the
+// event loop, with the shard lock held.
+func (d *DAGStore) runAfterHooks(tsk *task, info ShardInfo) {
+	for _, h := range d.config.Hooks {
+		if h.After != nil {
+			h.After(tsk.op, tsk.shard.key, info)
+		}
+	}
+}
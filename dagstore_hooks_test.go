@@ -0,0 +1,92 @@
+package dagstore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+func TestOpHooks(t *testing.T) {
+	var (
+		lk       sync.Mutex
+		before   []OpType
+		after    []OpType
+		rejected = shard.KeyFromString("rejected")
+		noaccess = shard.KeyFromString("noaccess")
+	)
+	hook := OpHook{
+		Before: func(op OpType, key shard.Key, info ShardInfo) error {
+			lk.Lock()
+			before = append(before, op)
+			lk.Unlock()
+			switch {
+			case key == rejected && op == OpShardRegister:
+				return errors.New("not today")
+			case key == noaccess && op == OpShardAcquire:
+				return errors.New("no access")
+			case op == OpShardFail:
+				return errors.New("cannot reject failures") // ignored.
+			}
+			return nil
+		},
+		After: func(op OpType, key shard.Key, info ShardInfo) {
+			lk.Lock()
+			after = append(after, op)
+			lk.Unlock()
+		},
+	}
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		Datastore:     datastore.NewMapDatastore(),
+		Hooks:         []OpHook{hook},
+	})
+	require.NoError(t, err)
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	// a rejected registration fails the shard.
+	ch := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), rejected, carv2mnt, ch, RegisterOpts{})
+	require.NoError(t, err)
+	res := <-ch
+	require.ErrorIs(t, res.Error, ErrOpRejected)
+	info, err := dagst.GetShardInfo(rejected)
+	require.NoError(t, err)
+	require.Equal(t, ShardStateErrored, info.ShardState)
+
+	// a rejected acquire leaves the shard untouched.
+	err = dagst.RegisterShard(context.Background(), noaccess, carv2mnt, ch, RegisterOpts{})
+	require.NoError(t, err)
+	res = <-ch
+	require.NoError(t, res.Error)
+	err = dagst.AcquireShard(context.Background(), noaccess, ch, AcquireOpts{})
+	require.NoError(t, err)
+	res = <-ch
+	require.ErrorIs(t, res.Error, ErrOpRejected)
+	require.Nil(t, res.Accessor)
+	info, err = dagst.GetShardInfo(noaccess)
+	require.NoError(t, err)
+	require.Equal(t, ShardStateAvailable, info.ShardState)
+	require.Zero(t, info.refs)
+
+	lk.Lock()
+	defer lk.Unlock()
+	require.Equal(t, []OpType{
+		OpShardRegister, OpShardFail, // rejected
+		OpShardRegister, OpShardInitialize, OpShardMakeAvailable, OpShardAcquire, // noaccess
+	}, before)
+	// after hooks only run for operations that were not rejected.
+	require.Equal(t, []OpType{
+		OpShardFail,
+		OpShardRegister, OpShardInitialize, OpShardMakeAvailable,
+	}, after)
+}
@@ -0,0 +1,92 @@
+package dagstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/dagstore/mount"
+)
+
+// monitorMounts periodically checks the mounts of shards without a transient
+// copy, until the DAG store is closed. See Config.MountCheckInterval.
+func (d *DAGStore) monitorMounts() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.config.MountCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.ctx.Done():
+			return
+		}
+
+		d.lk.RLock()
+		shards := make([]*Shard, 0, len(d.shards))
+		for _, s := range d.shards {
+			shards = append(shards, s)
+		}
+		d.lk.RUnlock()
+
+		for _, s := range shards {
+			if d.ctx.Err() != nil {
+				return
+			}
+			d.checkMount(s)
+		}
+	}
+}
+
+// checkMount checks whether the mount of an available or unavailable shard
+// without a transient copy is reachable, and queues a task to change the state
+// of the shard if its reachability changed. Other shards are skipped.
+func (d *DAGStore) checkMount(s *Shard) {
+	s.lk.RLock()
+	state, mnt := s.state, s.mount
+	s.lk.RUnlock()
+
+	if state != ShardStateAvailable && state != ShardStateUnavailable {
+		return
+	}
+	if mnt.TransientPath() != "" {
+		return // the shard can be served from the transient.
+	}
+
+	// don't let a hanging mount stall the next round of checks.
+	ctx, cancel := context.WithTimeout(d.ctx, d.mountCheckTimeout())
+	defer cancel()
+
+	var err error
+	switch stat, serr := mnt.Stat(ctx); {
+	case serr != nil:
+		err = fmt.Errorf("failed to stat mount: %w", serr)
+	case !stat.Exists:
+		err = fmt.Errorf("mount target doesn't exist")
+	}
+	// keep the secrets of the mount out of the error, as it's logged, and
+	// persisted along with the shard.
+	err = mount.RedactError(err, d.mounts.Secrets(mnt)...)
+
+	switch {
+	case err != nil && state == ShardStateAvailable:
+		log.Infow("mount of shard is unreachable; shard is now unavailable", "shard", s.key, "error", err)
+		_ = d.queueTask(&task{op: OpShardMountUnreachable, shard: s, err: err}, d.completionCh)
+	case err == nil && state == ShardStateUnavailable:
+		log.Infow("mount of shard is reachable again; shard is now available", "shard", s.key)
+		_ = d.queueTask(&task{op: OpShardMountReachable, shard: s}, d.completionCh)
+	}
+}
+
+// mountCheckTimeout returns the timeout for checking a single mount.
+func (d *DAGStore) mountCheckTimeout() time.Duration {
+	if d.config.MountCheckInterval > 0 {
+		return d.config.MountCheckInterval
+	}
+	return defaultMountCheckTimeout
+}
+
+// defaultMountCheckTimeout is the timeout for checking mounts on demand when
+// periodic checks are disabled.
+const defaultMountCheckTimeout = 30 * time.Second
@@ -1,19 +1,34 @@
 package dagstore
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	dsq "github.com/ipfs/go-datastore/query"
 	dssync "github.com/ipfs/go-datastore/sync"
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipld/go-car/v2"
+	carindex "github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
 
@@ -24,8 +39,8 @@ import (
 )
 
 var (
-	carv2mnt = &mount.FSMount{FS: testdata.FS, Path: testdata.FSPathCarV2}
-	junkmnt  = &mount.FSMount{FS: testdata.FS, Path: testdata.FSPathJunk}
+	carv2mnt = &mount.FSMount{FS: testdata.SequentialFS, Path: testdata.FSPathCarV2}
+	junkmnt  = &mount.FSMount{FS: testdata.SequentialFS, Path: testdata.FSPathJunk}
 )
 
 func init() {
@@ -47,7 +62,7 @@ func TestRegisterUsingExistingTransient(t *testing.T) {
 	ch := make(chan ShardResult, 1)
 	k := shard.KeyFromString("foo")
 	// even though the fs mount has an empty path, the existing transient will get us through registration.
-	err = dagst.RegisterShard(context.Background(), k, &mount.FSMount{FS: testdata.FS, Path: ""}, ch, RegisterOpts{ExistingTransient: testdata.RootPathCarV2})
+	err = dagst.RegisterShard(context.Background(), k, &mount.FSMount{FS: testdata.SequentialFS, Path: ""}, ch, RegisterOpts{ExistingTransient: testdata.RootPathCarV2})
 	require.NoError(t, err)
 
 	res := <-ch
@@ -73,7 +88,7 @@ func TestRegisterWithaNilResponseChannel(t *testing.T) {
 
 	k := shard.KeyFromString("foo")
 	// we pass a nil response channel to Register Shard here
-	err = dagst.RegisterShard(context.Background(), k, &mount.FSMount{FS: testdata.FS, Path: testdata.FSPathCarV1}, nil, RegisterOpts{})
+	err = dagst.RegisterShard(context.Background(), k, &mount.FSMount{FS: testdata.SequentialFS, Path: testdata.FSPathCarV1}, nil, RegisterOpts{})
 	require.NoError(t, err)
 
 	// acquire and wait for acquire
@@ -108,7 +123,7 @@ func TestRegisterCarV1(t *testing.T) {
 
 	ch := make(chan ShardResult, 1)
 	k := shard.KeyFromString("foo")
-	err = dagst.RegisterShard(context.Background(), k, &mount.FSMount{FS: testdata.FS, Path: testdata.FSPathCarV1}, ch, RegisterOpts{})
+	err = dagst.RegisterShard(context.Background(), k, &mount.FSMount{FS: testdata.SequentialFS, Path: testdata.FSPathCarV1}, ch, RegisterOpts{})
 	require.NoError(t, err)
 
 	res := <-ch
@@ -161,6 +176,239 @@ func TestRegisterCarV2(t *testing.T) {
 	require.True(t, istat.Exists)
 }
 
+func TestRegisterVerifiesContents(t *testing.T) {
+	other, err := cid.Decode("bafkqaaa")
+	require.NoError(t, err)
+
+	register := func(t *testing.T, opts RegisterOpts) (*DAGStore, ShardResult) {
+		dagst, err := NewDAGStore(Config{
+			MountRegistry: testRegistry(t),
+			TransientsDir: t.TempDir(),
+			Datastore:     datastore.NewMapDatastore(),
+		})
+		require.NoError(t, err)
+		err = dagst.Start(context.Background())
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = dagst.Close() })
+
+		ch := make(chan ShardResult, 1)
+		err = dagst.RegisterShard(context.Background(), shard.KeyFromString("foo"), carv2mnt, ch, opts)
+		require.NoError(t, err)
+		return dagst, <-ch
+	}
+
+	t.Run("match", func(t *testing.T) {
+		_, res := register(t, RegisterOpts{
+			ExpectedRoots: []cid.Cid{testdata.RootCID},
+			ExpectedSize:  int64(len(testdata.CarV2)),
+		})
+		require.NoError(t, res.Error)
+	})
+
+	t.Run("roots mismatch", func(t *testing.T) {
+		dagst, res := register(t, RegisterOpts{ExpectedRoots: []cid.Cid{other}})
+		var mismatch *ContentMismatchError
+		require.ErrorAs(t, res.Error, &mismatch)
+		require.Equal(t, []cid.Cid{testdata.RootCID}, mismatch.ActualRoots)
+
+		info, err := dagst.GetShardInfo(res.Key)
+		require.NoError(t, err)
+		require.Equal(t, ShardStateErrored, info.ShardState)
+		istat, err := dagst.indices.StatFullIndex(res.Key)
+		require.NoError(t, err)
+		require.False(t, istat.Exists)
+	})
+
+	t.Run("size mismatch", func(t *testing.T) {
+		_, res := register(t, RegisterOpts{ExpectedSize: 1})
+		var mismatch *ContentMismatchError
+		require.ErrorAs(t, res.Error, &mismatch)
+		require.EqualValues(t, len(testdata.CarV2), mismatch.ActualSize)
+	})
+
+	t.Run("lazy", func(t *testing.T) {
+		dagst, res := register(t, RegisterOpts{ExpectedRoots: []cid.Cid{other}, LazyInitialization: true})
+		require.NoError(t, res.Error)
+
+		// verification happens on first acquire.
+		ch := make(chan ShardResult, 1)
+		err := dagst.AcquireShard(context.Background(), res.Key, ch, AcquireOpts{})
+		require.NoError(t, err)
+		res = <-ch
+		var mismatch *ContentMismatchError
+		require.ErrorAs(t, res.Error, &mismatch)
+	})
+}
+func TestRegisterWithExistingIndex(t *testing.T) {
+	idx, err := car.ReadOrGenerateIndex(bytes.NewReader(testdata.CarV2))
+	require.NoError(t, err)
+
+	newStore := func(t *testing.T) *DAGStore {
+		dagst, err := NewDAGStore(Config{
+			MountRegistry: testRegistry(t),
+			TransientsDir: t.TempDir(),
+			Datastore:     datastore.NewMapDatastore(),
+		})
+		require.NoError(t, err)
+		err = dagst.Start(context.Background())
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = dagst.Close() })
+		return dagst
+	}
+
+	filemnt := &mount.FileMount{Path: "testdata/files/sample-wrapped-v2.car"}
+
+	t.Run("no fetch", func(t *testing.T) {
+		dagst := newStore(t)
+		counting := &mount.Counting{Mount: carv2mnt}
+		ch := make(chan ShardResult, 1)
+		k := shard.KeyFromString("foo")
+		err := dagst.RegisterShard(context.Background(), k, counting, ch, RegisterOpts{ExistingIndex: idx})
+		require.NoError(t, err)
+		res := <-ch
+		require.NoError(t, res.Error)
+
+		info, err := dagst.GetShardInfo(k)
+		require.NoError(t, err)
+		require.Equal(t, ShardStateAvailable, info.ShardState)
+		require.Zero(t, counting.Count())
+
+		accessors := acquireShard(t, dagst, k, 2)
+		releaseAll(t, dagst, k, accessors)
+	})
+
+	t.Run("from path", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "index")
+		f, err := os.Create(path)
+		require.NoError(t, err)
+		err = carindex.WriteTo(idx, f)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		dagst := newStore(t)
+		ch := make(chan ShardResult, 1)
+		k := shard.KeyFromString("foo")
+		err = dagst.RegisterShard(context.Background(), k, filemnt, ch, RegisterOpts{ExistingIndexPath: path})
+		require.NoError(t, err)
+		res := <-ch
+		require.NoError(t, res.Error)
+
+		accessors := acquireShard(t, dagst, k, 2)
+		releaseAll(t, dagst, k, accessors)
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		// an empty index.
+		other, err := carindex.New(multicodec.CarIndexSorted)
+		require.NoError(t, err)
+
+		dagst := newStore(t)
+		k := shard.KeyFromString("foo")
+		err = dagst.RegisterShard(context.Background(), k, filemnt, nil, RegisterOpts{ExistingIndex: other})
+		require.ErrorIs(t, err, ErrIndexMismatch)
+
+		_, err = dagst.GetShardInfo(k)
+		require.ErrorIs(t, err, ErrShardUnknown)
+	})
+
+	t.Run("mismatch past the first blocks", func(t *testing.T) {
+		// the index of a CAR, checked against the same CAR with one more
+		// block at the end.
+		blocks := make(map[cid.Cid][]byte)
+		var root cid.Cid
+		for i := 0; i < 4*indexCheckSamples; i++ {
+			data := []byte(fmt.Sprintf("block-%d", i))
+			mh, err := multihash.Sum(data, multihash.SHA2_256, -1)
+			require.NoError(t, err)
+			root = cid.NewCidV1(cid.Raw, mh)
+			blocks[root] = data
+		}
+		bz := makeCARv1(t, root, blocks)
+		ix := &indexer{}
+		other, err := ix.generate(context.Background(), shard.KeyFromString("other"), bytes.NewReader(bz))
+		require.NoError(t, err)
+
+		extra := []byte("extra")
+		mh, err := multihash.Sum(extra, multihash.SHA2_256, -1)
+		require.NoError(t, err)
+		section := append(cid.NewCidV1(cid.Raw, mh).Bytes(), extra...)
+		bz = append(append(bz, varint.ToUvarint(uint64(len(section)))...), section...)
+		path := filepath.Join(t.TempDir(), "extended.car")
+		require.NoError(t, os.WriteFile(path, bz, 0644))
+
+		dagst := newStore(t)
+		k := shard.KeyFromString("foo")
+		err = dagst.RegisterShard(context.Background(), k, &mount.FileMount{Path: path}, nil, RegisterOpts{ExistingIndex: other})
+		require.ErrorIs(t, err, ErrIndexMismatch)
+	})
+
+	t.Run("dropped if not queued", func(t *testing.T) {
+		// a closed DAG store whose queue is full.
+		dagst := newStore(t)
+		require.NoError(t, dagst.Close())
+		for len(dagst.externalCh) < cap(dagst.externalCh) {
+			dagst.externalCh <- &task{}
+		}
+
+		k := shard.KeyFromString("foo")
+		err := dagst.RegisterShard(context.Background(), k, filemnt, nil, RegisterOpts{ExistingIndex: idx})
+		require.Error(t, err)
+
+		_, err = dagst.GetShardInfo(k)
+		require.ErrorIs(t, err, ErrShardUnknown)
+		istat, err := dagst.indices.StatFullIndex(k)
+		require.NoError(t, err)
+		require.False(t, istat.Exists)
+	})
+}
+
+func TestAcquireWhileStreaming(t *testing.T) {
+	idx, err := car.ReadOrGenerateIndex(bytes.NewReader(testdata.CarV2))
+	require.NoError(t, err)
+
+	r := testRegistry(t)
+	err = r.Register("block", newBlockingMount(&mount.FSMount{FS: testdata.SequentialFS}))
+	require.NoError(t, err)
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:       r,
+		TransientsDir:       t.TempDir(),
+		Datastore:           datastore.NewMapDatastore(),
+		StreamingTransients: true,
+	})
+	require.NoError(t, err)
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	block := newBlockingMount(carv2mnt)
+	ch := make(chan ShardResult, 1)
+	k := shard.KeyFromString("foo")
+	err = dagst.RegisterShard(context.Background(), k, block, ch, RegisterOpts{ExistingIndex: idx})
+	require.NoError(t, err)
+	res := <-ch
+	require.NoError(t, res.Error)
+
+	// the accessor is handed out while the download is blocked.
+	err = dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{})
+	require.NoError(t, err)
+	select {
+	case res = <-ch:
+		require.NoError(t, res.Error)
+	case <-time.After(5 * time.Second):
+		t.Fatal("acquire blocked on the download")
+	}
+	sa := res.Accessor
+	defer sa.Close()
+
+	block.UnblockNext(1)
+	bs, err := sa.Blockstore()
+	require.NoError(t, err)
+	blk, err := bs.Get(testdata.RootCID)
+	require.NoError(t, err)
+	require.Equal(t, testdata.RootCID, blk.Cid())
+}
+
 func TestRegisterConcurrentShards(t *testing.T) {
 	run := func(t *testing.T, n int) {
 		store := dssync.MutexWrap(datastore.NewMapDatastore())
@@ -348,7 +596,7 @@ func TestRestartResumesRegistration(t *testing.T) {
 	store := datastore.NewLogDatastore(dssync.MutexWrap(datastore.NewMapDatastore()), "trace")
 	r := testRegistry(t)
 
-	err := r.Register("block", newBlockingMount(&mount.FSMount{FS: testdata.FS}))
+	err := r.Register("block", newBlockingMount(&mount.FSMount{FS: testdata.SequentialFS}))
 	require.NoError(t, err)
 
 	sink := tracer(128)
@@ -401,7 +649,7 @@ func TestRestartResumesRegistration(t *testing.T) {
 	// a template. Because UnblockCh is exported, it is a templated field, so
 	// all mounts will await for tokens on that shared channel.
 	r = testRegistry(t)
-	bm := newBlockingMount(&mount.FSMount{FS: testdata.FS})
+	bm := newBlockingMount(&mount.FSMount{FS: testdata.SequentialFS})
 	err = r.Register("block", bm)
 	require.NoError(t, err)
 
@@ -588,7 +836,7 @@ func TestLazyInitialization(t *testing.T) {
 // Testing thottling on indexing is way harder...
 func TestThrottleFetch(t *testing.T) {
 	r := testRegistry(t)
-	err := r.Register("block", newBlockingMount(&mount.FSMount{FS: testdata.FS}))
+	err := r.Register("block", newBlockingMount(&mount.FSMount{FS: testdata.SequentialFS}))
 	require.NoError(t, err)
 
 	dir := t.TempDir()
@@ -1091,7 +1339,7 @@ func TestRecoveryOnStart(t *testing.T) {
 func TestFailingAcquireErrorPropagates(t *testing.T) {
 	r := testRegistry(t)
 
-	err := r.Register("block", newBlockingMount(&mount.FSMount{FS: testdata.FS}))
+	err := r.Register("block", newBlockingMount(&mount.FSMount{FS: testdata.SequentialFS}))
 	require.NoError(t, err)
 
 	dir := t.TempDir()
@@ -1265,7 +1513,7 @@ func TestWaiterContextCancelled(t *testing.T) {
 
 func TestAcquireContextCancelled(t *testing.T) {
 	r := testRegistry(t)
-	err := r.Register("block", newBlockingMount(&mount.FSMount{FS: testdata.FS}))
+	err := r.Register("block", newBlockingMount(&mount.FSMount{FS: testdata.SequentialFS}))
 	require.NoError(t, err)
 
 	dagst, err := NewDAGStore(Config{
@@ -1323,6 +1571,174 @@ func TestAcquireContextCancelled(t *testing.T) {
 
 }
 
+func TestUpdateMount(t *testing.T) {
+	newStore := func(t *testing.T) (*DAGStore, datastore.Datastore) {
+		store := dssync.MutexWrap(datastore.NewMapDatastore())
+		mounts := testRegistry(t)
+		require.NoError(t, mounts.Register("etag", new(etagMount)))
+		dagst, err := NewDAGStore(Config{
+			MountRegistry: mounts,
+			TransientsDir: t.TempDir(),
+			Datastore:     store,
+		})
+		require.NoError(t, err)
+
+		err = dagst.Start(context.Background())
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = dagst.Close() })
+		return dagst, store
+	}
+
+	// relocated is the same CARv2 as carv2mnt, served from a different mount.
+	relocated := &mount.FSMount{FS: os.DirFS("testdata/files"), Path: "sample-wrapped-v2.car"}
+
+	t.Run("keep index", func(t *testing.T) {
+		dagst, store := newStore(t)
+		k := registerShards(t, dagst, 1, carv2mnt, RegisterOpts{})[0]
+
+		ch := make(chan ShardResult, 1)
+		err := dagst.UpdateMount(context.Background(), k, relocated, ch, UpdateMountOpts{KeepIndex: true})
+		require.NoError(t, err)
+		res := <-ch
+		require.NoError(t, res.Error)
+
+		info, err := dagst.GetShardInfo(k)
+		require.NoError(t, err)
+		require.Equal(t, ShardStateAvailable, info.ShardState)
+		require.Same(t, relocated, dagst.shards[k].mount.Underlying())
+
+		// the new mount has been persisted.
+		bz, err := store.Get(datastore.NewKey(StoreNamespace.String() + "/" + k.String()))
+		require.NoError(t, err)
+		var ps PersistedShard
+		require.NoError(t, json.Unmarshal(bz, &ps))
+		require.Contains(t, ps.URL, "path=sample-wrapped-v2.car")
+
+		accessors := acquireShard(t, dagst, k, 2)
+		releaseAll(t, dagst, k, accessors)
+	})
+
+	t.Run("reindex", func(t *testing.T) {
+		dagst, _ := newStore(t)
+		k := registerShards(t, dagst, 1, carv2mnt, RegisterOpts{})[0]
+
+		counting := &mount.Counting{Mount: relocated}
+		ch := make(chan ShardResult, 1)
+		err := dagst.UpdateMount(context.Background(), k, counting, ch, UpdateMountOpts{})
+		require.NoError(t, err)
+		res := <-ch
+		require.NoError(t, res.Error)
+
+		// the shard was reinitialized from the new mount.
+		require.Equal(t, 1, counting.Count())
+		info, err := dagst.GetShardInfo(k)
+		require.NoError(t, err)
+		require.Equal(t, ShardStateAvailable, info.ShardState)
+
+		accessors := acquireShard(t, dagst, k, 2)
+		releaseAll(t, dagst, k, accessors)
+	})
+
+	t.Run("size mismatch", func(t *testing.T) {
+		dagst, _ := newStore(t)
+		k := registerShards(t, dagst, 1, carv2mnt, RegisterOpts{})[0]
+
+		v1mnt := &mount.FSMount{FS: testdata.SequentialFS, Path: testdata.FSPathCarV1}
+		err := dagst.UpdateMount(context.Background(), k, v1mnt, nil, UpdateMountOpts{KeepIndex: true})
+		require.ErrorIs(t, err, ErrMountMismatch)
+	})
+
+	t.Run("version mismatch", func(t *testing.T) {
+		dagst, _ := newStore(t)
+		k := registerShards(t, dagst, 1, &etagMount{Mount: carv2mnt, ETag: "a"}, RegisterOpts{})[0]
+
+		// a different ETag is rejected.
+		err := dagst.UpdateMount(context.Background(), k, &etagMount{Mount: relocated, ETag: "b"}, nil, UpdateMountOpts{KeepIndex: true})
+		require.ErrorIs(t, err, ErrMountMismatch)
+
+		// so is a different modification time.
+		dir := t.TempDir()
+		cp := func(name string, mtime time.Time) *mount.FileMount {
+			path := filepath.Join(dir, name)
+			require.NoError(t, os.WriteFile(path, testdata.CarV2, 0644))
+			require.NoError(t, os.Chtimes(path, mtime, mtime))
+			return &mount.FileMount{Path: path}
+		}
+		mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+		k = shard.KeyFromString("file")
+		ch := make(chan ShardResult, 1)
+		require.NoError(t, dagst.RegisterShard(context.Background(), k, cp("a.car", mtime), ch, RegisterOpts{}))
+		require.NoError(t, (<-ch).Error)
+
+		err = dagst.UpdateMount(context.Background(), k, cp("b.car", mtime.Add(time.Minute)), nil, UpdateMountOpts{KeepIndex: true})
+		require.ErrorIs(t, err, ErrMountMismatch)
+
+		err = dagst.UpdateMount(context.Background(), k, cp("c.car", mtime), ch, UpdateMountOpts{KeepIndex: true})
+		require.NoError(t, err)
+		require.NoError(t, (<-ch).Error)
+	})
+
+	t.Run("current mount unreachable", func(t *testing.T) {
+		dagst, _ := newStore(t)
+		junk := &mount.FSMount{FS: os.DirFS("testdata/files"), Path: "junk.dat"}
+
+		register := func(key string, opts RegisterOpts) shard.Key {
+			path := filepath.Join(t.TempDir(), "gone.car")
+			require.NoError(t, os.WriteFile(path, testdata.CarV2, 0644))
+			k := shard.KeyFromString(key)
+			ch := make(chan ShardResult, 1)
+			require.NoError(t, dagst.RegisterShard(context.Background(), k, &mount.FileMount{Path: path}, ch, opts))
+			require.NoError(t, (<-ch).Error)
+			require.NoError(t, os.Remove(path))
+			return k
+		}
+
+		// the new mount is checked against the index.
+		k := register("index", RegisterOpts{})
+		err := dagst.UpdateMount(context.Background(), k, junk, nil, UpdateMountOpts{KeepIndex: true})
+		require.ErrorIs(t, err, ErrMountMismatch)
+		ch := make(chan ShardResult, 1)
+		err = dagst.UpdateMount(context.Background(), k, relocated, ch, UpdateMountOpts{KeepIndex: true})
+		require.NoError(t, err)
+		require.NoError(t, (<-ch).Error)
+
+		// or against the expected size.
+		k = register("size", RegisterOpts{ExpectedSize: int64(len(testdata.CarV2))})
+		err = dagst.UpdateMount(context.Background(), k, junk, nil, UpdateMountOpts{KeepIndex: true})
+		require.ErrorIs(t, err, ErrMountMismatch)
+		err = dagst.UpdateMount(context.Background(), k, relocated, ch, UpdateMountOpts{KeepIndex: true})
+		require.NoError(t, err)
+		require.NoError(t, (<-ch).Error)
+	})
+
+	t.Run("refused while serving", func(t *testing.T) {
+		dagst, _ := newStore(t)
+		k := registerShards(t, dagst, 1, carv2mnt, RegisterOpts{})[0]
+		accessors := acquireShard(t, dagst, k, 1)
+
+		ch := make(chan ShardResult, 1)
+		err := dagst.UpdateMount(context.Background(), k, relocated, ch, UpdateMountOpts{KeepIndex: true})
+		require.NoError(t, err)
+		res := <-ch
+		require.Error(t, res.Error)
+		require.Same(t, carv2mnt, dagst.shards[k].mount.Underlying())
+
+		releaseAll(t, dagst, k, accessors)
+	})
+}
+
+// etagMount is a mount that reports an ETag in its stat.
+type etagMount struct {
+	mount.Mount
+	ETag string
+}
+
+func (e *etagMount) Stat(ctx context.Context) (mount.Stat, error) {
+	stat, err := e.Mount.Stat(ctx)
+	stat.ETag = e.ETag
+	return stat, err
+}
+
 // registerShards registers n shards concurrently, using the CARv2 mount.
 func registerShards(t *testing.T, dagst *DAGStore, n int, mnt mount.Mount, opts RegisterOpts) (ret []shard.Key) {
 	grp, _ := errgroup.WithContext(context.Background())
@@ -1431,12 +1847,412 @@ func releaseAll(t *testing.T, dagst *DAGStore, k shard.Key, accs []*ShardAccesso
 
 }
 
+func TestMountSecretsRedacted(t *testing.T) {
+	// the server advertises the CAR, but fails to serve it.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", strconv.Itoa(len(testdata.CarV2)))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	const secret = "s3cr3t-t0ken"
+	mnt := &mount.HTTPMount{URL: srv.URL + "/file.car?token=" + secret}
+
+	r := testRegistry(t)
+	require.NoError(t, r.Register("http", &mount.HTTPMount{SecretQueryParams: []string{"token"}}))
+
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	tr := tracer(128)
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: r,
+		TransientsDir: t.TempDir(),
+		Datastore:     store,
+		TraceCh:       tr,
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+	defer dagst.Close()
+
+	// shards with secrets that can't be protected are refused.
+	k := shard.KeyFromString("foo")
+	err = dagst.RegisterShard(context.Background(), k, mnt, nil, RegisterOpts{})
+	require.ErrorIs(t, err, mount.ErrSecretsUnprotected)
+
+	// as are shards whose secrets the provider doesn't know about.
+	r.SetSecretProvider(mount.StaticSecrets{"other": "other"})
+	err = dagst.RegisterShard(context.Background(), k, mnt, nil, RegisterOpts{})
+	require.ErrorIs(t, err, mount.ErrUnknownSecret)
+	require.NotContains(t, err.Error(), secret)
+	_, err = dagst.GetShardInfo(k)
+	require.ErrorIs(t, err, ErrShardUnknown)
+
+	// mounts of unregistered types can't be persisted either.
+	err = dagst.RegisterShard(context.Background(), k, &mount.BytesMount{Bytes: testdata.CarV2}, nil, RegisterOpts{})
+	require.ErrorIs(t, err, mount.ErrUnrecognizedType)
+
+	// nor can mounts wrapping them.
+	require.NoError(t, r.Register("section", &mount.SectionMount{Registry: r}))
+	section := &mount.SectionMount{Registry: r, Inner: &mount.BytesMount{Bytes: testdata.CarV2}, Length: int64(len(testdata.CarV2))}
+	err = dagst.RegisterShard(context.Background(), k, section, nil, RegisterOpts{})
+	require.ErrorIs(t, err, mount.ErrUnrecognizedType)
+
+	r.SetSecretProvider(mount.StaticSecrets{"tok": secret})
+	ch := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), k, mnt, ch, RegisterOpts{})
+	require.NoError(t, err)
+	res := <-ch
+	require.Error(t, res.Error)
+	require.NotContains(t, res.Error.Error(), secret)
+
+	info, err := dagst.GetShardInfo(k)
+	require.NoError(t, err)
+	require.Equal(t, ShardStateErrored, info.ShardState)
+	require.Contains(t, info.Error.Error(), "REDACTED")
+	require.NotContains(t, info.Error.Error(), secret)
+
+	traces := make([]Trace, 3)
+	n, _ := tr.Read(traces, 1*time.Second)
+	for _, trace := range traces[:n] {
+		if trace.After.Error != nil {
+			require.NotContains(t, trace.After.Error.Error(), secret)
+		}
+	}
+
+	// neither the mount URL nor the error are persisted with the secret.
+	bz, err := store.Get(datastore.NewKey(StoreNamespace.String() + "/" + k.String()))
+	require.NoError(t, err)
+	require.NotContains(t, string(bz), secret)
+	require.Contains(t, string(bz), "token="+url.QueryEscape("secret:tok"))
+}
+
+func TestMountUnreachableRedactsSecrets(t *testing.T) {
+	// the server serves the CAR until it's told to fail.
+	var failing int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, "file.car", time.Time{}, bytes.NewReader(testdata.CarV2))
+	}))
+	defer srv.Close()
+
+	const secret = "s3cr3t-t0ken"
+	mnt := &mount.HTTPMount{URL: srv.URL + "/file.car?token=" + secret}
+
+	r := testRegistry(t)
+	require.NoError(t, r.Register("http", &mount.HTTPMount{SecretQueryParams: []string{"token"}}))
+	r.SetSecretProvider(mount.StaticSecrets{"tok": secret})
+
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:      r,
+		TransientsDir:      t.TempDir(),
+		Datastore:          store,
+		MountCheckInterval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+	defer dagst.Close()
+
+	// register with an existing index, so that no transient is fetched.
+	idx, err := car.ReadOrGenerateIndex(bytes.NewReader(testdata.CarV2))
+	require.NoError(t, err)
+	k := shard.KeyFromString("foo")
+	ch := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), k, mnt, ch, RegisterOpts{ExistingIndex: idx})
+	require.NoError(t, err)
+	require.NoError(t, (<-ch).Error)
+
+	atomic.StoreInt32(&failing, 1)
+	var info ShardInfo
+	require.Eventually(t, func() bool {
+		info, err = dagst.GetShardInfo(k)
+		return err == nil && info.ShardState == ShardStateUnavailable
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Contains(t, info.Error.Error(), "REDACTED")
+	require.NotContains(t, info.Error.Error(), secret)
+
+	bz, err := store.Get(datastore.NewKey(StoreNamespace.String() + "/" + k.String()))
+	require.NoError(t, err)
+	require.NotContains(t, string(bz), secret)
+}
+
+func TestRestartRestoresMountState(t *testing.T) {
+	newRegistry := func() *mount.Registry {
+		r := mount.NewRegistry()
+		err := r.RegisterFactory("sfs", func(u *url.URL) (mount.Mount, error) {
+			m := &statefulFSMount{FSMount: mount.FSMount{FS: testdata.SequentialFS}}
+			if u == nil {
+				return m, nil
+			}
+			return m, m.Deserialize(u)
+		})
+		require.NoError(t, err)
+		return r
+	}
+
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	idx, err := index.NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+	cfg := Config{
+		MountRegistry: newRegistry(),
+		TransientsDir: t.TempDir(),
+		Datastore:     store,
+		IndexRepo:     idx,
+	}
+	dagst, err := NewDAGStore(cfg)
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+
+	mnt := &statefulFSMount{FSMount: mount.FSMount{FS: testdata.SequentialFS, Path: testdata.FSPathCarV2}}
+	keys := registerShards(t, dagst, 1, mnt, RegisterOpts{})
+
+	// the path is persisted in the mount state, not in the URL.
+	bz, err := store.Get(datastore.NewKey(StoreNamespace.String() + "/" + keys[0].String()))
+	require.NoError(t, err)
+	var ps PersistedShard
+	require.NoError(t, json.Unmarshal(bz, &ps))
+	require.Equal(t, "sfs://summary", ps.URL)
+	require.Equal(t, testdata.FSPathCarV2, string(ps.MountState))
+	require.NoError(t, dagst.Close())
+
+	cfg.MountRegistry = newRegistry()
+	dagst, err = NewDAGStore(cfg)
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+	defer dagst.Close()
+	_ = acquireShard(t, dagst, keys[0], 1)
+}
+
+func TestRestartMigratesLegacyFileURLs(t *testing.T) {
+	path, err := filepath.Abs(testdata.RootPathCarV2)
+	require.NoError(t, err)
+
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	idx, err := index.NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+	cfg := Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		Datastore:     store,
+		IndexRepo:     idx,
+	}
+	dagst, err := NewDAGStore(cfg)
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+	keys := registerShards(t, dagst, 2, &mount.FileMount{Path: path}, RegisterOpts{})
+	require.NoError(t, dagst.Close())
+
+	// rewrite the record with the legacy representation of the path.
+	k := datastore.NewKey(StoreNamespace.String() + "/" + keys[0].String())
+	bz, err := store.Get(k)
+	require.NoError(t, err)
+	var ps PersistedShard
+	require.NoError(t, json.Unmarshal(bz, &ps))
+	require.Equal(t, "file://"+filepath.ToSlash(path), ps.URL)
+	ps.URL = (&url.URL{Scheme: "file", Host: path}).String()
+	bz, err = json.Marshal(ps)
+	require.NoError(t, err)
+	require.NoError(t, store.Put(k, bz))
+
+	// reformat the other record, which is in the current representation.
+	k2 := datastore.NewKey(StoreNamespace.String() + "/" + keys[1].String())
+	bz, err = store.Get(k2)
+	require.NoError(t, err)
+	var indented bytes.Buffer
+	require.NoError(t, json.Indent(&indented, bz, "", "  "))
+	require.NoError(t, store.Put(k2, indented.Bytes()))
+
+	cfg.MountRegistry = testRegistry(t)
+	dagst, err = NewDAGStore(cfg)
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+	defer dagst.Close()
+	_ = acquireShard(t, dagst, keys[0], 1)
+
+	// the record was migrated on startup.
+	bz, err = store.Get(k)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(bz, &ps))
+	require.Equal(t, "file://"+filepath.ToSlash(path), ps.URL)
+
+	// the other one was left alone.
+	bz, err = store.Get(k2)
+	require.NoError(t, err)
+	require.Equal(t, indented.Bytes(), bz)
+}
+
+func TestMountUnavailable(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sample.car")
+	require.NoError(t, os.WriteFile(path, testdata.CarV2, 0644))
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:      testRegistry(t),
+		TransientsDir:      t.TempDir(),
+		Datastore:          datastore.NewMapDatastore(),
+		MountCheckInterval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+	defer dagst.Close()
+
+	keys := registerShards(t, dagst, 1, &mount.FileMount{Path: path}, RegisterOpts{})
+	k := keys[0]
+
+	// the file disappears; the shard becomes unavailable.
+	moved := filepath.Join(dir, "moved.car")
+	require.NoError(t, os.Rename(path, moved))
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(k)
+		return err == nil && info.ShardState == ShardStateUnavailable && info.Error != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// acquiring fails fast.
+	ch := make(chan ShardResult, 1)
+	require.NoError(t, dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{}))
+	res := <-ch
+	require.ErrorIs(t, res.Error, ErrShardUnavailable)
+
+	// unless we wait for the mount to become reachable.
+	require.NoError(t, dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{WaitUnavailable: true}))
+	select {
+	case res := <-ch:
+		t.Fatalf("unexpected result while shard is unavailable: %v", res)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the file reappears; the waiting acquirer is served.
+	require.NoError(t, os.Rename(moved, path))
+	res = <-ch
+	require.NoError(t, res.Error)
+	require.NotNil(t, res.Accessor)
+
+	info, err := dagst.GetShardInfo(k)
+	require.NoError(t, err)
+	require.Equal(t, ShardStateServing, info.ShardState)
+	require.NoError(t, info.Error)
+	releaseAll(t, dagst, k, []*ShardAccessor{res.Accessor})
+}
+
+func TestCloseWaitsForMountCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sample.car")
+	require.NoError(t, os.WriteFile(path, testdata.CarV2, 0644))
+
+	r := testRegistry(t)
+	require.NoError(t, r.Register("stall", new(stallingMount)))
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:      r,
+		TransientsDir:      t.TempDir(),
+		Datastore:          datastore.NewMapDatastore(),
+		MountCheckInterval: time.Hour,
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+
+	mnt := &stallingMount{FileMount: mount.FileMount{Path: path}}
+	k := registerShards(t, dagst, 1, mnt, RegisterOpts{})[0]
+
+	// make the shard unavailable, and stall checks of its mount.
+	err = dagst.queueTask(&task{op: OpShardMountUnreachable, shard: dagst.shards[k], err: errors.New("unreachable")}, dagst.completionCh)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(k)
+		return err == nil && info.ShardState == ShardStateUnavailable
+	}, 5*time.Second, 10*time.Millisecond)
+	stalled, release := mnt.stall()
+
+	// acquiring the shard checks the mount right away.
+	ch := make(chan ShardResult, 1)
+	require.NoError(t, dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{WaitUnavailable: true}))
+	<-stalled
+
+	closed := make(chan error, 1)
+	go func() { closed <- dagst.Close() }()
+	select {
+	case <-closed:
+		t.Fatal("Close returned while a mount check was in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-closed:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't return after the mount check finished")
+	}
+}
+
+// stallingMount is a FileMount whose Stat can be made to stall, regardless of
+// the context, until released.
+type stallingMount struct {
+	mount.FileMount
+
+	lk      sync.Mutex
+	stalled chan struct{}
+	release chan struct{}
+}
+
+// stall makes the next calls to Stat stall. The returned stalled channel is
+// closed when the first call stalls, and closing release releases them.
+func (s *stallingMount) stall() (stalled <-chan struct{}, release chan struct{}) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.stalled, s.release = make(chan struct{}), make(chan struct{})
+	return s.stalled, s.release
+}
+
+func (s *stallingMount) Stat(ctx context.Context) (mount.Stat, error) {
+	s.lk.Lock()
+	stalled, release := s.stalled, s.release
+	s.stalled = nil
+	s.lk.Unlock()
+	if stalled != nil {
+		close(stalled)
+	}
+	if release != nil {
+		<-release
+	}
+	return s.FileMount.Stat(ctx)
+}
+
+// statefulFSMount is an FSMount that persists its path in its state.
+type statefulFSMount struct {
+	mount.FSMount
+}
+
+var _ mount.StatefulMount = (*statefulFSMount)(nil)
+
+func (s *statefulFSMount) Serialize() *url.URL {
+	return &url.URL{Host: "summary"}
+}
+
+func (s *statefulFSMount) Deserialize(_ *url.URL) error {
+	return nil
+}
+
+func (s *statefulFSMount) MarshalState() ([]byte, error) {
+	return []byte(s.Path), nil
+}
+
+func (s *statefulFSMount) UnmarshalState(state []byte) error {
+	s.Path = string(state)
+	return nil
+}
+
 func testRegistry(t *testing.T) *mount.Registry {
 	r := mount.NewRegistry()
-	err := r.Register("fs", &mount.FSMount{FS: testdata.FS})
+	err := r.Register("fs", &mount.FSMount{FS: testdata.SequentialFS})
 	require.NoError(t, err)
 	err = r.Register("counting", new(mount.Counting))
 	require.NoError(t, err)
+	err = r.Register("file", new(mount.FileMount))
+	require.NoError(t, err)
 	return r
 }
 
@@ -1494,3 +2310,187 @@ func (b *blockingMount) Stat(ctx context.Context) (mount.Stat, error) {
 	s.Ready = b.ready
 	return s, err
 }
+
+func TestDestroyShard(t *testing.T) {
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	cfg := Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		Datastore:     store,
+	}
+	dagst, err := NewDAGStore(cfg)
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+
+	keys := registerShards(t, dagst, 2, carv2mnt, RegisterOpts{})
+	k := keys[0]
+	transient := dagst.shards[k].mount.TransientPath()
+	require.NotEmpty(t, transient)
+
+	// shards in use can't be destroyed.
+	accessors := acquireShard(t, dagst, k, 1)
+	ch := make(chan ShardResult, 1)
+	err = dagst.DestroyShard(context.Background(), k, ch, DestroyOpts{})
+	require.NoError(t, err)
+	require.ErrorIs(t, (<-ch).Error, ErrIllegalTransition)
+	releaseAll(t, dagst, k, accessors)
+
+	err = dagst.DestroyShard(context.Background(), k, ch, DestroyOpts{})
+	require.NoError(t, err)
+	res := <-ch
+	require.NoError(t, res.Error)
+	require.Equal(t, k, res.Key)
+
+	// the shard is gone, along with its data.
+	_, err = dagst.GetShardInfo(k)
+	require.ErrorIs(t, err, ErrShardUnknown)
+	istat, err := dagst.indices.StatFullIndex(k)
+	require.NoError(t, err)
+	require.False(t, istat.Exists)
+	_, err = os.Stat(transient)
+	require.True(t, os.IsNotExist(err))
+	exists, err := dagst.store.Has(datastore.NewKey(k.String()))
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	// the shard isn't revived on restart, unlike the other one.
+	require.NoError(t, dagst.Close())
+	cfg.MountRegistry = testRegistry(t)
+	dagst, err = NewDAGStore(cfg)
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+	defer dagst.Close()
+	info := dagst.AllShardsInfo()
+	require.Len(t, info, 1)
+	require.Contains(t, info, keys[1])
+}
+
+func TestDestroyShardAbortsStreamingDownload(t *testing.T) {
+	idx, err := car.ReadOrGenerateIndex(bytes.NewReader(testdata.CarV2))
+	require.NoError(t, err)
+
+	r := testRegistry(t)
+	err = r.Register("gated", &gatedMount{Mount: &mount.FSMount{FS: testdata.SequentialFS}})
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:       r,
+		TransientsDir:       dir,
+		Datastore:           datastore.NewMapDatastore(),
+		StreamingTransients: true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+	defer dagst.Close()
+
+	k := shard.KeyFromString("foo")
+	ch := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), k, &gatedMount{Mount: carv2mnt, Gate: 1024}, ch, RegisterOpts{ExistingIndex: idx})
+	require.NoError(t, err)
+	require.NoError(t, (<-ch).Error)
+
+	// start the download, which stalls after the gate.
+	accessors := acquireShard(t, dagst, k, 1)
+	require.Eventually(t, func() bool {
+		fi, err := os.Stat(filepath.Join(dir, "transient-"+k.String()+".partial"))
+		return err == nil && fi.Size() == 1024
+	}, 5*time.Second, 10*time.Millisecond)
+	releaseAll(t, dagst, k, accessors)
+
+	err = dagst.DestroyShard(context.Background(), k, ch, DestroyOpts{})
+	require.NoError(t, err)
+	require.NoError(t, (<-ch).Error)
+
+	// the download was aborted, and left nothing behind.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestDestroyShardDuringInitialization(t *testing.T) {
+	newRegistry := func() *mount.Registry {
+		r := testRegistry(t)
+		require.NoError(t, r.Register("gated", &gatedMount{Mount: &mount.FSMount{FS: testdata.SequentialFS}}))
+		return r
+	}
+	failures := make(chan ShardResult, 1)
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	cfg := Config{
+		MountRegistry: newRegistry(),
+		TransientsDir: t.TempDir(),
+		Datastore:     store,
+		FailureCh:     failures,
+	}
+	dagst, err := NewDAGStore(cfg)
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+
+	// initialization stalls while fetching the data.
+	k := shard.KeyFromString("foo")
+	registered := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), k, &gatedMount{Mount: carv2mnt, Gate: 1024}, registered, RegisterOpts{})
+	require.NoError(t, err)
+
+	ch := make(chan ShardResult, 1)
+	err = dagst.DestroyShard(context.Background(), k, ch, DestroyOpts{})
+	require.NoError(t, err)
+	require.NoError(t, (<-ch).Error)
+
+	// the registration is reported as failed, but not as a shard failure.
+	require.ErrorIs(t, (<-registered).Error, ErrShardUnknown)
+	select {
+	case res := <-failures:
+		t.Fatalf("unexpected failure notification: %v", res.Error)
+	case <-time.After(100 * time.Millisecond):
+	}
+	_, err = dagst.GetShardInfo(k)
+	require.ErrorIs(t, err, ErrShardUnknown)
+
+	// the shard isn't revived on restart.
+	require.NoError(t, dagst.Close())
+	cfg.MountRegistry = newRegistry()
+	dagst, err = NewDAGStore(cfg)
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+	defer dagst.Close()
+	require.Empty(t, dagst.AllShardsInfo())
+}
+
+// gatedMount serves the first Gate bytes of the underlying mount, and then
+// stalls until the fetch context is cancelled.
+type gatedMount struct {
+	mount.Mount
+	Gate int
+}
+
+func (g *gatedMount) Fetch(ctx context.Context) (mount.Reader, error) {
+	rd, err := g.Mount.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &gatedReader{Reader: rd, ctx: ctx, left: g.Gate}, nil
+}
+
+func (g *gatedMount) Info() mount.Info {
+	return mount.Info{Kind: mount.KindRemote, AccessSequential: true}
+}
+
+type gatedReader struct {
+	mount.Reader
+	ctx  context.Context
+	left int
+}
+
+func (g *gatedReader) Read(p []byte) (int, error) {
+	if g.left == 0 {
+		<-g.ctx.Done()
+		return 0, g.ctx.Err()
+	}
+	if len(p) > g.left {
+		p = p[:g.left]
+	}
+	n, err := g.Reader.Read(p)
+	g.left -= n
+	return n, err
+}
@@ -0,0 +1,244 @@
+package dagstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	carindex "github.com/ipld/go-car/v2/index"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+//
+// This file contains the logic to move individual shards between DAG store
+// instances. Shards are exported as bundles, which are archives in the same
+// format as backups (see dagstore_backup.go), containing a single shard.
+//
+
+type ExportShardOpts struct {
+	// IncludeData includes the CAR data of the shard in the bundle, so that
+	// the importing DAG store doesn't need to fetch it from the mount.
+	IncludeData bool
+}
+
+// ExportShard writes a bundle containing the catalogue record and the full
+// index of the shard, and optionally its CAR data, to w.
+//
+// The data is exported as served by the mount, before the transform of the
+// shard (if any) is applied, so that the importing DAG store can apply it in
+// turn.
+//
+// When exporting the data, the shard is acquired for the duration of the
+// export, which guarantees that it cannot be destroyed or have its mount
+// updated in the meantime; shards registered with lazy initialization will be
+// initialized. Otherwise, the record and the index are snapshotted with
+// exclusivity from the event loop, like backups do, and the shard is left
+// untouched.
+func (d *DAGStore) ExportShard(ctx context.Context, key shard.Key, w io.Writer, opts ExportShardOpts) error {
+	if !opts.IncludeData {
+		snaps, err := d.snapshot(ctx, func() ([]*Shard, error) {
+			d.lk.RLock()
+			s, ok := d.shards[key]
+			d.lk.RUnlock()
+			if !ok {
+				return nil, ErrShardUnknown
+			}
+			return []*Shard{s}, nil
+		}, false)
+		defer closeSnapshots(snaps)
+		if err != nil {
+			return err
+		}
+		return d.writeArchive(ctx, w, snaps, false)
+	}
+
+	ch := make(chan ShardResult, 1)
+	if err := d.AcquireShard(ctx, key, ch, AcquireOpts{}); err != nil {
+		return err
+	}
+
+	var res ShardResult
+	select {
+	case res = <-ch:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if res.Error != nil {
+		return fmt.Errorf("failed to acquire shard for export: %w", res.Error)
+	}
+	sa := res.Accessor
+	defer sa.Close()
+
+	s := sa.shard
+	s.lk.RLock()
+	bz, err := s.MarshalJSON()
+	s.lk.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to serialize shard %s: %w", key, err)
+	}
+
+	// the accessor serves transformed data; read the data from the mount
+	// instead, which is served from the local transient where there is one.
+	data, err := s.mount.Fetch(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch data of shard %s: %w", key, mount.RedactError(err, d.mounts.Secrets(s.mount)...))
+	}
+	defer data.Close()
+
+	aw, err := newArchiveWriter(w, 1, true)
+	if err != nil {
+		return err
+	}
+	if err := aw.writeShard(key, bz); err != nil {
+		return err
+	}
+	if err := aw.writeIndex(key, sa.idx); err != nil {
+		return err
+	}
+	if err := aw.writeTransient(key, data); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+type ImportShardOpts struct {
+	// Mount overrides the mount recorded in the bundle. Use this when the
+	// shard data is reachable through a different location at the
+	// destination.
+	Mount mount.Mount
+}
+
+// ImportShard imports a bundle created by ExportShard into this DAG store.
+//
+// The shard is restored with every setting recorded in the bundle, such as its
+// transform, expected roots and size, and indexing options. If the bundle
+// contains the shard index, the shard becomes available without reindexing.
+// If the bundle contains the CAR data, it is adopted as the local transient
+// copy for mounts that require one.
+//
+// This method returns an error synchronously if the bundle is invalid, or if
+// the shard already exists. Otherwise, it queues the shard for activation, and
+// the result is delivered on the supplied channel.
+func (d *DAGStore) ImportShard(ctx context.Context, r io.Reader, out chan ShardResult, opts ImportShardOpts) error {
+	ar, err := d.readArchive(r)
+	if err != nil {
+		return err
+	}
+	if len(ar.shards) != 1 {
+		return fmt.Errorf("%w: bundle must contain exactly one shard; found %d", ErrInvalidBackup, len(ar.shards))
+	}
+	ps := ar.shards[0]
+	key := shard.KeyFromString(ps.Key)
+	if ps.State == ShardStateErrored {
+		return fmt.Errorf("%s: refusing to import shard in errored state; error: %s", key, ps.Error)
+	}
+
+	d.lk.RLock()
+	_, exists := d.shards[key]
+	d.lk.RUnlock()
+	if exists {
+		return fmt.Errorf("%s: %w", key.String(), ErrShardExists)
+	}
+
+	mnt := opts.Mount
+	if mnt == nil {
+		if mnt, err = d.instantiateMount(ps); err != nil {
+			return err
+		}
+	} else if err := d.checkPersistable(mnt); err != nil {
+		return fmt.Errorf("%s: %w", key.String(), err)
+	}
+
+	// stage the index and the data before adding the shard.
+	var (
+		idx       carindex.Index
+		transient string
+	)
+	err = ar.forEachData(func(dir string, k string, r io.Reader) error {
+		if k != ps.Key {
+			return fmt.Errorf("%w: unexpected entry for shard %s", ErrInvalidBackup, k)
+		}
+		var err error
+		switch dir {
+		case backupIndicesDir:
+			if idx, err = carindex.ReadFrom(r); err != nil {
+				return fmt.Errorf("failed to read index: %w", err)
+			}
+		case backupTransientsDir:
+			if transient, err = d.restoreTransient(r, d.transientsEnc); err != nil {
+				return fmt.Errorf("failed to restore data: %w", err)
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		removeStaged(transient)
+		return err
+	}
+
+	upgraded, err := d.upgradeMount(mnt, key, transient)
+	if err != nil {
+		removeStaged(transient)
+		return err
+	}
+
+	w := &waiter{outCh: out, ctx: ctx}
+	s := &Shard{d: d}
+	s.restoreFields(ps)
+	// the shard starts afresh in this DAG store; the registration waiter is
+	// notified when it becomes available.
+	s.state, s.err = ShardStateNew, nil
+	s.mount = upgraded
+	s.wRegister = w
+
+	d.lk.Lock()
+	if _, ok := d.shards[key]; ok {
+		d.lk.Unlock()
+		removeStaged(transient)
+		return fmt.Errorf("%s: %w", key.String(), ErrShardExists)
+	}
+	if idx != nil {
+		if err := d.indices.AddFullIndex(key, idx); err != nil {
+			d.lk.Unlock()
+			removeStaged(transient)
+			return fmt.Errorf("failed to add index for shard: %w", err)
+		}
+	}
+	d.shards[key] = s
+	d.lk.Unlock()
+
+	// initialization will find the index and make the shard available right
+	// away; otherwise, it will fetch and index the shard data.
+	tsk := &task{op: OpShardInitialize, shard: s, waiter: w}
+	if err := d.queueTask(tsk, d.externalCh); err != nil {
+		// the shard never reached the event loop; forget it, along with the
+		// data we staged for it.
+		d.lk.Lock()
+		delete(d.shards, key)
+		d.lk.Unlock()
+		if idx != nil {
+			if _, err := d.indices.DropFullIndex(key); err != nil {
+				log.Warnw("failed to drop index of unimported shard", "shard", key, "error", err)
+			}
+		}
+		removeStaged(transient)
+		return err
+	}
+	return nil
+}
+
+// removeStaged removes a staged transient, if any.
+func removeStaged(path string) {
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		log.Warnw("failed to remove staged transient", "path", path, "error", err)
+	}
+}
@@ -2,6 +2,7 @@ package index
 
 import (
 	"errors"
+	"io"
 
 	"github.com/filecoin-project/dagstore/shard"
 	"github.com/ipld/go-car/v2/index"
@@ -51,6 +52,15 @@ type FullIndexRepo interface {
 	Size() (uint64, error)
 }
 
+// FullIndexOpener is implemented by FullIndexRepos that can open the
+// serialized form of a full index without deserializing it.
+type FullIndexOpener interface {
+	// OpenFullIndex opens the serialized full index for the specified shard,
+	// returning a reader and its size. The reader keeps yielding the index
+	// as it was when opened, even if the index is later dropped or replaced.
+	OpenFullIndex(key shard.Key) (io.ReadCloser, int64, error)
+}
+
 // TODO unimplemented.
 type ManifestRepo interface {
 	// ListManifests returns the available manifests for a given shard,
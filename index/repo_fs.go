@@ -2,6 +2,7 @@ package index
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -23,7 +24,10 @@ type FSIndexRepo struct {
 	baseDir string
 }
 
-var _ FullIndexRepo = (*FSIndexRepo)(nil)
+var (
+	_ FullIndexRepo   = (*FSIndexRepo)(nil)
+	_ FullIndexOpener = (*FSIndexRepo)(nil)
+)
 
 // NewFSRepo creates a new index repo that stores indices on the local
 // filesystem with the given base directory as the root
@@ -72,16 +76,43 @@ func (l *FSIndexRepo) GetFullIndex(key shard.Key) (carindex.Index, error) {
 	return carindex.ReadFrom(f)
 }
 
+// OpenFullIndex opens the index file of the specified shard.
+func (l *FSIndexRepo) OpenFullIndex(key shard.Key) (io.ReadCloser, int64, error) {
+	f, err := os.Open(l.indexPath(key))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
 func (l *FSIndexRepo) AddFullIndex(key shard.Key, index carindex.Index) (err error) {
-	// Create a file at the key path
-	f, err := os.Create(l.indexPath(key))
+	// Write the index to a temporary file, and move it into place once
+	// complete, so that readers of a previous index (see OpenFullIndex) are
+	// never affected.
+	f, err := os.CreateTemp(l.baseDir, ".tmp-*")
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	defer func() {
+		if err != nil {
+			_ = os.Remove(f.Name())
+		}
+	}()
 
 	// Write the index to the file
-	return carindex.WriteTo(index, f)
+	if err = carindex.WriteTo(index, f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), l.indexPath(key))
 }
 
 func (l *FSIndexRepo) DropFullIndex(key shard.Key) (dropped bool, err error) {
@@ -74,3 +74,45 @@ func TestFSRepoLoadFromDisk(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, offset1, offset)
 }
+
+func TestFSRepoOpenFullIndex(t *testing.T) {
+	repo, err := NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+
+	cid1, err := cid.Parse("bafykbzaceaeqhm77anl5mv2wjkmh4ofyf6s6eww3ujfmhtsfab65vi3rlccaq")
+	require.NoError(t, err)
+	k := shard.KeyFromString("shard-key-1")
+
+	newIndex := func(offset uint64) carindex.Index {
+		idx, err := carindex.New(multicodec.CarIndexSorted)
+		require.NoError(t, err)
+		err = idx.Load([]carindex.Record{{Cid: cid1, Offset: offset}})
+		require.NoError(t, err)
+		return idx
+	}
+
+	err = repo.AddFullIndex(k, newIndex(10))
+	require.NoError(t, err)
+	rd, size, err := repo.OpenFullIndex(k)
+	require.NoError(t, err)
+	defer rd.Close()
+
+	// replacing the index doesn't affect the opened one.
+	err = repo.AddFullIndex(k, newIndex(20))
+	require.NoError(t, err)
+
+	opened, err := carindex.ReadFrom(rd)
+	require.NoError(t, err)
+	offset, err := carindex.GetFirst(opened, cid1)
+	require.NoError(t, err)
+	require.EqualValues(t, 10, offset)
+
+	stat, err := repo.StatFullIndex(k)
+	require.NoError(t, err)
+	require.EqualValues(t, size, stat.Size)
+
+	// temporary files aren't counted as indices.
+	n, err := repo.Len()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
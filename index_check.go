@@ -0,0 +1,221 @@
+package dagstore
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+	carindex "github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-varint"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/transform"
+)
+
+// indexCheckSamples is the number of blocks that checkIndex verifies, besides
+// the last one.
+const indexCheckSamples = 16
+
+// ErrIndexMismatch is returned when a supplied index is inconsistent with the
+// CAR it's supposed to index.
+var ErrIndexMismatch = errors.New("index does not match CAR")
+
+// checkIndex performs a light consistency check of idx against the CAR in r.
+// It walks the section headers of the CAR, and verifies that n blocks spread
+// evenly across the CARv1 payload, as well as the last block, are indexed at
+// their actual offsets. If the size of the payload can't be determined, the
+// first n blocks are verified instead.
+func checkIndex(r io.ReaderAt, idx carindex.Index, n int) error {
+	version, err := car.ReadVersion(io.NewSectionReader(r, 0, 1<<63-1))
+	if err != nil {
+		return fmt.Errorf("failed to read CAR version: %w", err)
+	}
+
+	// offsets in the index are relative to the start of the CARv1 payload.
+	var (
+		payload io.ReaderAt
+		size    int64 = -1
+	)
+	switch version {
+	case 1:
+		payload = r
+		if sk, ok := r.(io.Seeker); ok {
+			if size, err = seekSize(sk); err != nil {
+				return fmt.Errorf("failed to determine CAR size: %w", err)
+			}
+		}
+	case 2:
+		cr, err := car.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("failed to read CARv2 header: %w", err)
+		}
+		payload, size = cr.DataReader(), int64(cr.Header.DataSize)
+	default:
+		return fmt.Errorf("unsupported CAR version: %d", version)
+	}
+
+	// skip the CARv1 header.
+	or := &offsetReader{ra: payload}
+	l, err := varint.ReadUvarint(or)
+	if err != nil {
+		return fmt.Errorf("failed to read CAR header length: %w", err)
+	}
+
+	var (
+		checked int
+		last    int64 = -1 // offset of the last section.
+		buf     [binary.MaxVarintLen64]byte
+	)
+	for off := or.off + int64(l); ; {
+		// only the section length is read, unless the section is sampled.
+		nr, err := payload.ReadAt(buf[:], off)
+		if nr == 0 && err == io.EOF {
+			break // reached the end of the CAR.
+		} else if nr == 0 {
+			return fmt.Errorf("failed to read section length at offset %d: %w", off, err)
+		}
+		l, ln, err := varint.FromUvarint(buf[:nr])
+		if err != nil {
+			return fmt.Errorf("failed to read section length at offset %d: %w", off, err)
+		}
+		if l == 0 {
+			break // null padding; treat as EOF.
+		}
+
+		// sample the first section at or past every nth of the payload.
+		if checked < n && (size < 0 || off >= size*int64(checked)/int64(n)) {
+			if err := checkSection(payload, idx, off); err != nil {
+				return err
+			}
+			checked++
+		}
+		last = off
+		off += int64(ln) + int64(l)
+	}
+
+	if last < 0 {
+		return nil // no blocks.
+	}
+	return checkSection(payload, idx, last)
+}
+
+// checkSection verifies that the block in the section starting at off is
+// indexed at that offset.
+func checkSection(r io.ReaderAt, idx carindex.Index, off int64) error {
+	or := &offsetReader{ra: r, off: off}
+	if _, err := varint.ReadUvarint(or); err != nil {
+		return fmt.Errorf("failed to read section length at offset %d: %w", off, err)
+	}
+	_, c, err := cid.CidFromReader(or)
+	if err != nil {
+		return fmt.Errorf("failed to read CID at offset %d: %w", off, err)
+	}
+
+	var found bool
+	err = idx.GetAll(c, func(o uint64) bool {
+		found = o == uint64(off)
+		return !found
+	})
+	if err != nil || !found {
+		return fmt.Errorf("%w: block %s at offset %d not indexed at that offset", ErrIndexMismatch, c, off)
+	}
+	return nil
+}
+
+// seekSize returns the size of sk by seeking to the end, and restores the
+// current offset.
+func seekSize(sk io.Seeker) (int64, error) {
+	cur, err := sk.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	size, err := sk.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := sk.Seek(cur, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// offsetReader reads sequentially from an io.ReaderAt, tracking the offset.
+type offsetReader struct {
+	ra  io.ReaderAt
+	off int64
+}
+
+func (o *offsetReader) Read(p []byte) (int, error) {
+	n, err := o.ra.ReadAt(p, o.off)
+	o.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (o *offsetReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(o, b[:])
+	return b[0], err
+}
+
+// loadExistingIndex loads the existing index supplied in RegisterOpts, if any,
+// and checks it against the CAR when the latter can be read locally.
+func loadExistingIndex(ctx context.Context, mnt mount.Mount, tf transform.Transform, opts RegisterOpts) (carindex.Index, error) {
+	idx := opts.ExistingIndex
+	if idx == nil && opts.ExistingIndexPath != "" {
+		f, err := os.Open(opts.ExistingIndexPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open existing index: %w", err)
+		}
+		defer f.Close()
+		if idx, err = carindex.ReadFrom(f); err != nil {
+			return nil, fmt.Errorf("failed to read existing index: %w", err)
+		}
+	}
+	if idx == nil {
+		return nil, nil
+	}
+	if idx.Codec() != indexCodec {
+		return nil, fmt.Errorf("unsupported codec of existing index: %s; expected %s", idx.Codec(), indexCodec)
+	}
+
+	// determine whether we can check the index without fetching remotely.
+	var r mount.Reader
+	switch info := mnt.Info(); {
+	case opts.ExistingTransient != "":
+		f, err := os.Open(opts.ExistingTransient)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open existing transient: %w", err)
+		}
+		r = f
+	case info.Kind == mount.KindLocal && info.AccessRandom:
+		var err error
+		if r, err = mnt.Fetch(ctx); err != nil {
+			return nil, fmt.Errorf("failed to fetch from mount to check existing index: %w", err)
+		}
+	default:
+		log.Debugw("cannot read CAR locally; skipping check of existing index")
+		return idx, nil
+	}
+	if tf != nil {
+		tr, err := tf.Apply(r)
+		if err != nil {
+			_ = r.Close()
+			return nil, fmt.Errorf("failed to apply transform to check existing index: %w", err)
+		}
+		r = tr
+	}
+	defer r.Close()
+
+	if err := checkIndex(r, idx, indexCheckSamples); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
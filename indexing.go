@@ -0,0 +1,244 @@
+package dagstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+	carindex "github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// defaultIndexingProgressInterval is the interval at which indexing progress
+// is reported if Config.IndexingProgressInterval is unset.
+const defaultIndexingProgressInterval = 5 * time.Second
+
+// indexingCheckEvery and indexingCheckBytes are the number of blocks and
+// bytes scanned, whichever comes first, after which the indexer checks for
+// cancellation and reports progress. The latter keeps CARs with large blocks
+// responsive.
+const (
+	indexingCheckEvery = 1024
+	indexingCheckBytes = 4 << 20 // 4MiB
+)
+
+// indexCodec is the codec of the indices generated by the DAG store, which is
+// the only one go-car can generate.
+const indexCodec = multicodec.CarIndexSorted
+
+// ErrBlockHashMismatch is returned when IndexingOpts.VerifyHashes is enabled,
+// and the data of a block in the CAR doesn't hash to its CID.
+var ErrBlockHashMismatch = errors.New("block data does not match its CID")
+
+// IndexingOpts controls how the full index of a shard is generated.
+//
+// Store-wide defaults are set through Config.Indexing, and can be overridden
+// for individual shards through RegisterOpts.Indexing.
+type IndexingOpts struct {
+	// VerifyHashes verifies that the data of every block hashes to its CID
+	// while indexing. The shard fails with ErrBlockHashMismatch otherwise.
+	// This requires reading the entire CAR, rather than skipping over block
+	// data.
+	VerifyHashes bool `json:"v,omitempty"`
+
+	// SkipIdentityCIDs omits blocks with identity CIDs from the index. Such
+	// blocks carry their data inline in the CID, so they needn't be looked
+	// up in the CAR.
+	SkipIdentityCIDs bool `json:"i,omitempty"`
+}
+
+// IndexingProgress is emitted on Config.IndexingProgressCh periodically while
+// a shard is being indexed, and once more when indexing finishes.
+type IndexingProgress struct {
+	Key shard.Key
+	// BytesScanned is the number of bytes of the CARv1 payload scanned so far.
+	BytesScanned int64
+	// BlocksIndexed is the number of blocks indexed so far.
+	BlocksIndexed int64
+	// Done is set on the final event of a successful indexing job.
+	Done bool
+}
+
+// indexer generates the full index of a CAR.
+type indexer struct {
+	opts     IndexingOpts
+	interval time.Duration
+	progress func(IndexingProgress)
+}
+
+// generate reads or generates the index of the CAR in r. An index embedded in
+// a CARv2 is used as is, unless the options require scanning the CAR, or it
+// has a codec other than indexCodec. It returns ctx.Err() if ctx is cancelled
+// while scanning.
+func (ix *indexer) generate(ctx context.Context, key shard.Key, r io.ReaderAt) (carindex.Index, error) {
+	version, err := car.ReadVersion(io.NewSectionReader(r, 0, 1<<63-1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CAR version: %w", err)
+	}
+
+	var payload io.Reader
+	switch version {
+	case 1:
+		payload = io.NewSectionReader(r, 0, 1<<63-1)
+	case 2:
+		cr, err := car.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CARv2 header: %w", err)
+		}
+		if cr.Header.HasIndex() && !ix.opts.VerifyHashes && !ix.opts.SkipIdentityCIDs {
+			idx, err := carindex.ReadFrom(cr.IndexReader())
+			if err != nil {
+				return nil, fmt.Errorf("failed to read embedded index: %w", err)
+			}
+			if idx.Codec() == indexCodec {
+				ix.report(IndexingProgress{Key: key, Done: true})
+				return idx, nil
+			}
+		}
+		payload = cr.DataReader()
+	default:
+		return nil, fmt.Errorf("unsupported CAR version: %d", version)
+	}
+	return ix.scan(ctx, key, payload)
+}
+
+// scan generates an index by scanning the CARv1 payload in r.
+func (ix *indexer) scan(ctx context.Context, key shard.Key, r io.Reader) (carindex.Index, error) {
+	cr := &countingReader{r: bufio.NewReaderSize(r, 1<<20)}
+
+	h, err := readCARv1Header(cr)
+	if err != nil {
+		return nil, err
+	}
+	if h.Version != 1 {
+		return nil, fmt.Errorf("expected CARv1 payload; got version %d", h.Version)
+	}
+
+	var (
+		records  []carindex.Record
+		last     = time.Now()
+		checked  int64 // bytes scanned at the last check.
+		buf      []byte
+		progress = IndexingProgress{Key: key}
+	)
+	for i := 0; ; i++ {
+		if i%indexingCheckEvery == 0 || cr.n-checked >= indexingCheckBytes {
+			checked = cr.n
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if now := time.Now(); now.Sub(last) >= ix.interval {
+				progress.BytesScanned, progress.BlocksIndexed = cr.n, int64(len(records))
+				ix.report(progress)
+				last = now
+			}
+		}
+
+		offset := cr.n
+		l, err := varint.ReadUvarint(cr)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read section length at offset %d: %w", offset, err)
+		}
+		if l == 0 {
+			break // null padding; treat as EOF.
+		}
+
+		cidLen, c, err := cid.CidFromReader(cr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CID at offset %d: %w", offset, err)
+		}
+		dataLen := int64(l) - int64(cidLen)
+		if dataLen < 0 {
+			return nil, fmt.Errorf("invalid section length at offset %d: %d", offset, l)
+		}
+
+		identity := c.Prefix().MhType == multihash.IDENTITY
+		if ix.opts.VerifyHashes && !identity {
+			if int64(cap(buf)) < dataLen {
+				buf = make([]byte, dataLen)
+			}
+			buf = buf[:dataLen]
+			if _, err := io.ReadFull(cr, buf); err != nil {
+				return nil, fmt.Errorf("failed to read block %s at offset %d: %w", c, offset, err)
+			}
+			if err := verifyBlock(c, buf); err != nil {
+				return nil, fmt.Errorf("block %s at offset %d: %w", c, offset, err)
+			}
+		} else if err := cr.discard(dataLen); err != nil {
+			return nil, fmt.Errorf("failed to skip block %s at offset %d: %w", c, offset, err)
+		}
+
+		if identity && ix.opts.SkipIdentityCIDs {
+			continue
+		}
+		records = append(records, carindex.Record{Cid: c, Offset: uint64(offset)})
+	}
+
+	idx, err := carindex.New(indexCodec)
+	if err != nil {
+		return nil, err
+	}
+	if err := idx.Load(records); err != nil {
+		return nil, fmt.Errorf("failed to load index records: %w", err)
+	}
+
+	progress.BytesScanned, progress.BlocksIndexed, progress.Done = cr.n, int64(len(records)), true
+	ix.report(progress)
+	return idx, nil
+}
+
+func (ix *indexer) report(p IndexingProgress) {
+	if ix.progress != nil {
+		ix.progress(p)
+	}
+}
+
+// verifyBlock checks that data hashes to c.
+func verifyBlock(c cid.Cid, data []byte) error {
+	actual, err := c.Prefix().Sum(data)
+	if err != nil {
+		return fmt.Errorf("failed to hash block: %w", err)
+	}
+	if !bytes.Equal(actual.Hash(), c.Hash()) {
+		return ErrBlockHashMismatch
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+func (c *countingReader) discard(n int64) error {
+	d, err := c.r.Discard(int(n))
+	c.n += int64(d)
+	return err
+}
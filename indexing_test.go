@@ -0,0 +1,202 @@
+package dagstore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/ipld/go-car/v2"
+	carindex "github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore/internal/carv1"
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+	"github.com/filecoin-project/dagstore/testdata"
+)
+
+func TestIndexerGenerate(t *testing.T) {
+	k := shard.KeyFromString("foo")
+
+	// the generated index matches the one go-car generates.
+	for _, bz := range [][]byte{testdata.CarV1, testdata.CarV2} {
+		expected, err := car.ReadOrGenerateIndex(bytes.NewReader(bz))
+		require.NoError(t, err)
+
+		ix := &indexer{opts: IndexingOpts{VerifyHashes: true}}
+		idx, err := ix.generate(context.Background(), k, bytes.NewReader(bz))
+		require.NoError(t, err)
+		require.Equal(t, multicodec.CarIndexSorted, idx.Codec())
+
+		expectedOff, err := carindex.GetFirst(expected, testdata.RootCID)
+		require.NoError(t, err)
+		off, err := carindex.GetFirst(idx, testdata.RootCID)
+		require.NoError(t, err)
+		require.Equal(t, expectedOff, off)
+	}
+
+	t.Run("verify hashes", func(t *testing.T) {
+		corrupted := append([]byte(nil), testdata.CarV1...)
+		corrupted[len(corrupted)-1] ^= 0xff
+
+		// without verification, the corruption goes unnoticed.
+		ix := &indexer{}
+		_, err := ix.generate(context.Background(), k, bytes.NewReader(corrupted))
+		require.NoError(t, err)
+
+		ix = &indexer{opts: IndexingOpts{VerifyHashes: true}}
+		_, err = ix.generate(context.Background(), k, bytes.NewReader(corrupted))
+		require.ErrorIs(t, err, ErrBlockHashMismatch)
+	})
+
+	t.Run("skip identity cids", func(t *testing.T) {
+		data := []byte("hello")
+		mh, err := multihash.Sum(data, multihash.SHA2_256, -1)
+		require.NoError(t, err)
+		regular := cid.NewCidV1(cid.Raw, mh)
+		mh, err = multihash.Sum(data, multihash.IDENTITY, -1)
+		require.NoError(t, err)
+		identity := cid.NewCidV1(cid.Raw, mh)
+		bz := makeCARv1(t, regular, map[cid.Cid][]byte{regular: data, identity: data})
+
+		ix := &indexer{opts: IndexingOpts{VerifyHashes: true}}
+		idx, err := ix.generate(context.Background(), k, bytes.NewReader(bz))
+		require.NoError(t, err)
+		_, err = carindex.GetFirst(idx, identity)
+		require.NoError(t, err)
+
+		ix = &indexer{opts: IndexingOpts{VerifyHashes: true, SkipIdentityCIDs: true}}
+		idx, err = ix.generate(context.Background(), k, bytes.NewReader(bz))
+		require.NoError(t, err)
+		_, err = carindex.GetFirst(idx, identity)
+		require.ErrorIs(t, err, carindex.ErrNotFound)
+		_, err = carindex.GetFirst(idx, regular)
+		require.NoError(t, err)
+	})
+
+	t.Run("cancellation", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		ix := &indexer{}
+		_, err := ix.generate(ctx, k, bytes.NewReader(testdata.CarV1))
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("large blocks", func(t *testing.T) {
+		// a few blocks larger than indexingCheckBytes; checks happen by bytes
+		// scanned, long before indexingCheckEvery blocks.
+		blocks := make(map[cid.Cid][]byte)
+		var root cid.Cid
+		for i := 0; i < 4; i++ {
+			data := bytes.Repeat([]byte{byte(i)}, indexingCheckBytes+1)
+			mh, err := multihash.Sum(data, multihash.SHA2_256, -1)
+			require.NoError(t, err)
+			root = cid.NewCidV1(cid.Raw, mh)
+			blocks[root] = data
+		}
+		bz := makeCARv1(t, root, blocks)
+
+		var reports []IndexingProgress
+		ix := &indexer{progress: func(p IndexingProgress) { reports = append(reports, p) }}
+		_, err := ix.generate(context.Background(), k, bytes.NewReader(bz))
+		require.NoError(t, err)
+		require.Len(t, reports, 6) // one at the start, one after every block, and the final one.
+		require.True(t, reports[5].Done)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		ix = &indexer{progress: func(p IndexingProgress) {
+			if p.BytesScanned > 0 {
+				cancel()
+			}
+		}}
+		_, err = ix.generate(ctx, k, bytes.NewReader(bz))
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestIndexingOpts(t *testing.T) {
+	progressCh := make(chan IndexingProgress, 16)
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:            testRegistry(t),
+		TransientsDir:            t.TempDir(),
+		Datastore:                datastore.NewMapDatastore(),
+		IndexingProgressCh:       progressCh,
+		IndexingProgressInterval: time.Nanosecond,
+	})
+	require.NoError(t, err)
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	k := shard.KeyFromString("foo")
+	v1mnt := &mount.FSMount{FS: testdata.SequentialFS, Path: testdata.FSPathCarV1}
+
+	// existing indices of unsupported codecs are rejected synchronously.
+	existing, err := car.ReadOrGenerateIndex(bytes.NewReader(testdata.CarV1))
+	require.NoError(t, err)
+	err = dagst.RegisterShard(context.Background(), k, v1mnt, nil, RegisterOpts{ExistingIndex: otherCodecIndex{existing}})
+	require.Error(t, err)
+
+	ch := make(chan ShardResult, 1)
+	opts := &IndexingOpts{VerifyHashes: true}
+	err = dagst.RegisterShard(context.Background(), k, v1mnt, ch, RegisterOpts{Indexing: opts})
+	require.NoError(t, err)
+	res := <-ch
+	require.NoError(t, res.Error)
+
+	// we get progress events, the last of which is final.
+	var last IndexingProgress
+	for p := range progressCh {
+		require.Equal(t, k, p.Key)
+		last = p
+		if p.Done {
+			break
+		}
+	}
+	require.Positive(t, last.BlocksIndexed)
+	require.EqualValues(t, len(testdata.CarV1), last.BytesScanned)
+
+	// the per-shard options are persisted.
+	sh := dagst.shards[k]
+	sh.lk.RLock()
+	bz, err := sh.MarshalJSON()
+	sh.lk.RUnlock()
+	require.NoError(t, err)
+	s := &Shard{d: dagst}
+	err = s.UnmarshalJSON(bz)
+	require.NoError(t, err)
+	require.Equal(t, opts, s.indexing)
+}
+
+// otherCodecIndex is an index reporting a codec other than the one the DAG
+// store generates.
+type otherCodecIndex struct {
+	carindex.Index
+}
+
+func (otherCodecIndex) Codec() multicodec.Code {
+	return multicodec.Sha2_256
+}
+
+// makeCARv1 builds a CARv1 with the supplied root and blocks.
+func makeCARv1(t *testing.T, root cid.Cid, blocks map[cid.Cid][]byte) []byte {
+	var buf bytes.Buffer
+	writeSection := func(bz []byte) {
+		buf.Write(varint.ToUvarint(uint64(len(bz))))
+		buf.Write(bz)
+	}
+	hdr, err := cbor.DumpObject(&carv1.Header{Roots: []cid.Cid{root}, Version: 1})
+	require.NoError(t, err)
+	writeSection(hdr)
+	for c, data := range blocks {
+		writeSection(append(c.Bytes(), data...))
+	}
+	return buf.Bytes()
+}
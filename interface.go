@@ -2,6 +2,7 @@ package dagstore
 
 import (
 	"context"
+	"io"
 
 	"github.com/filecoin-project/dagstore/mount"
 	"github.com/filecoin-project/dagstore/shard"
@@ -15,8 +16,11 @@ type Interface interface {
 	DestroyShard(ctx context.Context, key shard.Key, out chan ShardResult, _ DestroyOpts) error
 	AcquireShard(ctx context.Context, key shard.Key, out chan ShardResult, _ AcquireOpts) error
 	RecoverShard(ctx context.Context, key shard.Key, out chan ShardResult, _ RecoverOpts) error
+	UpdateMount(ctx context.Context, key shard.Key, mnt mount.Mount, out chan ShardResult, opts UpdateMountOpts) error
 	GetShardInfo(k shard.Key) (ShardInfo, error)
 	AllShardsInfo() AllShardsInfo
 	GC(ctx context.Context) (*GCResult, error)
+	ExportShard(ctx context.Context, key shard.Key, w io.Writer, opts ExportShardOpts) error
+	ImportShard(ctx context.Context, r io.Reader, out chan ShardResult, opts ImportShardOpts) error
 	Close() error
 }
@@ -0,0 +1,18 @@
+// Package carv1 holds the CARv1 header definition shared by the DAG store and
+// its mounts.
+package carv1
+
+import (
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+)
+
+func init() {
+	cbor.RegisterCborType(Header{})
+}
+
+// Header is the header of a CARv1 payload, or the pragma of a CARv2.
+type Header struct {
+	Roots   []cid.Cid
+	Version uint64
+}
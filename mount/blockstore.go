@@ -0,0 +1,181 @@
+package mount
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/multiformats/go-varint"
+
+	// registers the dag-pb, raw and dag-cbor decoders with go-ipld-format,
+	// which we use to traverse the DAG.
+	_ "github.com/ipfs/go-merkledag"
+
+	"github.com/filecoin-project/dagstore/internal/carv1"
+)
+
+// BlockstoreMount is a mount that synthesizes a CARv1 from the DAG rooted at
+// Root in a blockstore, typically one backed by a go-datastore. The CAR is
+// streamed on every Fetch, so the mount only supports sequential access, and
+// the Upgrader materializes it into a transient.
+//
+// Only Root is serialized; the Blockstore is set on the template mount
+// registered in the Registry.
+type BlockstoreMount struct {
+	// Blockstore is the blockstore holding the DAG.
+	Blockstore blockstore.Blockstore
+
+	// Root is the root CID of the DAG.
+	Root cid.Cid
+}
+
+var _ Mount = (*BlockstoreMount)(nil)
+
+// Fetch streams a CARv1 with Root as its only root, followed by every block
+// reachable from it in depth-first order. Blocks are only written once. A
+// missing block, or a block that can't be decoded, fails the read.
+func (b *BlockstoreMount) Fetch(ctx context.Context) (Reader, error) {
+	if b.Blockstore == nil {
+		return nil, fmt.Errorf("no blockstore set on mount")
+	}
+	if !b.Root.Defined() {
+		return nil, fmt.Errorf("no root set on mount")
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(b.writeCAR(ctx, pw))
+	}()
+	return &sequentialReader{ReadCloser: pr}, nil
+}
+
+func (b *BlockstoreMount) Info() Info {
+	return Info{
+		Kind:             KindLocal,
+		AccessSequential: true,
+	}
+}
+
+// Stat checks for the root block in the blockstore. The size of the CAR
+// isn't known until it's generated, so it's reported as zero.
+func (b *BlockstoreMount) Stat(_ context.Context) (Stat, error) {
+	if b.Blockstore == nil {
+		return Stat{}, fmt.Errorf("no blockstore set on mount")
+	}
+	has, err := b.Blockstore.Has(b.Root)
+	if err != nil {
+		return Stat{}, fmt.Errorf("failed to check for root %s: %w", b.Root, err)
+	}
+	return Stat{
+		Exists: has,
+		Ready:  has,
+	}, nil
+}
+
+func (b *BlockstoreMount) Serialize() *url.URL {
+	u, err := b.serialize()
+	if err != nil {
+		return &url.URL{Host: "irrecoverable"}
+	}
+	return u
+}
+
+func (b *BlockstoreMount) serialize() (*url.URL, error) {
+	if !b.Root.Defined() {
+		return nil, fmt.Errorf("undefined root CID")
+	}
+	return &url.URL{
+		Host: b.Root.String(),
+	}, nil
+}
+
+func (b *BlockstoreMount) Deserialize(u *url.URL) error {
+	c, err := cid.Decode(u.Host)
+	if err != nil {
+		return fmt.Errorf("invalid root CID in host %q: %w", u.Host, err)
+	}
+	b.Root = c
+	return nil
+}
+
+func (b *BlockstoreMount) Close() error {
+	return nil
+}
+
+func (b *BlockstoreMount) writeCAR(ctx context.Context, w io.Writer) error {
+	hdr, err := cbor.DumpObject(&carv1.Header{Roots: []cid.Cid{b.Root}, Version: 1})
+	if err != nil {
+		return fmt.Errorf("failed to encode CAR header: %w", err)
+	}
+	if err := writeSection(w, hdr); err != nil {
+		return err
+	}
+
+	seen := cid.NewSet()
+	stack := []cid.Cid{b.Root}
+	for len(stack) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !seen.Visit(c) {
+			continue
+		}
+
+		blk, err := b.Blockstore.Get(c)
+		if err != nil {
+			return fmt.Errorf("failed to get block %s: %w", c, err)
+		}
+		if err := writeSection(w, c.Bytes(), blk.RawData()); err != nil {
+			return err
+		}
+
+		links, err := blockLinks(blk)
+		if err != nil {
+			return err
+		}
+		// push in reverse, so that links are visited in order.
+		for i := len(links) - 1; i >= 0; i-- {
+			stack = append(stack, links[i].Cid)
+		}
+	}
+	return nil
+}
+
+// blockLinks returns the links of a block, decoding it with the decoders
+// registered with go-ipld-format. Raw blocks have no links.
+func blockLinks(blk blocks.Block) ([]*format.Link, error) {
+	if blk.Cid().Prefix().Codec == cid.Raw {
+		return nil, nil
+	}
+	nd, err := format.Decode(blk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode block %s: %w", blk.Cid(), err)
+	}
+	return nd.Links(), nil
+}
+
+// writeSection writes a varint-prefixed CAR section made up of the
+// concatenation of parts.
+func writeSection(w io.Writer, parts ...[]byte) error {
+	var l int
+	for _, p := range parts {
+		l += len(p)
+	}
+	if _, err := w.Write(varint.ToUvarint(uint64(l))); err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
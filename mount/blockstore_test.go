@@ -0,0 +1,174 @@
+package mount
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/filecoin-project/dagstore/throttle"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	carbs "github.com/ipld/go-car/v2/blockstore"
+	"github.com/multiformats/go-varint"
+	"github.com/stretchr/testify/require"
+)
+
+// testDAG stores a DAG in a fresh blockstore, with a shared raw leaf
+// reachable through two paths, and returns the blockstore, the root and the
+// CIDs of all the blocks in the DAG in depth-first order. dag-pb sorts links
+// by name.
+func testDAG(t *testing.T) (blockstore.Blockstore, cid.Cid, []cid.Cid) {
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+
+	shared := merkledag.NewRawNode([]byte("shared leaf"))
+	leaf := merkledag.NewRawNode([]byte("leaf"))
+	require.NoError(t, bs.PutMany([]blocks.Block{shared, leaf}))
+
+	child := merkledag.NodeWithData([]byte("child"))
+	require.NoError(t, child.AddNodeLink("shared", shared))
+	require.NoError(t, child.AddNodeLink("leaf", leaf))
+	require.NoError(t, bs.Put(child))
+
+	root := merkledag.NodeWithData([]byte("root"))
+	require.NoError(t, root.AddNodeLink("child", child))
+	require.NoError(t, root.AddNodeLink("shared", shared))
+	require.NoError(t, bs.Put(root))
+
+	return bs, root.Cid(), []cid.Cid{root.Cid(), child.Cid(), leaf.Cid(), shared.Cid()}
+}
+
+func TestBlockstoreMount(t *testing.T) {
+	ctx := context.Background()
+	bs, root, all := testDAG(t)
+
+	// unrelated blocks in the blockstore don't make it into the CAR.
+	unrelated := blocks.NewBlock([]byte("unrelated"))
+	require.NoError(t, bs.Put(unrelated))
+
+	mnt := &BlockstoreMount{Blockstore: bs, Root: root}
+	info := mnt.Info()
+	require.True(t, info.AccessSequential)
+	require.False(t, info.AccessSeek || info.AccessRandom)
+
+	stat, err := mnt.Stat(ctx)
+	require.NoError(t, err)
+	require.True(t, stat.Exists)
+
+	rd, err := mnt.Fetch(ctx)
+	require.NoError(t, err)
+	car, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+
+	// hide the Seeker, so that the index is generated from the start of the
+	// CAR rather than from wherever the version check left the reader.
+	robs, err := carbs.NewReadOnly(struct{ io.ReaderAt }{bytes.NewReader(car)}, nil)
+	require.NoError(t, err)
+	roots, err := robs.Roots()
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{root}, roots)
+
+	// every block is written once, in depth-first order.
+	require.Equal(t, all, carCIDs(t, car))
+	for _, c := range all {
+		blk, err := robs.Get(c)
+		require.NoError(t, err)
+		expected, err := bs.Get(c)
+		require.NoError(t, err)
+		require.Equal(t, expected.RawData(), blk.RawData())
+	}
+
+	// a missing root doesn't exist.
+	mnt = &BlockstoreMount{Blockstore: bs, Root: blocks.NewBlock([]byte("missing")).Cid()}
+	stat, err = mnt.Stat(ctx)
+	require.NoError(t, err)
+	require.False(t, stat.Exists)
+}
+
+// carCIDs returns the CIDs of the blocks of a CARv1, in order.
+func carCIDs(t *testing.T, car []byte) []cid.Cid {
+	br := bufio.NewReader(bytes.NewReader(car))
+	var ret []cid.Cid
+	for first := true; ; first = false {
+		l, err := varint.ReadUvarint(br)
+		if err == io.EOF {
+			return ret
+		}
+		require.NoError(t, err)
+		section := make([]byte, l)
+		_, err = io.ReadFull(br, section)
+		require.NoError(t, err)
+		if first {
+			continue // header.
+		}
+		_, c, err := cid.CidFromBytes(section)
+		require.NoError(t, err)
+		ret = append(ret, c)
+	}
+}
+
+func TestBlockstoreMountMissingBlock(t *testing.T) {
+	ctx := context.Background()
+	bs, root, all := testDAG(t)
+	require.NoError(t, bs.DeleteBlock(all[len(all)-1]))
+
+	mnt := &BlockstoreMount{Blockstore: bs, Root: root}
+	rd, err := mnt.Fetch(ctx)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(rd)
+	require.ErrorIs(t, err, blockstore.ErrNotFound)
+	require.NoError(t, rd.Close())
+}
+
+func TestBlockstoreMountRegistry(t *testing.T) {
+	bs, root, _ := testDAG(t)
+
+	r := NewRegistry()
+	require.NoError(t, r.Register("blockstore", &BlockstoreMount{Blockstore: bs}))
+
+	u, err := r.Represent(&BlockstoreMount{Blockstore: bs, Root: root})
+	require.NoError(t, err)
+	require.Equal(t, "blockstore", u.Scheme)
+
+	mnt, err := r.Instantiate(u)
+	require.NoError(t, err)
+	require.Equal(t, root, mnt.(*BlockstoreMount).Root)
+	require.Equal(t, bs, mnt.(*BlockstoreMount).Blockstore)
+
+	_, err = r.Instantiate(&url.URL{Scheme: "blockstore", Host: "notacid"})
+	require.Error(t, err)
+}
+
+func TestBlockstoreMountUpgrade(t *testing.T) {
+	ctx := context.Background()
+	bs, root, _ := testDAG(t)
+
+	mnt := &BlockstoreMount{Blockstore: bs, Root: root}
+	rd, err := mnt.Fetch(ctx)
+	require.NoError(t, err)
+	expected, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+
+	// the upgrader materializes the CAR into a transient.
+	u, err := Upgrade(mnt, throttle.Noop(), t.TempDir(), "foo", "")
+	require.NoError(t, err)
+	rd, err = u.Fetch(ctx)
+	require.NoError(t, err)
+	buf := make([]byte, 16)
+	_, err = rd.ReadAt(buf, 4)
+	require.NoError(t, err)
+	require.Equal(t, expected[4:20], buf)
+	require.NoError(t, rd.Close())
+	_, err = os.Stat(u.TransientPath())
+	require.NoError(t, err)
+}
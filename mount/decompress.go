@@ -0,0 +1,263 @@
+package mount
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression formats supported by DecompressMount.
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// DecompressMount is a mount that transparently decompresses a gzip or zstd
+// compressed CAR served by an inner mount. It only supports sequential access,
+// so it's upgraded to a decompressed transient copy.
+//
+// If Compression is empty, the format is detected from the magic bytes at
+// the start of the inner mount.
+//
+// Stat reports the uncompressed size if it's known, i.e. if Size is set, or
+// if it can be read cheaply from the frame header of zstd data (if the encoder
+// recorded the content size). Otherwise, the size is reported as 0. The gzip
+// trailer isn't trusted, as it only holds the size of the last member, modulo
+// 2^32.
+//
+// Its URL representation carries the URL of the inner mount in its query
+// string, along with the compression format and the size, if set. Like
+// SectionMount, representing and instantiating the inner mount requires
+// Registry to be set.
+type DecompressMount struct {
+	Inner Mount
+
+	// Compression is CompressionGzip, CompressionZstd, or empty to detect
+	// the format.
+	Compression string
+
+	// Size is the uncompressed size, if known.
+	Size int64
+
+	// Registry is used to represent and instantiate the inner mount.
+	Registry *Registry
+}
+
+var _ Mount = (*DecompressMount)(nil)
+
+func (d *DecompressMount) Fetch(ctx context.Context) (Reader, error) {
+	r, err := d.Inner.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(r)
+
+	compression := d.Compression
+	if compression == "" {
+		magic, _ := br.Peek(len(zstdMagic))
+		if compression = detectCompression(magic); compression == "" {
+			_ = r.Close()
+			return nil, fmt.Errorf("unrecognized compression format")
+		}
+	}
+
+	var dr io.ReadCloser
+	switch compression {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			_ = r.Close()
+			return nil, fmt.Errorf("failed to open gzip stream: %w", err)
+		}
+		dr = zr
+	case CompressionZstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			_ = r.Close()
+			return nil, fmt.Errorf("failed to open zstd stream: %w", err)
+		}
+		dr = zr.IOReadCloser()
+	default:
+		_ = r.Close()
+		return nil, fmt.Errorf("unsupported compression format: %s", compression)
+	}
+
+	return &sequentialReader{ReadCloser: &decompressReader{ReadCloser: dr, inner: r}}, nil
+}
+
+func (d *DecompressMount) Info() Info {
+	return Info{
+		Kind:             d.Inner.Info().Kind,
+		AccessSequential: true,
+	}
+}
+
+func (d *DecompressMount) Stat(ctx context.Context) (Stat, error) {
+	stat, err := d.Inner.Stat(ctx)
+	if err != nil || !stat.Exists {
+		return stat, err
+	}
+	compressed := stat.Size
+	stat.Size = d.Size
+	if d.Size == 0 {
+		stat.Size = d.uncompressedSize(ctx, compressed)
+	}
+	return stat, nil
+}
+
+// uncompressedSize reads the uncompressed size from the header of zstd data,
+// if possible. It returns 0 if the size is unknown.
+func (d *DecompressMount) uncompressedSize(ctx context.Context, compressed int64) int64 {
+	if d.Compression == CompressionGzip {
+		return 0
+	}
+	head, err := d.readAt(ctx, 0, zstd.HeaderMaxSize, compressed)
+	if err != nil {
+		return 0
+	}
+	if d.Compression == "" && detectCompression(head) != CompressionZstd {
+		return 0
+	}
+	var hdr zstd.Header
+	if err := hdr.Decode(head); err == nil && hdr.HasFCS {
+		return int64(hdr.FrameContentSize)
+	}
+	return 0
+}
+
+// readAt reads up to n bytes at off from the inner mount, if it supports
+// ranged reads or random access. Otherwise, it can only read from the start
+// of local mounts.
+func (d *DecompressMount) readAt(ctx context.Context, off, n, size int64) ([]byte, error) {
+	if size > 0 && off+n > size {
+		n = size - off
+	}
+	info := d.Inner.Info()
+	if rf, ok := d.Inner.(RangeFetcher); ok && info.AccessRanged && n > 0 {
+		rc, err := rf.FetchRange(ctx, off, n)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(io.LimitReader(rc, n))
+	}
+	if !info.AccessRandom && (off > 0 || info.Kind != KindLocal) {
+		return nil, ErrRandomAccessUnsupported
+	}
+
+	r, err := d.Inner.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if !info.AccessRandom {
+		return io.ReadAll(io.LimitReader(r, n))
+	}
+	buf := make([]byte, n)
+	read, err := r.ReadAt(buf, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return buf[:read], err
+}
+
+func (d *DecompressMount) Serialize() *url.URL {
+	u, err := d.serialize()
+	if err != nil {
+		return &url.URL{Host: "irrecoverable"}
+	}
+	return u
+}
+
+func (d *DecompressMount) serialize() (*url.URL, error) {
+	if d.Registry == nil {
+		return nil, fmt.Errorf("no registry to represent inner mount")
+	}
+	inner, err := d.Registry.Represent(d.Inner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to represent inner mount: %w", err)
+	}
+	q := url.Values{}
+	q.Set("inner", inner.String())
+	if d.Compression != "" {
+		q.Set("compression", d.Compression)
+	}
+	if d.Size > 0 {
+		q.Set("size", strconv.FormatInt(d.Size, 10))
+	}
+	return &url.URL{Host: "decompress", RawQuery: q.Encode()}, nil
+}
+
+func (d *DecompressMount) Deserialize(u *url.URL) error {
+	if u.Host == "irrecoverable" || u.Host == "" {
+		return fmt.Errorf("invalid host")
+	}
+	if d.Registry == nil {
+		return fmt.Errorf("no registry to instantiate inner mount")
+	}
+
+	q := u.Query()
+	switch d.Compression = q.Get("compression"); d.Compression {
+	case "", CompressionGzip, CompressionZstd:
+	default:
+		return fmt.Errorf("unsupported compression format: %s", d.Compression)
+	}
+	d.Size = 0
+	if v := q.Get("size"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid size: %q", v)
+		}
+		d.Size = size
+	}
+	inner, err := ParseURL(q.Get("inner"))
+	if err != nil {
+		return fmt.Errorf("invalid inner mount url: %w", err)
+	}
+	if d.Inner, err = d.Registry.Instantiate(inner); err != nil {
+		return fmt.Errorf("failed to instantiate inner mount: %w", err)
+	}
+	return nil
+}
+
+func (d *DecompressMount) Close() error {
+	return d.Inner.Close()
+}
+
+// detectCompression detects the compression format from the magic bytes at
+// the start of the data. It returns an empty string if the format is unknown.
+func detectCompression(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return CompressionGzip
+	case bytes.HasPrefix(head, zstdMagic):
+		return CompressionZstd
+	}
+	return ""
+}
+
+// decompressReader closes both the decompressor and the inner reader.
+type decompressReader struct {
+	io.ReadCloser
+	inner io.Closer
+}
+
+func (r *decompressReader) Close() error {
+	err := r.ReadCloser.Close()
+	if cerr := r.inner.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,102 @@
+package mount
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"testing"
+	"testing/fstest"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore/testdata"
+	"github.com/filecoin-project/dagstore/throttle"
+)
+
+func TestDecompressMount(t *testing.T) {
+	ctx := context.Background()
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, err := gw.Write(testdata.CarV1)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	zw, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	zst := zw.EncodeAll(testdata.CarV1, nil)
+
+	for name, tc := range map[string]struct {
+		mnt  *DecompressMount
+		size int64
+	}{
+		"gzip detected":          {mnt: &DecompressMount{Inner: &BytesMount{Bytes: gz.Bytes()}}, size: 0},
+		"zstd detected":          {mnt: &DecompressMount{Inner: &BytesMount{Bytes: zst}}, size: int64(len(testdata.CarV1))},
+		"zstd explicit":          {mnt: &DecompressMount{Inner: &BytesMount{Bytes: zst}, Compression: CompressionZstd}, size: int64(len(testdata.CarV1))},
+		"gzip sequential inner":  {mnt: &DecompressMount{Inner: &FSMount{FS: testdata.Sequential(fstest.MapFS{"car.gz": {Data: gz.Bytes()}}), Path: "car.gz"}}, size: 0},
+		"gzip with size setting": {mnt: &DecompressMount{Inner: &FSMount{FS: testdata.Sequential(fstest.MapFS{"car.gz": {Data: gz.Bytes()}}), Path: "car.gz"}, Size: 42}, size: 42},
+	} {
+		t.Run(name, func(t *testing.T) {
+			info := tc.mnt.Info()
+			require.True(t, info.AccessSequential)
+			require.False(t, info.AccessSeek || info.AccessRandom)
+
+			stat, err := tc.mnt.Stat(ctx)
+			require.NoError(t, err)
+			require.True(t, stat.Exists)
+			require.Equal(t, tc.size, stat.Size)
+
+			rd, err := tc.mnt.Fetch(ctx)
+			require.NoError(t, err)
+			bz, err := ioutil.ReadAll(rd)
+			require.NoError(t, err)
+			require.NoError(t, rd.Close())
+			require.Equal(t, testdata.CarV1, bz)
+		})
+	}
+
+	// the upgrader materializes a decompressed transient.
+	u, err := Upgrade(&DecompressMount{Inner: &BytesMount{Bytes: zst}}, throttle.Noop(), t.TempDir(), "foo", "")
+	require.NoError(t, err)
+	defer u.Close()
+	rd, err := u.Fetch(ctx)
+	require.NoError(t, err)
+	buf := make([]byte, 10)
+	_, err = rd.ReadAt(buf, 100)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	require.Equal(t, testdata.CarV1[100:110], buf)
+
+	// uncompressed data and mismatched formats are rejected.
+	_, err = (&DecompressMount{Inner: &BytesMount{Bytes: testdata.CarV1}}).Fetch(ctx)
+	require.Error(t, err)
+	_, err = (&DecompressMount{Inner: &BytesMount{Bytes: zst}, Compression: CompressionGzip}).Fetch(ctx)
+	require.Error(t, err)
+}
+
+func TestDecompressMountRegistry(t *testing.T) {
+	r := NewRegistry()
+	require.NoError(t, r.Register("bytes", new(BytesMount)))
+	require.NoError(t, r.Register("decompress", &DecompressMount{Registry: r}))
+
+	mnt := &DecompressMount{Inner: &BytesMount{Bytes: []byte("foo")}, Compression: CompressionZstd, Size: 1234, Registry: r}
+	u, err := r.Represent(mnt)
+	require.NoError(t, err)
+	require.Equal(t, "decompress", u.Scheme)
+
+	m, err := r.Instantiate(u)
+	require.NoError(t, err)
+	dm, ok := m.(*DecompressMount)
+	require.True(t, ok)
+	require.Equal(t, &BytesMount{Bytes: []byte("foo")}, dm.Inner)
+	require.Equal(t, CompressionZstd, dm.Compression)
+	require.EqualValues(t, 1234, dm.Size)
+
+	q := u.Query()
+	q.Set("compression", "lz4")
+	u.RawQuery = q.Encode()
+	_, err = r.Instantiate(u)
+	require.Error(t, err)
+}
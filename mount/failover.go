@@ -0,0 +1,189 @@
+package mount
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// FailoverMount is a composite mount over several sources of the same CAR, in
+// order of preference, e.g. a local disk, a NAS, and a remote worker.
+//
+// Fetch tries the sources that exist and are ready first, then the ones that
+// exist but aren't ready, in order, falling back to the next source if a fetch
+// fails. Info reports the capabilities common to all sources, so that any
+// source can serve the reader.
+//
+// Its URL representation carries the URLs of all sources, in order, in its
+// query string. Like SectionMount, representing and instantiating the sources
+// requires Registry to be set.
+type FailoverMount struct {
+	Sources []Mount
+
+	// Registry is used to represent and instantiate the sources.
+	Registry *Registry
+}
+
+var _ Mount = (*FailoverMount)(nil)
+
+func (f *FailoverMount) Fetch(ctx context.Context) (Reader, error) {
+	candidates, err := f.candidates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("none of the %d sources exist", len(f.Sources))
+	}
+
+	var errs []string
+	for _, c := range candidates {
+		r, err := f.Sources[c].Fetch(ctx)
+		if err == nil {
+			return r, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		log.Warnw("failover mount: failed to fetch from source; trying next", "source", c, "error", err)
+		errs = append(errs, fmt.Sprintf("source %d: %s", c, err))
+	}
+	return nil, fmt.Errorf("failed to fetch from all sources: %v", errs)
+}
+
+// candidates returns the indices of the sources that exist, the ready ones
+// first, preserving their order otherwise. It fails if no source could be
+// stat'ed.
+func (f *FailoverMount) candidates(ctx context.Context) ([]int, error) {
+	var ready, notReady []int
+	var errs int
+	for i, src := range f.Sources {
+		stat, err := src.Stat(ctx)
+		switch {
+		case err != nil:
+			log.Debugw("failover mount: failed to stat source", "source", i, "error", err)
+			errs++
+		case !stat.Exists:
+		case stat.Ready:
+			ready = append(ready, i)
+		default:
+			notReady = append(notReady, i)
+		}
+	}
+	if errs > 0 && errs == len(f.Sources) {
+		return nil, fmt.Errorf("failed to stat all %d sources", errs)
+	}
+	return append(ready, notReady...), nil
+}
+
+func (f *FailoverMount) Info() Info {
+	if len(f.Sources) == 0 {
+		return Info{Kind: KindRemote}
+	}
+	ret := Info{
+		Kind:             KindLocal,
+		AccessSequential: true,
+		AccessSeek:       true,
+		AccessRandom:     true,
+	}
+	for _, src := range f.Sources {
+		info := src.Info()
+		if info.Kind == KindRemote {
+			ret.Kind = KindRemote
+		}
+		ret.AccessSequential = ret.AccessSequential && info.AccessSequential
+		ret.AccessSeek = ret.AccessSeek && info.AccessSeek
+		ret.AccessRandom = ret.AccessRandom && info.AccessRandom
+	}
+	return ret
+}
+
+// Stat returns the stat of the preferred source, i.e. the first one that
+// exists and is ready, or else the first one that exists.
+func (f *FailoverMount) Stat(ctx context.Context) (Stat, error) {
+	var (
+		first *Stat
+		errs  int
+		err   error
+	)
+	for _, src := range f.Sources {
+		var stat Stat
+		if stat, err = src.Stat(ctx); err != nil {
+			errs++
+			continue
+		}
+		if stat.Exists && stat.Ready {
+			return stat, nil
+		}
+		if stat.Exists && first == nil {
+			first = &stat
+		}
+	}
+	if first != nil {
+		return *first, nil
+	}
+	// no source exists; fail if we couldn't tell for any of them.
+	if errs > 0 && errs == len(f.Sources) {
+		return Stat{}, fmt.Errorf("failed to stat all %d sources: %w", errs, err)
+	}
+	return Stat{Exists: false}, nil
+}
+
+func (f *FailoverMount) Serialize() *url.URL {
+	u, err := f.serialize()
+	if err != nil {
+		return &url.URL{Host: "irrecoverable"}
+	}
+	return u
+}
+
+func (f *FailoverMount) serialize() (*url.URL, error) {
+	if f.Registry == nil {
+		return nil, fmt.Errorf("no registry to represent sources")
+	}
+	q := url.Values{}
+	for i, src := range f.Sources {
+		u, err := f.Registry.Represent(src)
+		if err != nil {
+			return nil, fmt.Errorf("failed to represent source %d: %w", i, err)
+		}
+		q.Add("source", u.String())
+	}
+	return &url.URL{Host: "failover", RawQuery: q.Encode()}, nil
+}
+
+func (f *FailoverMount) Deserialize(u *url.URL) error {
+	if u.Host == "irrecoverable" || u.Host == "" {
+		return fmt.Errorf("invalid host")
+	}
+	if f.Registry == nil {
+		return fmt.Errorf("no registry to instantiate sources")
+	}
+
+	sources := u.Query()["source"]
+	if len(sources) == 0 {
+		return fmt.Errorf("no sources")
+	}
+	f.Sources = make([]Mount, 0, len(sources))
+	for i, s := range sources {
+		su, err := ParseURL(s)
+		if err != nil {
+			return fmt.Errorf("invalid url for source %d: %w", i, err)
+		}
+		m, err := f.Registry.Instantiate(su)
+		if err != nil {
+			return fmt.Errorf("failed to instantiate source %d: %w", i, err)
+		}
+		f.Sources = append(f.Sources, m)
+	}
+	return nil
+}
+
+func (f *FailoverMount) Close() error {
+	var err error
+	for _, src := range f.Sources {
+		if cerr := src.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
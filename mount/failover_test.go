@@ -0,0 +1,127 @@
+package mount
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore/testdata"
+)
+
+func TestFailoverMount(t *testing.T) {
+	ctx := context.Background()
+
+	missing := &faultyMount{stat: Stat{Exists: false}}
+	broken := &faultyMount{stat: Stat{Exists: true, Ready: true}, fetchErr: errors.New("boom")}
+	unreachable := &faultyMount{statErr: errors.New("unreachable")}
+	notReady := &faultyMount{stat: Stat{Exists: true, Ready: false}, Mount: &BytesMount{Bytes: []byte("not ready")}}
+	good := &faultyMount{stat: Stat{Exists: true, Ready: true}, Mount: &BytesMount{Bytes: testdata.CarV1}}
+
+	mnt := &FailoverMount{Sources: []Mount{missing, unreachable, notReady, broken, good}}
+
+	// the ready source is preferred over the one that's not ready.
+	stat, err := mnt.Stat(ctx)
+	require.NoError(t, err)
+	require.True(t, stat.Exists && stat.Ready)
+
+	// the broken source is skipped.
+	rd, err := mnt.Fetch(ctx)
+	require.NoError(t, err)
+	bz, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	require.Equal(t, testdata.CarV1, bz)
+	require.Equal(t, 0, missing.fetches)
+	require.Equal(t, 1, broken.fetches)
+	require.Equal(t, 1, good.fetches)
+	require.Equal(t, 0, notReady.fetches)
+
+	// sources that aren't ready are used as a last resort.
+	good.fetchErr = errors.New("boom")
+	rd, err = mnt.Fetch(ctx)
+	require.NoError(t, err)
+	bz, err = ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, []byte("not ready"), bz)
+
+	// all sources fail.
+	notReady.fetchErr = errors.New("boom")
+	_, err = mnt.Fetch(ctx)
+	require.Error(t, err)
+
+	// no source exists.
+	mnt = &FailoverMount{Sources: []Mount{missing, unreachable}}
+	stat, err = mnt.Stat(ctx)
+	require.NoError(t, err)
+	require.False(t, stat.Exists)
+	_, err = mnt.Fetch(ctx)
+	require.Error(t, err)
+
+	// no source can be stat'ed.
+	mnt = &FailoverMount{Sources: []Mount{unreachable}}
+	_, err = mnt.Stat(ctx)
+	require.Error(t, err)
+
+	// capabilities are those common to all sources.
+	mnt = &FailoverMount{Sources: []Mount{&BytesMount{}, &FSMount{FS: testdata.SequentialFS}}}
+	info := mnt.Info()
+	require.True(t, info.AccessSequential)
+	require.False(t, info.AccessSeek || info.AccessRandom)
+	require.Equal(t, KindLocal, info.Kind)
+}
+
+func TestFailoverMountRegistry(t *testing.T) {
+	r := NewRegistry()
+	require.NoError(t, r.Register("bytes", new(BytesMount)))
+	require.NoError(t, r.Register("failover", &FailoverMount{Registry: r}))
+
+	mnt := &FailoverMount{
+		Sources:  []Mount{&BytesMount{Bytes: []byte("a")}, &BytesMount{Bytes: []byte("b")}, &BytesMount{Bytes: []byte("c")}},
+		Registry: r,
+	}
+	u, err := r.Represent(mnt)
+	require.NoError(t, err)
+	require.Equal(t, "failover", u.Scheme)
+
+	u, err = url.Parse(u.String())
+	require.NoError(t, err)
+	m, err := r.Instantiate(u)
+	require.NoError(t, err)
+	fm, ok := m.(*FailoverMount)
+	require.True(t, ok)
+	// the order of the sources is preserved.
+	require.Equal(t, mnt.Sources, fm.Sources)
+
+	_, err = r.Instantiate(&url.URL{Scheme: "failover", Host: "failover"})
+	require.Error(t, err)
+}
+
+// faultyMount is a mount with a canned Stat, whose fetches can be made to
+// fail.
+type faultyMount struct {
+	Mount
+	stat     Stat
+	statErr  error
+	fetchErr error
+	fetches  int
+}
+
+func (f *faultyMount) Stat(_ context.Context) (Stat, error) {
+	return f.stat, f.statErr
+}
+
+func (f *faultyMount) Fetch(ctx context.Context) (Reader, error) {
+	f.fetches++
+	if f.fetchErr != nil {
+		return nil, f.fetchErr
+	}
+	return f.Mount.Fetch(ctx)
+}
+
+func (f *faultyMount) Info() Info {
+	return Info{Kind: KindRemote, AccessSequential: true}
+}
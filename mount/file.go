@@ -5,8 +5,17 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
+// FileMount is a mount that opens the local file indicated by Path.
+//
+// It is represented as a file URL, e.g. file:///path/to/file.car for absolute
+// paths, and file:relative/path.car for relative paths, which are resolved
+// against the working directory when fetching. URLs persisted by former
+// versions, which carried the path in the host component, are still
+// accepted; see ParseURL.
 type FileMount struct {
 	Path string
 }
@@ -28,26 +37,52 @@ func (f *FileMount) Info() Info {
 
 func (f *FileMount) Stat(_ context.Context) (Stat, error) {
 	stat, err := os.Stat(f.Path)
-	if err != nil && os.IsNotExist(err) {
+	if os.IsNotExist(err) {
+		return Stat{Exists: false}, nil
+	}
+	if err != nil {
 		return Stat{}, err
 	}
 	return Stat{
-		Exists: !os.IsNotExist(err),
-		Size:   stat.Size(),
-	}, err
+		Exists:  true,
+		Size:    stat.Size(),
+		Ready:   true,
+		ModTime: stat.ModTime(),
+	}, nil
 }
 
 func (f *FileMount) Serialize() *url.URL {
-	return &url.URL{
-		Host: f.Path,
+	p := filepath.ToSlash(f.Path)
+	if !filepath.IsAbs(f.Path) {
+		// URL paths are absolute, so relative paths are carried opaquely.
+		return &url.URL{Opaque: (&url.URL{Path: p}).EscapedPath()}
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p // paths starting with a volume name, e.g. C:/file.car.
 	}
+	return &url.URL{Path: p}
 }
 
 func (f *FileMount) Deserialize(u *url.URL) error {
-	if u.Host == "" {
-		return fmt.Errorf("invalid host")
+	switch {
+	case u.Host != "":
+		// legacy representation, with the path in the host.
+		f.Path = u.Host
+	case u.Opaque != "":
+		p, err := url.PathUnescape(u.Opaque)
+		if err != nil {
+			return fmt.Errorf("invalid path: %w", err)
+		}
+		f.Path = filepath.FromSlash(p)
+	case u.Path != "":
+		p := u.Path
+		if filepath.VolumeName(filepath.FromSlash(p[1:])) != "" {
+			p = p[1:] // strip the slash preceding a volume name.
+		}
+		f.Path = filepath.FromSlash(p)
+	default:
+		return fmt.Errorf("invalid path")
 	}
-	f.Path = u.Host
 	return nil
 }
 
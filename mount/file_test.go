@@ -6,6 +6,8 @@ import (
 	"crypto/rand"
 	"io"
 	"io/ioutil"
+	"net/url"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -34,9 +36,10 @@ func TestFileMount(t *testing.T) {
 	require.NoError(t, err)
 	require.True(t, stat.Exists)
 	require.EqualValues(t, size, stat.Size)
+	require.False(t, stat.ModTime.IsZero())
 
 	// check URL.
-	require.Equal(t, mnt.Path, mnt.Serialize().Host)
+	require.Equal(t, mnt.Path, mnt.Serialize().Path)
 
 	info := mnt.Info()
 	require.True(t, info.AccessSequential && info.AccessSeek && info.AccessRandom) // all flags true
@@ -71,3 +74,74 @@ func TestFileMount(t *testing.T) {
 	err = reader.Close()
 	require.NoError(t, err)
 }
+
+func TestFileMountStatMissing(t *testing.T) {
+	mnt := &FileMount{Path: filepath.Join(t.TempDir(), "missing")}
+	stat, err := mnt.Stat(context.Background())
+	require.NoError(t, err)
+	require.False(t, stat.Exists)
+
+	// errors other than non-existence are reported.
+	f, err := ioutil.TempFile(t.TempDir(), "")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	mnt = &FileMount{Path: filepath.Join(f.Name(), "child")}
+	_, err = mnt.Stat(context.Background())
+	require.Error(t, err)
+}
+
+func TestFileMountURL(t *testing.T) {
+	r := NewRegistry()
+	require.NoError(t, r.Register("file", new(FileMount)))
+
+	for _, p := range []string{
+		"/tmp/sample.car",
+		"/tmp/with space/100%/a:80/what?#.car",
+		"relative/sample.car",
+		"../relative:colon/with space%.car",
+		"sample.car",
+	} {
+		p = filepath.FromSlash(p)
+		u, err := r.Represent(&FileMount{Path: p})
+		require.NoError(t, err)
+		require.Empty(t, u.Host)
+
+		// the URL survives a round trip through its string form.
+		parsed, err := ParseURL(u.String())
+		require.NoError(t, err)
+		m, err := r.Instantiate(parsed)
+		require.NoError(t, err)
+		require.Equal(t, p, m.(*FileMount).Path, u.String())
+	}
+}
+
+func TestFileMountLegacyURL(t *testing.T) {
+	r := NewRegistry()
+	require.NoError(t, r.Register("file", new(FileMount)))
+
+	for _, p := range []string{
+		"/tmp/sample.car",
+		"/tmp/with space/a:80/100%.car",
+		"../relative/sample.car",
+		"sample.car",
+	} {
+		// former versions carried the path in the host.
+		legacy := (&url.URL{Scheme: "file", Host: p}).String()
+		u, err := ParseURL(legacy)
+		require.NoError(t, err, legacy)
+		m, err := r.Instantiate(u)
+		require.NoError(t, err)
+		require.Equal(t, p, m.(*FileMount).Path, legacy)
+
+		// and are represented in the current form from then on.
+		u, err = r.Represent(m)
+		require.NoError(t, err)
+		require.Empty(t, u.Host)
+		require.False(t, IsLegacyURL(u.String()), u.String())
+	}
+
+	require.True(t, IsLegacyURL((&url.URL{Scheme: "file", Host: "/tmp/sample.car"}).String()))
+	require.False(t, IsLegacyURL("file://%zz"))
+	_, err := ParseURL("file://%zz")
+	require.Error(t, err)
+}
@@ -7,18 +7,33 @@ import (
 	"io"
 	"io/fs"
 	"net/url"
+	gopath "path"
+	"sync/atomic"
 )
 
 const path = "path"
 
 // FSMount is a mount that opens the file indicated by Path, using the
-// provided fs.FS. Given that io/fs does not support random access patterns,
-// this mount requires an Upgrade. It is suitable for testing.
+// provided fs.FS. io/fs does not mandate random access patterns, so the
+// capabilities of this mount depend on the files returned by the fs.FS (e.g.
+// those of os.DirFS support seeking and random access; see Info). When
+// they're lacking, this mount requires an Upgrade.
 type FSMount struct {
 	FS   fs.FS
 	Path string
+
+	// caps caches the capabilities of the file once it's been opened; see
+	// Info. Accessed atomically.
+	caps uint32
 }
 
+// capability bits of FSMount.caps.
+const (
+	fsCapsKnown uint32 = 1 << iota
+	fsCapsSeek
+	fsCapsRandom
+)
+
 var _ Mount = (*FSMount)(nil)
 
 func (f *FSMount) Close() error {
@@ -37,6 +52,7 @@ func (f *FSMount) Fetch(ctx context.Context) (Reader, error) {
 	if err != nil {
 		return nil, err
 	}
+	f.learnCaps(file)
 	ra, _ := file.(io.ReaderAt)
 	sk, _ := file.(io.Seeker)
 	return &fsReader{
@@ -46,13 +62,36 @@ func (f *FSMount) Fetch(ctx context.Context) (Reader, error) {
 	}, err
 }
 
+// Info reports the capabilities of the file returned by the fs.FS. They're
+// determined by opening the file the first time it's needed, unless it's been
+// fetched already, and cached from then on. If the file can't be opened, only
+// sequential access is reported, and the capabilities are probed again on the
+// next call.
 func (f *FSMount) Info() Info {
-	return Info{
-		Kind:             KindLocal,
-		AccessSequential: true,
-		AccessSeek:       false, // TODO actual capabilities depend on the fs.FS implementation!
-		AccessRandom:     false, // TODO actual capabilities depend on the fs.FS implementation!
+	info := Info{Kind: KindLocal, AccessSequential: true}
+	caps := atomic.LoadUint32(&f.caps)
+	if caps == 0 && f.FS != nil {
+		if file, err := f.FS.Open(f.Path); err == nil {
+			caps = f.learnCaps(file)
+			_ = file.Close()
+		}
 	}
+	info.AccessSeek = caps&fsCapsSeek != 0
+	info.AccessRandom = caps&fsCapsRandom != 0
+	return info
+}
+
+// learnCaps caches the capabilities of file, and returns them.
+func (f *FSMount) learnCaps(file fs.File) uint32 {
+	caps := fsCapsKnown
+	if _, ok := file.(io.Seeker); ok {
+		caps |= fsCapsSeek
+	}
+	if _, ok := file.(io.ReaderAt); ok {
+		caps |= fsCapsRandom
+	}
+	atomic.StoreUint32(&f.caps, caps)
+	return caps
 }
 
 func (f *FSMount) Stat(_ context.Context) (Stat, error) {
@@ -69,16 +108,18 @@ func (f *FSMount) Stat(_ context.Context) (Stat, error) {
 	}, nil
 }
 
+// Serialize doesn't access the file, so that a file that's temporarily
+// unavailable remains recoverable. The host is the base name of the file.
 func (f *FSMount) Serialize() *url.URL {
 	u := new(url.URL)
-	if st, err := fs.Stat(f.FS, f.Path); err != nil {
+	if f.Path == "" {
 		u.Host = "irrecoverable"
-	} else {
-		q := u.Query()
-		q.Set(path, f.Path)
-		u.RawQuery = q.Encode()
-		u.Host = st.Name()
+		return u
 	}
+	q := u.Query()
+	q.Set(path, f.Path)
+	u.RawQuery = q.Encode()
+	u.Host = gopath.Base(f.Path)
 	return u
 }
 
@@ -97,7 +138,11 @@ type fsReader struct {
 	io.Seeker
 }
 
-var _ Reader = (*fsReader)(nil)
+var _ PartialReader = (*fsReader)(nil)
+
+func (f *fsReader) Capabilities() (seek, random bool) {
+	return f.Seeker != nil, f.ReaderAt != nil
+}
 
 func (f *fsReader) ReadAt(p []byte, off int64) (n int, err error) {
 	if f.ReaderAt == nil {
@@ -0,0 +1,155 @@
+package mount
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/filecoin-project/dagstore/throttle"
+
+	"github.com/filecoin-project/dagstore/testdata"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFSMountCapabilities(t *testing.T) {
+	ctx := context.Background()
+
+	// files of the embedded FS support seeking and random access.
+	mnt := &FSMount{FS: testdata.FS, Path: testdata.FSPathCarV1}
+	info := mnt.Info()
+	require.True(t, info.AccessSequential && info.AccessSeek && info.AccessRandom)
+
+	rd, err := mnt.Fetch(ctx)
+	require.NoError(t, err)
+	seek, random := rd.(PartialReader).Capabilities()
+	require.True(t, seek && random)
+	buf := make([]byte, 4)
+	_, err = rd.ReadAt(buf, 1)
+	require.NoError(t, err)
+	require.Equal(t, testdata.CarV1[1:5], buf)
+	require.NoError(t, rd.Close())
+
+	// files of the sequential FS don't.
+	mnt = &FSMount{FS: testdata.SequentialFS, Path: testdata.FSPathCarV1}
+	info = mnt.Info()
+	require.True(t, info.AccessSequential)
+	require.False(t, info.AccessSeek || info.AccessRandom)
+
+	rd, err = mnt.Fetch(ctx)
+	require.NoError(t, err)
+	seek, random = rd.(PartialReader).Capabilities()
+	require.False(t, seek || random)
+	_, err = rd.ReadAt(buf, 1)
+	require.ErrorIs(t, err, ErrRandomAccessUnsupported)
+	_, err = rd.Seek(1, 0)
+	require.ErrorIs(t, err, ErrSeekUnsupported)
+	require.NoError(t, rd.Close())
+
+	// a missing file only reports sequential access.
+	mnt = &FSMount{FS: testdata.FS, Path: "missing"}
+	info = mnt.Info()
+	require.True(t, info.AccessSequential)
+	require.False(t, info.AccessSeek || info.AccessRandom)
+}
+
+func TestFSMountCapabilitiesCached(t *testing.T) {
+	fsys := &probeFS{FS: fstest.MapFS{}}
+	mnt := &FSMount{FS: fsys, Path: "file.car"}
+
+	// a missing file is probed on every call, until it appears.
+	require.False(t, mnt.Info().AccessRandom)
+	require.False(t, mnt.Info().AccessRandom)
+	require.Equal(t, 2, fsys.count())
+
+	fsys.FS.(fstest.MapFS)["file.car"] = &fstest.MapFile{Data: testdata.CarV1}
+	require.True(t, mnt.Info().AccessRandom)
+	require.True(t, mnt.Info().AccessRandom)
+	require.Equal(t, 3, fsys.count())
+
+	// fetching learns the capabilities too.
+	mnt = &FSMount{FS: fsys, Path: "file.car"}
+	rd, err := mnt.Fetch(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	require.True(t, mnt.Info().AccessRandom)
+	require.Equal(t, 4, fsys.count())
+}
+
+func TestUpgraderDirectFetchError(t *testing.T) {
+	// the file doesn't exist when the Upgrader is created, so it's not
+	// fetched directly from the start.
+	fsys := &probeFS{FS: fstest.MapFS{}}
+	mnt := &FSMount{FS: fsys, Path: "file.car"}
+	u, err := Upgrade(mnt, throttle.Noop(), t.TempDir(), "foo", "")
+	require.NoError(t, err)
+	defer u.Close()
+
+	// the file appears, but fails to open once; the error is returned, rather
+	// than falling back to a transient copy.
+	fsys.FS.(fstest.MapFS)["file.car"] = &fstest.MapFile{Data: testdata.CarV1}
+	require.True(t, mnt.Info().AccessRandom)
+	errBoom := errors.New("boom")
+	fsys.failNext(errBoom)
+	_, err = u.Fetch(context.Background())
+	require.ErrorIs(t, err, errBoom)
+	require.Empty(t, u.TransientPath())
+
+	// the next fetch is direct.
+	rd, err := u.Fetch(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	require.Empty(t, u.TransientPath())
+}
+
+// probeFS is an fs.FS that counts the files opened, and can be made to fail
+// opening the next one.
+type probeFS struct {
+	fs.FS
+
+	lk    sync.Mutex
+	opens int
+	err   error
+}
+
+func (p *probeFS) Open(name string) (fs.File, error) {
+	p.lk.Lock()
+	p.opens++
+	err := p.err
+	p.err = nil
+	p.lk.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return p.FS.Open(name)
+}
+
+func (p *probeFS) count() int {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return p.opens
+}
+
+func (p *probeFS) failNext(err error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.err = err
+}
+
+func TestFSMountSerialize(t *testing.T) {
+	fsys := fstest.MapFS{}
+	mnt := &FSMount{FS: fsys, Path: "dir/file.car"}
+
+	// the file doesn't exist, but the mount remains recoverable.
+	u := mnt.Serialize()
+	require.Equal(t, "file.car", u.Host)
+
+	var mnt2 FSMount
+	require.NoError(t, mnt2.Deserialize(u))
+	require.Equal(t, mnt.Path, mnt2.Path)
+
+	mnt = &FSMount{FS: fsys}
+	require.Equal(t, "irrecoverable", mnt.Serialize().Host)
+}
@@ -0,0 +1,222 @@
+package mount
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+)
+
+// HTTPMount is a mount that fetches a CAR from an HTTP(S) URL. It supports
+// ranged reads if the server honours Range requests, which enables the
+// Upgrader to resume interrupted downloads, and to use a sparse cache (see
+// WithSparseCache).
+//
+// Support for ranged reads is learnt from the Accept-Ranges header of the
+// response to Stat, and assumed until the first Stat. A server that ignores a
+// Range request disables ranged reads for good.
+//
+// Registries must know about HTTPMount under the http scheme, and about
+// HTTPSMount under the https scheme; RegisterHTTP does both.
+type HTTPMount struct {
+	// URL is the URL of the CAR.
+	URL string
+
+	// Headers are added to every request, e.g. for authorization. They are
+	// not serialized, so they're normally set on the template mount
+	// registered in the Registry.
+	Headers http.Header
+
+	// Client is the HTTP client to use. If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// SecretQueryParams are the names of the query parameters of URL that
+	// carry secrets, such as access tokens. They're normally set on the
+	// template mount registered in the Registry; see SecretMount.
+	SecretQueryParams []string
+
+	// ranges records whether the server supports ranged reads; one of the
+	// rangesXXX constants, accessed atomically.
+	ranges int32
+}
+
+const (
+	rangesUnknown int32 = iota
+	rangesSupported
+	rangesUnsupported
+)
+
+// HTTPSMount is an HTTPMount for https URLs. It only exists because the
+// Registry maps every mount type to a single scheme.
+type HTTPSMount struct {
+	HTTPMount
+}
+
+var (
+	_ SecretMount  = (*HTTPMount)(nil)
+	_ Mount        = (*HTTPMount)(nil)
+	_ RangeFetcher = (*HTTPMount)(nil)
+	_ Mount        = (*HTTPSMount)(nil)
+	_ RangeFetcher = (*HTTPSMount)(nil)
+)
+
+// NewHTTPMount returns an *HTTPMount or an *HTTPSMount for the supplied URL,
+// depending on its scheme.
+func NewHTTPMount(rawurl string, headers http.Header) (Mount, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	m := HTTPMount{URL: rawurl, Headers: headers}
+	switch u.Scheme {
+	case "http":
+		return &m, nil
+	case "https":
+		return &HTTPSMount{m}, nil
+	default:
+		return nil, fmt.Errorf("unsupported scheme for HTTP mount: %s", u.Scheme)
+	}
+}
+
+// RegisterHTTP registers HTTPMount and HTTPSMount in the registry under the
+// http and https schemes respectively, using template as the template for
+// both.
+func RegisterHTTP(r *Registry, template HTTPMount) error {
+	if err := r.Register("http", &template); err != nil {
+		return err
+	}
+	return r.Register("https", &HTTPSMount{template})
+}
+
+func (h *HTTPMount) Fetch(ctx context.Context) (Reader, error) {
+	resp, err := h.do(ctx, http.MethodGet, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected HTTP status fetching %s: %s", h.URL, resp.Status)
+	}
+	return &sequentialReader{ReadCloser: resp.Body}, nil
+}
+
+// FetchRange fetches a byte range with a Range request. It fails with
+// ErrRangeUnsupported if the server doesn't honour the range.
+func (h *HTTPMount) FetchRange(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	hdr := http.Header{"Range": []string{fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	resp, err := h.do(ctx, http.MethodGet, hdr)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server ignored the Range header, and is sending everything.
+		_ = resp.Body.Close()
+		atomic.StoreInt32(&h.ranges, rangesUnsupported)
+		return nil, fmt.Errorf("%w: server ignored range request for %s", ErrRangeUnsupported, h.URL)
+	default:
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected HTTP status fetching range of %s: %s", h.URL, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (h *HTTPMount) Info() Info {
+	return Info{
+		Kind:             KindRemote,
+		AccessSequential: true,
+		AccessRanged:     atomic.LoadInt32(&h.ranges) != rangesUnsupported,
+	}
+}
+
+// Stat issues a HEAD request. A 404 or 410 response indicates that the CAR
+// doesn't exist. The Accept-Ranges header of the response determines whether
+// the mount supports ranged reads.
+func (h *HTTPMount) Stat(ctx context.Context) (Stat, error) {
+	resp, err := h.do(ctx, http.MethodHead, nil)
+	if err != nil {
+		return Stat{}, err
+	}
+	_ = resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return Stat{Exists: false}, nil
+	default:
+		return Stat{}, fmt.Errorf("unexpected HTTP status on HEAD %s: %s", h.URL, resp.Status)
+	}
+
+	ranges := rangesUnsupported
+	if resp.Header.Get("Accept-Ranges") == "bytes" {
+		ranges = rangesSupported
+	}
+	// a server that ignored a range request stays unsupported.
+	for cur := atomic.LoadInt32(&h.ranges); cur != rangesUnsupported; cur = atomic.LoadInt32(&h.ranges) {
+		if atomic.CompareAndSwapInt32(&h.ranges, cur, ranges) {
+			break
+		}
+	}
+
+	ret := Stat{
+		Exists: true,
+		Ready:  true,
+		ETag:   resp.Header.Get("ETag"),
+	}
+	if resp.ContentLength > 0 {
+		ret.Size = resp.ContentLength
+	}
+	return ret, nil
+}
+
+func (h *HTTPMount) Serialize() *url.URL {
+	u, err := url.Parse(h.URL)
+	if err != nil {
+		return &url.URL{Host: "irrecoverable"}
+	}
+	return u
+}
+
+func (h *HTTPMount) Deserialize(u *url.URL) error {
+	if u.Host == "" || u.Host == "irrecoverable" {
+		return fmt.Errorf("invalid host")
+	}
+	h.URL = u.String()
+	return nil
+}
+
+func (h *HTTPMount) SecretParams() []string {
+	return h.SecretQueryParams
+}
+
+func (h *HTTPMount) Close() error {
+	return nil
+}
+
+func (h *HTTPMount) do(ctx context.Context, method string, hdr http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, h.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	for k, vs := range h.Headers {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	for k, vs := range hdr {
+		req.Header[k] = vs
+	}
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP %s %s failed: %w", method, h.URL, err)
+	}
+	return resp, nil
+}
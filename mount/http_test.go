@@ -0,0 +1,324 @@
+package mount
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore/testdata"
+	"github.com/filecoin-project/dagstore/throttle"
+)
+
+// carServer serves testdata.CarV2 at /car, with Range and ETag support, and
+// records the requests it receives.
+type carServer struct {
+	*httptest.Server
+
+	lk   sync.Mutex
+	reqs []*http.Request
+}
+
+func newCARServer(t *testing.T) *carServer {
+	return newTaggedCARServer(t, `"v1"`)
+}
+
+// newTaggedCARServer serves testdata.CarV2 at /car, with the supplied ETag, or
+// none if empty.
+func newTaggedCARServer(t *testing.T, etag string) *carServer {
+	s := new(carServer)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lk.Lock()
+		s.reqs = append(s.reqs, r)
+		s.lk.Unlock()
+
+		if r.URL.Path != "/car" {
+			http.NotFound(w, r)
+			return
+		}
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		http.ServeContent(w, r, "car", time.Time{}, bytes.NewReader(testdata.CarV2))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *carServer) requests() []*http.Request {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return append([]*http.Request(nil), s.reqs...)
+}
+
+func TestHTTPMount(t *testing.T) {
+	ctx := context.Background()
+	srv := newCARServer(t)
+
+	mnt := &HTTPMount{URL: srv.URL + "/car", Headers: http.Header{"Authorization": []string{"Bearer foo"}}}
+
+	stat, err := mnt.Stat(ctx)
+	require.NoError(t, err)
+	require.True(t, stat.Exists)
+	require.EqualValues(t, len(testdata.CarV2), stat.Size)
+	require.Equal(t, `"v1"`, stat.ETag)
+
+	info := mnt.Info()
+	require.Equal(t, KindRemote, info.Kind)
+	require.True(t, info.AccessSequential && info.AccessRanged)
+	require.False(t, info.AccessSeek || info.AccessRandom)
+
+	// full fetch.
+	rd, err := mnt.Fetch(ctx)
+	require.NoError(t, err)
+	bz, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	require.Equal(t, testdata.CarV2, bz)
+
+	// ranged fetch.
+	rc, err := mnt.FetchRange(ctx, 100, 50)
+	require.NoError(t, err)
+	bz, err = ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, testdata.CarV2[100:150], bz)
+
+	// custom headers are sent with every request.
+	reqs := srv.requests()
+	require.Len(t, reqs, 3)
+	for _, r := range reqs {
+		require.Equal(t, "Bearer foo", r.Header.Get("Authorization"))
+	}
+	require.Equal(t, http.MethodHead, reqs[0].Method)
+	require.Equal(t, "bytes=100-149", reqs[2].Header.Get("Range"))
+
+	// missing resources.
+	mnt = &HTTPMount{URL: srv.URL + "/missing"}
+	stat, err = mnt.Stat(ctx)
+	require.NoError(t, err)
+	require.False(t, stat.Exists)
+	_, err = mnt.Fetch(ctx)
+	require.Error(t, err)
+}
+
+func TestHTTPMountRegistry(t *testing.T) {
+	r := NewRegistry()
+	err := RegisterHTTP(r, HTTPMount{Headers: http.Header{"X-Foo": []string{"bar"}}})
+	require.NoError(t, err)
+
+	for _, rawurl := range []string{"http://example.com/foo.car", "https://example.com/foo.car?bar=baz"} {
+		mnt, err := NewHTTPMount(rawurl, nil)
+		require.NoError(t, err)
+
+		u, err := r.Represent(mnt)
+		require.NoError(t, err)
+		require.Equal(t, rawurl, u.String())
+
+		mnt, err = r.Instantiate(u)
+		require.NoError(t, err)
+		var h *HTTPMount
+		switch m := mnt.(type) {
+		case *HTTPMount:
+			h = m
+		case *HTTPSMount:
+			h = &m.HTTPMount
+		default:
+			t.Fatalf("unexpected mount type %T", mnt)
+		}
+		require.Equal(t, rawurl, h.URL)
+		// the template headers are carried over.
+		require.Equal(t, "bar", h.Headers.Get("X-Foo"))
+	}
+
+	_, err = NewHTTPMount("ftp://example.com/foo.car", nil)
+	require.Error(t, err)
+}
+
+func TestUpgraderResumesHTTPDownload(t *testing.T) {
+	ctx := context.Background()
+	srv := newCARServer(t)
+	rootDir := t.TempDir()
+	mnt := &HTTPMount{URL: srv.URL + "/car"}
+
+	// simulate an interrupted download of the same version of the resource.
+	const have = 1000
+	err := ioutil.WriteFile(filepath.Join(rootDir, "transient-foo.partial"), testdata.CarV2[:have], 0644)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(rootDir, "transient-foo.partial.etag"), []byte(`"v1"`), 0644)
+	require.NoError(t, err)
+
+	u, err := Upgrade(mnt, throttle.Noop(), rootDir, "foo", "")
+	require.NoError(t, err)
+	defer u.Close()
+	require.Contains(t, u.ManagedFiles(), filepath.Join(rootDir, "transient-foo.partial"))
+
+	rd, err := u.Fetch(ctx)
+	require.NoError(t, err)
+	bz, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	require.Equal(t, testdata.CarV2, bz)
+
+	// only the remaining range was fetched.
+	var ranges []string
+	for _, r := range srv.requests() {
+		if r.Method == http.MethodGet {
+			ranges = append(ranges, r.Header.Get("Range"))
+		}
+	}
+	require.Equal(t, []string{fmt.Sprintf("bytes=%d-%d", have, len(testdata.CarV2)-1)}, ranges)
+
+	// the partial download state is cleaned up.
+	_, err = os.Stat(filepath.Join(rootDir, "transient-foo.partial.etag"))
+	require.True(t, os.IsNotExist(err))
+
+	// a partial of a different version is discarded.
+	rootDir = t.TempDir()
+	err = ioutil.WriteFile(filepath.Join(rootDir, "transient-foo.partial"), bytes.Repeat([]byte{0xff}, have), 0644)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(rootDir, "transient-foo.partial.etag"), []byte(`"v0"`), 0644)
+	require.NoError(t, err)
+
+	u, err = Upgrade(mnt, throttle.Noop(), rootDir, "foo", "")
+	require.NoError(t, err)
+	defer u.Close()
+	rd, err = u.Fetch(ctx)
+	require.NoError(t, err)
+	bz, err = ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	require.Equal(t, testdata.CarV2, bz)
+
+	// as is a partial of a resource whose version is unknown.
+	srv = newTaggedCARServer(t, "")
+	mnt = &HTTPMount{URL: srv.URL + "/car"}
+	rootDir = t.TempDir()
+	err = ioutil.WriteFile(filepath.Join(rootDir, "transient-foo.partial"), bytes.Repeat([]byte{0xff}, have), 0644)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(rootDir, "transient-foo.partial.etag"), nil, 0644)
+	require.NoError(t, err)
+
+	u, err = Upgrade(mnt, throttle.Noop(), rootDir, "foo", "")
+	require.NoError(t, err)
+	defer u.Close()
+	rd, err = u.Fetch(ctx)
+	require.NoError(t, err)
+	bz, err = ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	require.Equal(t, testdata.CarV2, bz)
+	for _, r := range srv.requests() {
+		require.Empty(t, r.Header.Get("Range"))
+	}
+}
+
+// newNoRangeServer serves testdata.CarV2 at /car, ignoring Range headers. If
+// advertise is true, it claims to accept ranges nevertheless.
+func newNoRangeServer(t *testing.T, advertise bool) *carServer {
+	s := new(carServer)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lk.Lock()
+		s.reqs = append(s.reqs, r)
+		s.lk.Unlock()
+
+		w.Header().Set("ETag", `"v1"`)
+		if advertise {
+			w.Header().Set("Accept-Ranges", "bytes")
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(testdata.CarV2)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(testdata.CarV2)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestHTTPMountRangeSupport(t *testing.T) {
+	ctx := context.Background()
+
+	// ranged reads are assumed until Stat says otherwise.
+	mnt := &HTTPMount{URL: newNoRangeServer(t, false).URL + "/car"}
+	require.True(t, mnt.Info().AccessRanged)
+	_, err := mnt.Stat(ctx)
+	require.NoError(t, err)
+	require.False(t, mnt.Info().AccessRanged)
+
+	mnt = &HTTPMount{URL: newCARServer(t).URL + "/car"}
+	_, err = mnt.Stat(ctx)
+	require.NoError(t, err)
+	require.True(t, mnt.Info().AccessRanged)
+
+	// a server that advertises ranges but ignores them is found out, for good.
+	mnt = &HTTPMount{URL: newNoRangeServer(t, true).URL + "/car"}
+	_, err = mnt.Stat(ctx)
+	require.NoError(t, err)
+	require.True(t, mnt.Info().AccessRanged)
+	_, err = mnt.FetchRange(ctx, 10, 10)
+	require.ErrorIs(t, err, ErrRangeUnsupported)
+	require.False(t, mnt.Info().AccessRanged)
+	_, err = mnt.Stat(ctx)
+	require.NoError(t, err)
+	require.False(t, mnt.Info().AccessRanged)
+}
+
+func TestUpgraderRestartsUnresumableHTTPDownload(t *testing.T) {
+	ctx := context.Background()
+	srv := newNoRangeServer(t, true)
+	rootDir := t.TempDir()
+	mnt := &HTTPMount{URL: srv.URL + "/car"}
+
+	// a partial left by an interrupted download.
+	const have = 1000
+	err := ioutil.WriteFile(filepath.Join(rootDir, "transient-foo.partial"), bytes.Repeat([]byte{0xff}, have), 0644)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(rootDir, "transient-foo.partial.etag"), []byte(`"v1"`), 0644)
+	require.NoError(t, err)
+
+	u, err := Upgrade(mnt, throttle.Noop(), rootDir, "foo", "")
+	require.NoError(t, err)
+	defer u.Close()
+
+	// the partial is dropped, and the download restarts from the beginning.
+	rd, err := u.Fetch(ctx)
+	require.NoError(t, err)
+	bz, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	require.Equal(t, testdata.CarV2, bz)
+
+	var ranges []string
+	for _, r := range srv.requests() {
+		if r.Method == http.MethodGet {
+			ranges = append(ranges, r.Header.Get("Range"))
+		}
+	}
+	require.Equal(t, []string{fmt.Sprintf("bytes=%d-%d", have, len(testdata.CarV2)-1), ""}, ranges)
+}
+
+func TestUpgraderSparseFallsBackWithoutRanges(t *testing.T) {
+	ctx := context.Background()
+	mnt := &HTTPMount{URL: newNoRangeServer(t, false).URL + "/car"}
+
+	u, err := Upgrade(mnt, throttle.Noop(), t.TempDir(), "foo", "", WithSparseCache(1024))
+	require.NoError(t, err)
+	defer u.Close()
+
+	rd, err := u.Fetch(ctx)
+	require.NoError(t, err)
+	bz, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	require.Equal(t, testdata.CarV2, bz)
+	require.NotEmpty(t, u.TransientPath())
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"net/url"
+	"time"
 )
 
 var (
@@ -15,6 +16,10 @@ var (
 	// ErrRandomAccessUnsupported is returned when ReadAt is called on a mount
 	// that does not support random access.
 	ErrRandomAccessUnsupported = errors.New("mount does not support random access")
+
+	// ErrRangeUnsupported is returned by RangeFetcher.FetchRange when the
+	// underlying resource turns out not to support ranged reads.
+	ErrRangeUnsupported = errors.New("mount does not support ranged reads")
 )
 
 // Kind is an enum describing the source of a Mount.
@@ -59,6 +64,9 @@ const (
 //  a. deserialise the Mount from DAG persistence when resuming the system by
 //     using a pre-defined Mount factory mapped to the URL scheme.
 //  b. support adding mounts from configuration files.
+//
+// Mounts whose configuration doesn't fit in a URL can also persist an opaque
+// state blob alongside it; see StatefulMount.
 type Mount interface {
 	io.Closer
 
@@ -70,7 +78,9 @@ type Mount interface {
 	// transient file, use the Upgrader.
 	Fetch(ctx context.Context) (Reader, error)
 
-	// Info describes the Mount. This is a pure function.
+	// Info describes the Mount. This is a pure function, except for mounts
+	// whose capabilities depend on the resource, which may probe it (e.g.
+	// FSMount).
 	Info() Info
 
 	// Stat describes the underlying resource.
@@ -94,6 +104,18 @@ type Reader interface {
 	io.Seeker
 }
 
+// PartialReader is implemented by Readers whose support for seeking and
+// random access depends on the resource they read, e.g. the files of an
+// fs.FS. The unsupported methods return ErrSeekUnsupported and
+// ErrRandomAccessUnsupported.
+type PartialReader interface {
+	Reader
+
+	// Capabilities returns whether the reader supports seeking and random
+	// access.
+	Capabilities() (seek, random bool)
+}
+
 // Info describes a mount.
 type Info struct {
 	// Kind indicates the kind of mount.
@@ -103,6 +125,19 @@ type Info struct {
 	AccessSequential bool
 	AccessSeek       bool
 	AccessRandom     bool
+	// AccessRanged indicates that the mount can serve byte ranges of the
+	// resource without fetching it in full. Such mounts implement
+	// RangeFetcher.
+	AccessRanged bool
+}
+
+// RangeFetcher is implemented by mounts that can serve byte ranges of the
+// underlying resource, e.g. HTTP servers supporting Range requests.
+type RangeFetcher interface {
+	// FetchRange returns a reader over length bytes of the resource, starting
+	// at offset. The reader may return fewer bytes if the range extends past
+	// the end of the resource.
+	FetchRange(ctx context.Context, offset, length int64) (io.ReadCloser, error)
 }
 
 // Stat
@@ -114,6 +149,12 @@ type Stat struct {
 	// Ready indicates whether the mount can serve the resource immediately, or
 	// if it needs to do work prior to serving it.
 	Ready bool
+	// ETag is an opaque identifier of the version of the asset, if the mount
+	// supports it (e.g. an HTTP ETag).
+	ETag string
+	// ModTime is the last modification time of the asset, if the mount
+	// supports it.
+	ModTime time.Time
 }
 
 type NopCloser struct {
@@ -125,3 +166,19 @@ type NopCloser struct {
 func (*NopCloser) Close() error {
 	return nil
 }
+
+// sequentialReader is a Reader over an io.ReadCloser that only supports
+// sequential access.
+type sequentialReader struct {
+	io.ReadCloser
+}
+
+var _ Reader = (*sequentialReader)(nil)
+
+func (*sequentialReader) ReadAt(_ []byte, _ int64) (int, error) {
+	return 0, ErrRandomAccessUnsupported
+}
+
+func (*sequentialReader) Seek(_ int64, _ int) (int64, error) {
+	return 0, ErrSeekUnsupported
+}
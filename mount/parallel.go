@@ -0,0 +1,117 @@
+package mount
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// parallelReader reads a byte range of a RangeFetcher sequentially, while
+// fetching up to concurrency parts of partSize bytes ahead of the reader in
+// parallel. At most concurrency parts are held in memory at any time.
+type parallelReader struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	parts chan *rangePart
+	sem   chan struct{}
+	abort error // set by the producer before closing parts.
+
+	cur *rangePart
+	off int // offset within cur.buf.
+	err error
+}
+
+type rangePart struct {
+	buf  []byte
+	err  error
+	done chan struct{}
+}
+
+var _ io.ReadCloser = (*parallelReader)(nil)
+
+func newParallelReader(ctx context.Context, rf RangeFetcher, offset, length, partSize int64, concurrency int) *parallelReader {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &parallelReader{
+		ctx:    ctx,
+		cancel: cancel,
+		parts:  make(chan *rangePart, concurrency),
+		sem:    make(chan struct{}, concurrency),
+	}
+	go r.produce(rf, offset, length, partSize)
+	return r
+}
+
+// produce starts fetching parts in order, as capacity frees up.
+func (r *parallelReader) produce(rf RangeFetcher, offset, length, partSize int64) {
+	defer close(r.parts)
+
+	for off, end := offset, offset+length; off < end; off += partSize {
+		select {
+		case r.sem <- struct{}{}:
+		case <-r.ctx.Done():
+			r.abort = r.ctx.Err()
+			return
+		}
+
+		p := &rangePart{done: make(chan struct{})}
+		go func(off, n int64) {
+			defer close(p.done)
+			p.buf, p.err = fetchPart(r.ctx, rf, off, n)
+		}(off, min64(partSize, end-off))
+
+		// never blocks, as parts has the same capacity as sem.
+		r.parts <- p
+	}
+}
+
+func (r *parallelReader) Read(p []byte) (int, error) {
+	for r.err == nil {
+		if r.cur != nil && r.off < len(r.cur.buf) {
+			n := copy(p, r.cur.buf[r.off:])
+			r.off += n
+			return n, nil
+		}
+		if r.cur != nil {
+			// release the finished part.
+			r.cur = nil
+			<-r.sem
+		}
+
+		next, ok := <-r.parts
+		if !ok {
+			if r.err = r.abort; r.err == nil {
+				r.err = io.EOF
+			}
+			break
+		}
+		<-next.done
+		if next.err != nil {
+			r.err = next.err
+			break
+		}
+		r.cur, r.off = next, 0
+	}
+	return 0, r.err
+}
+
+// Close aborts all outstanding fetches.
+func (r *parallelReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+// fetchPart fetches n bytes at off into memory.
+func fetchPart(ctx context.Context, rf RangeFetcher, off, n int64) ([]byte, error) {
+	rc, err := rf.FetchRange(ctx, off, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rc, buf); err != nil {
+		return nil, fmt.Errorf("failed to read range [%d, %d): %w", off, off+n, err)
+	}
+	return buf, nil
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net/url"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 )
 
@@ -18,88 +20,375 @@ var (
 	ErrUnrecognizedType = errors.New("unrecognized mount type")
 )
 
+// Factory creates a Mount from its URL representation.
+//
+// When registered through RegisterFactory, the factory is first invoked with
+// a nil URL, and must return a blank instance, which determines the type of
+// the mounts it creates (see Registry.Represent). Otherwise, it must return a
+// mount deserialized from the URL, which can share environmental
+// configuration, such as clients, with all other instances.
+type Factory func(u *url.URL) (Mount, error)
+
 // Registry is a registry of Mount factories known to the DAG store.
 type Registry struct {
 	lk       sync.RWMutex
-	byScheme map[string]Mount
+	byScheme map[string]registration
 	byType   map[reflect.Type]string
+	aliases  map[string]string // alias => scheme.
+	secrets  SecretProvider    // may be nil; see SetSecretProvider.
+}
+
+// registration is the factory of a scheme, the type of mounts it creates,
+// and their secret URL parameters.
+type registration struct {
+	factory Factory
+	typ     reflect.Type
+	secrets []string
 }
 
 // NewRegistry constructs a blank registry.
 func NewRegistry() *Registry {
-	return &Registry{byScheme: map[string]Mount{}, byType: map[reflect.Type]string{}}
+	return &Registry{
+		byScheme: map[string]registration{},
+		byType:   map[reflect.Type]string{},
+		aliases:  map[string]string{},
+	}
 }
 
 // Register adds a new mount type to the registry under the specified scheme.
 //
-// The supplied Mount is used as a template to create new instances.
+// The supplied Mount is used as a template to create new instances: it must
+// be a pointer to a struct, whose exported fields are copied into every new
+// instance before it's deserialized.
 //
 // This means that the provided Mount can contain environmental configuration
-// that will be automatically carried over to all instances.
+// that will be automatically carried over to all instances. Mounts holding
+// unexported configuration should be registered through RegisterFactory
+// instead.
 func (r *Registry) Register(scheme string, template Mount) error {
+	if v := reflect.ValueOf(template); v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("mount template must be a non-nil pointer to a struct; got %T", template)
+	}
+	factory := func(u *url.URL) (Mount, error) {
+		instance := clone(template)
+		if u == nil {
+			return instance, nil
+		}
+		return instance, instance.Deserialize(u)
+	}
+	return r.register(scheme, template, factory)
+}
+
+// RegisterFactory adds a new mount type to the registry under the specified
+// scheme, whose instances are created by the supplied factory. See Factory
+// for the contract the factory must honour.
+func (r *Registry) RegisterFactory(scheme string, factory Factory) error {
+	blank, err := factory(nil)
+	if err != nil {
+		return fmt.Errorf("mount factory for scheme %s failed to create blank instance: %w", scheme, err)
+	} else if blank == nil {
+		return fmt.Errorf("mount factory for scheme %s returned nil blank instance", scheme)
+	}
+	return r.register(scheme, blank, factory)
+}
+
+// register registers the factory under the scheme, for mounts of the same
+// type as the supplied instance.
+func (r *Registry) register(scheme string, instance Mount, factory Factory) error {
+	typ := reflect.TypeOf(instance)
+	var secrets []string
+	if sm, ok := instance.(SecretMount); ok {
+		secrets = sm.SecretParams()
+	}
+
 	r.lk.Lock()
 	defer r.lk.Unlock()
 
+	if scheme == "" {
+		return fmt.Errorf("mount scheme must not be empty")
+	}
 	if _, ok := r.byScheme[scheme]; ok {
 		return fmt.Errorf("mount already registered for scheme: %s", scheme)
 	}
+	if _, ok := r.aliases[scheme]; ok {
+		return fmt.Errorf("scheme already registered as an alias: %s", scheme)
+	}
+	if _, ok := r.byType[typ]; ok {
+		return fmt.Errorf("mount already registered for type: %s", typ)
+	}
+
+	r.byScheme[scheme] = registration{factory: factory, typ: typ, secrets: secrets}
+	r.byType[typ] = scheme
+	return nil
+}
+
+// RegisterAlias registers alias as an alternative scheme for the mounts
+// registered under scheme, e.g. to keep instantiating mounts persisted under
+// the former scheme of a renamed mount type. Mounts are always represented
+// with their registered scheme, never with an alias.
+func (r *Registry) RegisterAlias(alias, scheme string) error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
 
-	if _, ok := r.byType[reflect.TypeOf(template)]; ok {
-		return fmt.Errorf("mount already registered for type: %T", template)
+	if alias == "" {
+		return fmt.Errorf("mount scheme alias must not be empty")
 	}
+	if _, ok := r.byScheme[scheme]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnrecognizedScheme, scheme)
+	}
+	if _, ok := r.byScheme[alias]; ok {
+		return fmt.Errorf("mount already registered for scheme: %s", alias)
+	}
+	if _, ok := r.aliases[alias]; ok {
+		return fmt.Errorf("alias already registered: %s", alias)
+	}
+	r.aliases[alias] = scheme
+	return nil
+}
+
+// Unregister removes a scheme from the registry, along with all its aliases,
+// or removes an alias. Mounts instantiated previously are unaffected, but
+// can no longer be represented once their scheme is unregistered.
+func (r *Registry) Unregister(scheme string) error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
 
-	r.byScheme[scheme] = template
-	r.byType[reflect.TypeOf(template)] = scheme
+	if _, ok := r.aliases[scheme]; ok {
+		delete(r.aliases, scheme)
+		return nil
+	}
+	reg, ok := r.byScheme[scheme]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnrecognizedScheme, scheme)
+	}
+	delete(r.byScheme, scheme)
+	delete(r.byType, reg.typ)
+	for alias, target := range r.aliases {
+		if target == scheme {
+			delete(r.aliases, alias)
+		}
+	}
 	return nil
 }
 
+// Schemes returns the registered schemes, excluding aliases, in lexicographic
+// order.
+func (r *Registry) Schemes() []string {
+	r.lk.RLock()
+	defer r.lk.RUnlock()
+
+	ret := make([]string, 0, len(r.byScheme))
+	for scheme := range r.byScheme {
+		ret = append(ret, scheme)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Aliases returns the registered aliases, mapped to their schemes.
+func (r *Registry) Aliases() map[string]string {
+	r.lk.RLock()
+	defer r.lk.RUnlock()
+
+	ret := make(map[string]string, len(r.aliases))
+	for alias, scheme := range r.aliases {
+		ret[alias] = scheme
+	}
+	return ret
+}
+
 // Instantiate instantiates a new Mount from a URL.
 //
-// It looks up the Mount template in the registry based on the URL scheme,
-// creates a copy, and calls Deserialize() on it with the supplied URL before
-// returning.
+// It looks up the Mount factory in the registry based on the URL scheme,
+// resolving aliases, and invokes it with the supplied URL, once references
+// in secret parameters are resolved (see SecretMount).
+//
+// It propagates any error returned by the factory, e.g. by the
+// Mount#Deserialize method. If the scheme is not recognized, it returns
+// ErrUnrecognizedScheme.
 //
-// It propagates any error returned by the Mount#Deserialize method.
-// If the scheme is not recognized, it returns ErrUnrecognizedScheme.
+// The state of StatefulMounts is restored from the StateQueryParam parameter,
+// if present.
 func (r *Registry) Instantiate(u *url.URL) (Mount, error) {
-	r.lk.RLock()
-	defer r.lk.RUnlock()
+	u, state, err := extractState(u)
+	if err != nil {
+		return nil, err
+	}
+	return r.InstantiateWithState(u, state)
+}
 
-	template, ok := r.byScheme[u.Scheme]
+// InstantiateWithState is like Instantiate, but it restores the supplied
+// state, if not nil, into the instantiated mount, which must then be a
+// StatefulMount.
+func (r *Registry) InstantiateWithState(u *url.URL, state []byte) (Mount, error) {
+	m, err := r.instantiate(u)
+	if err != nil || state == nil {
+		return m, err
+	}
+	sm, ok := m.(StatefulMount)
+	if !ok {
+		return nil, fmt.Errorf("failed to restore state of mount with type %T: mount is not stateful", m)
+	}
+	if err := sm.UnmarshalState(state); err != nil {
+		return nil, fmt.Errorf("failed to restore state of mount with type %T: %w", m, err)
+	}
+	return m, nil
+}
+
+func (r *Registry) instantiate(u *url.URL) (Mount, error) {
+	// don't hold the lock while deserializing, as mounts wrapping other
+	// mounts (e.g. SectionMount) call back into the registry.
+	r.lk.RLock()
+	scheme := u.Scheme
+	if target, ok := r.aliases[scheme]; ok {
+		scheme = target
+	}
+	reg, ok := r.byScheme[scheme]
+	r.lk.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("%w: %s", ErrUnrecognizedScheme, u.Scheme)
 	}
 
-	instance := clone(template)
-	if err := instance.Deserialize(u); err != nil {
-		return nil, fmt.Errorf("failed to instantiate mount with url %s into type %T: %w", u.String(), template, err)
+	resolved, err := r.resolve(u, reg.secrets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate mount with url %s into type %s: %w", r.Redact(u), reg.typ, err)
+	}
+	instance, err := reg.factory(resolved)
+	if err != nil {
+		err = RedactError(err, r.secretValues(resolved, reg.secrets)...)
+		return nil, fmt.Errorf("failed to instantiate mount with url %s into type %s: %w", r.Redact(u), reg.typ, err)
+	} else if instance == nil {
+		return nil, fmt.Errorf("failed to instantiate mount with url %s into type %s: factory returned nil", r.Redact(u), reg.typ)
 	}
 	return instance, nil
 }
 
 // Represent returns the URL representation of a Mount, using the scheme that
 // was registered for that type of mount.
+//
+// The values of secret parameters are replaced with references obtained from
+// the SecretProvider (see SecretMount). If the mount URL carries secrets and
+// no SecretProvider is set, it returns ErrSecretsUnprotected.
+//
+// The state of StatefulMounts is carried in the StateQueryParam parameter.
 func (r *Registry) Represent(mount Mount) (*url.URL, error) {
-	r.lk.RLock()
-	defer r.lk.RUnlock()
+	u, state, err := r.RepresentWithState(mount)
+	if err != nil || state == nil {
+		return u, err
+	}
+	return embedState(u, state), nil
+}
 
+// RepresentWithState is like Represent, but it returns the state of
+// StatefulMounts separately from the URL. The state is nil for other mounts.
+func (r *Registry) RepresentWithState(mount Mount) (*url.URL, []byte, error) {
 	// special-case the upgrader, as it's transparent.
 	if up, ok := mount.(*Upgrader); ok {
 		mount = up.underlying
 	}
 
-	scheme, ok := r.byType[reflect.TypeOf(mount)]
+	// don't hold the lock while serializing, as mounts wrapping other mounts
+	// (e.g. SectionMount) call back into the registry.
+	scheme, params, ok := r.lookupType(mount)
 	if !ok {
-		return nil, fmt.Errorf("failed to represent mount with type %T: %w", mount, ErrUnrecognizedType)
+		return nil, nil, fmt.Errorf("failed to represent mount with type %T: %w", mount, ErrUnrecognizedType)
 	}
 
-	u := mount.Serialize()
+	var u *url.URL
+	if fm, ok := mount.(fallibleMount); ok {
+		var err error
+		if u, err = fm.serialize(); err != nil {
+			return nil, nil, fmt.Errorf("failed to represent mount with type %T: %w", mount, err)
+		}
+	} else {
+		u = mount.Serialize()
+	}
 	u.Scheme = scheme
-	return u, nil
+	u, err := r.protect(u, params)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to represent mount with type %T: %w", mount, err)
+	}
+	state, err := mountState(mount)
+	if err != nil {
+		return nil, nil, err
+	}
+	return u, state, nil
+}
+
+// fallibleMount is implemented by mounts that can't always be serialized,
+// such as those wrapping other mounts. Their Serialize returns an
+// irrecoverable URL when serialize fails, so the registry calls serialize
+// instead to surface the error.
+type fallibleMount interface {
+	serialize() (*url.URL, error)
+}
+
+// lookupType returns the scheme registered for the type of the mount, and its
+// secret parameters, including those declared by the mount itself.
+func (r *Registry) lookupType(mount Mount) (scheme string, params []string, ok bool) {
+	r.lk.RLock()
+	scheme, ok = r.byType[reflect.TypeOf(mount)]
+	params = r.byScheme[scheme].secrets
+	r.lk.RUnlock()
+
+	if sm, ok := mount.(SecretMount); ok {
+		params = append(params[:len(params):len(params)], sm.SecretParams()...)
+	}
+	return scheme, params, ok
+}
+
+// ParseURL parses the URL representation of a mount, as returned by
+// Represent. It also accepts representations persisted by former versions of
+// mounts that carried arbitrary strings in the host component, such as file
+// paths, which url.Parse rejects when escaped (e.g. file://%2Ftmp%2Ffile.car).
+// These are parsed into URLs with the unescaped string as the host.
+func ParseURL(rawurl string) (*url.URL, error) {
+	u, err := url.Parse(rawurl)
+	if err == nil {
+		return u, nil
+	}
+	return parseLegacyURL(rawurl, err)
+}
+
+// IsLegacyURL returns whether rawurl is a legacy mount representation, i.e.
+// one that url.Parse rejects, but ParseURL accepts.
+func IsLegacyURL(rawurl string) bool {
+	_, err := url.Parse(rawurl)
+	if err == nil {
+		return false
+	}
+	_, err = parseLegacyURL(rawurl, err)
+	return err == nil
+}
+
+// parseLegacyURL parses a legacy mount representation, returning err, the
+// error url.Parse failed with, if rawurl isn't one.
+func parseLegacyURL(rawurl string, err error) (*url.URL, error) {
+	i := strings.Index(rawurl, "://")
+	if i < 0 {
+		return nil, err
+	}
+	scheme, host, rest := rawurl[:i], rawurl[i+3:], ""
+	if j := strings.IndexAny(host, "?#"); j >= 0 {
+		host, rest = host[:j], host[j:]
+	}
+	if strings.Contains(host, "/") {
+		return nil, err // escaped hosts never contain slashes.
+	}
+	unescaped, uerr := url.PathUnescape(host)
+	if uerr != nil {
+		return nil, err
+	}
+	legacy, lerr := url.Parse(scheme + "://" + rest)
+	if lerr != nil {
+		return nil, err
+	}
+	legacy.Host = unescaped
+	return legacy, nil
 }
 
 // clone clones m1 into m2, casting it back to a Mount. It is only able to deal
-// with pointer types that implement Mount.
+// with pointer types that implement Mount, and only copies exported fields.
 func clone(m1 Mount) (m2 Mount) {
 	m2obj := reflect.New(reflect.TypeOf(m1).Elem())
 	m1val := reflect.ValueOf(m1).Elem()
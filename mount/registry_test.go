@@ -158,6 +158,119 @@ func TestRegistryRecognizedType(t *testing.T) {
 	require.Equal(t, "mount2", u.Scheme)
 }
 
+func TestRegistryFactory(t *testing.T) {
+	r := NewRegistry()
+
+	// the factory can carry unexported configuration.
+	type shared struct{ name string }
+	client := &shared{name: "client"}
+	var calls int
+	factory := func(u *url.URL) (Mount, error) {
+		calls++
+		m := &factoryMount{client: client}
+		if u == nil {
+			return m, nil
+		}
+		return m, m.Deserialize(u)
+	}
+	require.NoError(t, r.RegisterFactory("fac", factory))
+	require.Equal(t, 1, calls) // the blank instance.
+
+	// same type or scheme again -> fails.
+	require.Error(t, r.RegisterFactory("fac2", factory))
+	require.Error(t, r.Register("fac", new(MockMount)))
+
+	// factories that can't create a blank instance are rejected.
+	require.Error(t, r.RegisterFactory("broken", func(u *url.URL) (Mount, error) {
+		return nil, fmt.Errorf("boom")
+	}))
+	require.Error(t, r.RegisterFactory("nil", func(u *url.URL) (Mount, error) {
+		return nil, nil
+	}))
+
+	m, err := r.Instantiate(&url.URL{Scheme: "fac", Host: "foo"})
+	require.NoError(t, err)
+	require.Same(t, client, m.(*factoryMount).client.(*shared))
+	require.Equal(t, "foo", m.(*factoryMount).val)
+
+	u, err := r.Represent(m)
+	require.NoError(t, err)
+	require.Equal(t, "fac", u.Scheme)
+
+	// factory errors are propagated.
+	_, err = r.Instantiate(&url.URL{Scheme: "fac"})
+	require.Error(t, err)
+}
+
+func TestRegistryTemplateValidation(t *testing.T) {
+	r := NewRegistry()
+	require.Error(t, r.Register("nil", (*MockMount)(nil)))
+	require.Error(t, r.Register("value", valueMount{}))
+	require.Error(t, r.Register("", new(MockMount)))
+}
+
+func TestRegistryAliases(t *testing.T) {
+	r := NewRegistry()
+	require.NoError(t, r.Register("new", &MockMount{Templated: "template"}))
+	require.NoError(t, r.Register("other", new(factoryMount)))
+
+	require.NoError(t, r.RegisterAlias("old", "new"))
+	require.Error(t, r.RegisterAlias("old", "new"))       // duplicate alias.
+	require.Error(t, r.RegisterAlias("other", "new"))     // registered scheme.
+	require.Error(t, r.RegisterAlias("older", "unknown")) // unknown scheme.
+	require.Error(t, r.Register("old", new(MockMount)))   // registered alias.
+	require.Equal(t, map[string]string{"old": "new"}, r.Aliases())
+	require.Equal(t, []string{"new", "other"}, r.Schemes())
+
+	// instantiating through the alias works, but mounts are represented with
+	// their registered scheme.
+	u, err := url.Parse("old://bang?size=100&timestwo=false")
+	require.NoError(t, err)
+	m, err := r.Instantiate(u)
+	require.NoError(t, err)
+	require.Equal(t, "template", m.(*MockMount).Templated)
+	u, err = r.Represent(m)
+	require.NoError(t, err)
+	require.Equal(t, "new", u.Scheme)
+
+	// unregistering an alias.
+	require.NoError(t, r.Unregister("old"))
+	_, err = r.Instantiate(&url.URL{Scheme: "old"})
+	require.ErrorIs(t, err, ErrUnrecognizedScheme)
+
+	// unregistering a scheme removes its aliases and type.
+	require.NoError(t, r.RegisterAlias("old", "new"))
+	require.NoError(t, r.Unregister("new"))
+	require.Empty(t, r.Aliases())
+	require.Equal(t, []string{"other"}, r.Schemes())
+	_, err = r.Represent(m)
+	require.ErrorIs(t, err, ErrUnrecognizedType)
+	require.ErrorIs(t, r.Unregister("new"), ErrUnrecognizedScheme)
+
+	// the scheme can be registered again.
+	require.NoError(t, r.Register("new", new(MockMount)))
+}
+
+// factoryMount is a mount with unexported configuration.
+type factoryMount struct {
+	MockMount
+	client interface{}
+	val    string
+}
+
+func (f *factoryMount) Deserialize(u *url.URL) error {
+	if u.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+	f.val = u.Host
+	return nil
+}
+
+// valueMount is a mount implemented by a value type.
+type valueMount struct {
+	*MockMount
+}
+
 func fetchAndReadAll(t *testing.T, m Mount) string {
 	rd, err := m.Fetch(context.Background())
 	require.NoError(t, err)
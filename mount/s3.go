@@ -0,0 +1,334 @@
+package mount
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultS3PartSize is the size of the parts an S3Mount downloads in
+	// parallel, if S3Mount.PartSize is unset.
+	DefaultS3PartSize = 8 << 20 // 8MiB
+
+	// DefaultS3Concurrency is the number of parts an S3Mount downloads in
+	// parallel, if S3Mount.Concurrency is unset.
+	DefaultS3Concurrency = 4
+
+	// emptySHA256 is the hex-encoded SHA-256 of an empty payload.
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Mount is a mount that fetches a CAR stored as an object in an
+// S3-compatible object store. Requests are signed with AWS Signature Version 4
+// if credentials are set; otherwise they are anonymous.
+//
+// Objects larger than PartSize are downloaded with up to Concurrency parallel
+// ranged requests, both when fetched in full and when fetching byte ranges.
+//
+// Its URL representation is s3://<bucket>/<key>?region=<region>&endpoint=<endpoint>.
+// Credentials are never serialized; they are expected to be set on the
+// template mount registered in the Registry, e.g.:
+//
+//	r.Register("s3", &mount.S3Mount{AccessKeyID: id, SecretAccessKey: secret})
+type S3Mount struct {
+	Bucket string
+	Key    string
+
+	// Region is the region of the bucket. If empty, us-east-1 is assumed.
+	Region string
+
+	// Endpoint is the base URL of an S3-compatible service, e.g.
+	// http://localhost:9000. If set, objects are addressed in path style
+	// (<endpoint>/<bucket>/<key>). If empty, the AWS virtual-hosted style
+	// endpoint for the region is used.
+	Endpoint string
+
+	// Credentials. These are not serialized.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// PartSize and Concurrency control parallel downloads. Zero values select
+	// DefaultS3PartSize and DefaultS3Concurrency.
+	PartSize    int64
+	Concurrency int
+
+	// Client is the HTTP client to use. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+var (
+	_ Mount        = (*S3Mount)(nil)
+	_ RangeFetcher = (*S3Mount)(nil)
+)
+
+// Fetch downloads the object, in parallel parts if it's larger than PartSize.
+func (s *S3Mount) Fetch(ctx context.Context) (Reader, error) {
+	stat, err := s.Stat(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.Exists {
+		return nil, fmt.Errorf("s3 object %s/%s does not exist", s.Bucket, s.Key)
+	}
+	if stat.Size == 0 {
+		return &sequentialReader{ReadCloser: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}
+	rc, err := s.FetchRange(ctx, 0, stat.Size)
+	if err != nil {
+		return nil, err
+	}
+	return &sequentialReader{ReadCloser: rc}, nil
+}
+
+// FetchRange fetches a byte range of the object, in parallel parts if it's
+// larger than PartSize.
+func (s *S3Mount) FetchRange(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	partSize, concurrency := s.partSize(), s.concurrency()
+	if length > partSize && concurrency > 1 {
+		return newParallelReader(ctx, rangeFetcherFunc(s.getRange), offset, length, partSize, concurrency), nil
+	}
+	return s.getRange(ctx, offset, length)
+}
+
+func (s *S3Mount) Info() Info {
+	return Info{
+		Kind:             KindRemote,
+		AccessSequential: true,
+		AccessRanged:     true,
+	}
+}
+
+// Stat issues a HEAD request on the object.
+func (s *S3Mount) Stat(ctx context.Context) (Stat, error) {
+	resp, err := s.do(ctx, http.MethodHead, nil)
+	if err != nil {
+		return Stat{}, err
+	}
+	_ = resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return Stat{Exists: false}, nil
+	default:
+		return Stat{}, fmt.Errorf("unexpected status on HEAD of s3 object %s/%s: %s", s.Bucket, s.Key, resp.Status)
+	}
+
+	ret := Stat{
+		Exists: true,
+		Ready:  true,
+		ETag:   resp.Header.Get("ETag"),
+	}
+	if resp.ContentLength > 0 {
+		ret.Size = resp.ContentLength
+	}
+	return ret, nil
+}
+
+func (s *S3Mount) Serialize() *url.URL {
+	q := url.Values{}
+	if s.Region != "" {
+		q.Set("region", s.Region)
+	}
+	if s.Endpoint != "" {
+		q.Set("endpoint", s.Endpoint)
+	}
+	return &url.URL{
+		Host:     s.Bucket,
+		Path:     "/" + s.Key,
+		RawQuery: q.Encode(),
+	}
+}
+
+// Deserialize sets the bucket, key, region and endpoint from the URL. The
+// region and endpoint of the template are kept if the URL doesn't specify
+// them.
+func (s *S3Mount) Deserialize(u *url.URL) error {
+	if u.Host == "" {
+		return fmt.Errorf("missing bucket")
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if key == "" {
+		return fmt.Errorf("missing key")
+	}
+	s.Bucket, s.Key = u.Host, key
+
+	q := u.Query()
+	if v := q.Get("region"); v != "" {
+		s.Region = v
+	}
+	if v := q.Get("endpoint"); v != "" {
+		if _, err := url.Parse(v); err != nil {
+			return fmt.Errorf("invalid endpoint: %w", err)
+		}
+		s.Endpoint = v
+	}
+	return nil
+}
+
+func (s *S3Mount) Close() error {
+	return nil
+}
+
+// getRange fetches a byte range of the object with a single request.
+func (s *S3Mount) getRange(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	hdr := http.Header{"Range": []string{fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	resp, err := s.do(ctx, http.MethodGet, hdr)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status fetching range of s3 object %s/%s: %s", s.Bucket, s.Key, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Mount) partSize() int64 {
+	if s.PartSize > 0 {
+		return s.PartSize
+	}
+	return DefaultS3PartSize
+}
+
+func (s *S3Mount) concurrency() int {
+	if s.Concurrency > 0 {
+		return s.Concurrency
+	}
+	return DefaultS3Concurrency
+}
+
+func (s *S3Mount) region() string {
+	if s.Region != "" {
+		return s.Region
+	}
+	return "us-east-1"
+}
+
+// objectURL returns the URL of the object.
+func (s *S3Mount) objectURL() string {
+	path := "/" + s3Escape(s.Key)
+	if s.Endpoint != "" {
+		return strings.TrimSuffix(s.Endpoint, "/") + "/" + s3Escape(s.Bucket) + path
+	}
+	return "https://" + s.Bucket + ".s3." + s.region() + ".amazonaws.com" + path
+}
+
+func (s *S3Mount) do(ctx context.Context, method string, hdr http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 request: %w", err)
+	}
+	for k, vs := range hdr {
+		req.Header[k] = vs
+	}
+	if s.AccessKeyID != "" {
+		s.sign(req, time.Now())
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 %s %s/%s failed: %w", method, s.Bucket, s.Key, err)
+	}
+	return resp, nil
+}
+
+// sign signs a bodiless request with AWS Signature Version 4, signing the
+// Host and Range headers, and all X-Amz-* headers.
+func (s *S3Mount) sign(req *http.Request, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	// canonical headers, sorted by lowercase name.
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "range" || strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(vs, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonReq := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonHeaders.String(),
+		signedHeaders,
+		emptySHA256,
+	}, "\n")
+
+	scope := date + "/" + s.region() + "/s3/aws4_request"
+	reqHash := sha256.Sum256([]byte(canonReq))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(reqHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), date)
+	key = hmacSHA256(key, s.region())
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, scope, signedHeaders, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes an object key for use in a URL path, as required by
+// Signature Version 4: all bytes except unreserved characters and slashes are
+// percent-encoded.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// rangeFetcherFunc adapts a function to the RangeFetcher interface.
+type rangeFetcherFunc func(ctx context.Context, offset, length int64) (io.ReadCloser, error)
+
+func (f rangeFetcherFunc) FetchRange(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	return f(ctx, offset, length)
+}
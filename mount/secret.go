@@ -0,0 +1,299 @@
+package mount
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// SecretRefPrefix prefixes the values of secret URL parameters that hold a
+// reference to a secret, rather than the secret itself.
+const SecretRefPrefix = "secret:"
+
+// redacted replaces secrets in redacted URLs and errors.
+const redacted = "REDACTED"
+
+var (
+	// ErrSecretsUnprotected is returned by Represent when a mount URL carries
+	// secrets, but no SecretProvider is available to keep them out of the
+	// representation.
+	ErrSecretsUnprotected = errors.New("mount URL carries secrets, but no secret provider is configured")
+
+	// ErrUnknownSecret is returned by SecretProviders for unknown secrets and
+	// references.
+	ErrUnknownSecret = errors.New("unknown secret")
+)
+
+// SecretMount is implemented by mounts whose URL representation carries
+// secrets, such as access tokens, in query parameters.
+//
+// The Registry replaces the values of these parameters with references
+// obtained from its SecretProvider when representing mounts, and resolves
+// them when instantiating mounts, so that secrets are never persisted. It
+// also redacts them from errors reported by the DAG store.
+//
+// The secret parameters of a mount type are determined upon registration,
+// from the template, or from the blank instance returned by the factory.
+type SecretMount interface {
+	Mount
+
+	// SecretParams returns the names of the URL query parameters that carry
+	// secrets.
+	SecretParams() []string
+}
+
+// SecretProvider stores or looks up secrets on behalf of the Registry, and
+// hands out references to them, which are persisted in their place.
+type SecretProvider interface {
+	// Reference returns a reference to the supplied secret.
+	Reference(secret string) (ref string, err error)
+
+	// Resolve returns the secret a reference refers to.
+	Resolve(ref string) (secret string, err error)
+}
+
+// StaticSecrets is a SecretProvider over a fixed set of named secrets, whose
+// references are their names. It's typically populated from the environment
+// or from a configuration file on start.
+type StaticSecrets map[string]string
+
+var _ SecretProvider = StaticSecrets(nil)
+
+func (s StaticSecrets) Reference(secret string) (string, error) {
+	for name, v := range s {
+		if v == secret {
+			return name, nil
+		}
+	}
+	return "", ErrUnknownSecret
+}
+
+func (s StaticSecrets) Resolve(ref string) (string, error) {
+	v, ok := s[ref]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownSecret, ref)
+	}
+	return v, nil
+}
+
+// SetSecretProvider sets the provider used to protect and resolve the secret
+// URL parameters of mounts. See SecretMount.
+func (r *Registry) SetSecretProvider(p SecretProvider) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	r.secrets = p
+}
+
+// Secrets returns the secrets carried by the URL representation of a mount,
+// including those in the URLs of the registered mounts it wraps, unless they
+// were already replaced by references.
+func (r *Registry) Secrets(mount Mount) []string {
+	// special-case the upgrader, as it's transparent.
+	if up, ok := mount.(*Upgrader); ok {
+		mount = up.underlying
+	}
+	_, params, _ := r.lookupType(mount)
+	return r.secretValues(mount.Serialize(), params)
+}
+
+// secretValues returns the values of the secret parameters of u, and of the
+// URLs of the registered mounts it wraps, excluding references.
+func (r *Registry) secretValues(u *url.URL, params []string) []string {
+	var ret []string
+	r.rewriteSecrets(u, params, 0, func(v string) string {
+		if v != "" && !strings.HasPrefix(v, SecretRefPrefix) {
+			ret = append(ret, v)
+		}
+		return v
+	})
+	return ret
+}
+
+// Redact returns a copy of the supplied mount URL, with the values of all
+// secret parameters replaced, including those of the URLs of wrapped mounts.
+func (r *Registry) Redact(u *url.URL) *url.URL {
+	params, _ := r.secretParams(u.Scheme)
+	return r.rewriteSecrets(u, params, 0, func(string) string {
+		return redacted
+	})
+}
+
+// protect replaces the values of the secret parameters of u, and of the URLs
+// of wrapped mounts, with references.
+func (r *Registry) protect(u *url.URL, params []string) (*url.URL, error) {
+	r.lk.RLock()
+	p := r.secrets
+	r.lk.RUnlock()
+
+	var err error
+	ret := r.rewriteSecrets(u, params, 0, func(v string) string {
+		if err != nil || strings.HasPrefix(v, SecretRefPrefix) {
+			return v // already a reference.
+		}
+		if p == nil {
+			err = ErrSecretsUnprotected
+			return v
+		}
+		ref, rerr := p.Reference(v)
+		if rerr != nil {
+			err = fmt.Errorf("failed to obtain secret reference: %w", rerr)
+			return v
+		}
+		return SecretRefPrefix + ref
+	})
+	return ret, err
+}
+
+// resolve replaces the references in the secret parameters of u with the
+// secrets they refer to. Unlike protect, it doesn't descend into the URLs of
+// wrapped mounts, as those are resolved when they're instantiated.
+func (r *Registry) resolve(u *url.URL, params []string) (*url.URL, error) {
+	r.lk.RLock()
+	p := r.secrets
+	r.lk.RUnlock()
+
+	q := u.Query()
+	var changed bool
+	for _, name := range params {
+		for i, v := range q[name] {
+			if !strings.HasPrefix(v, SecretRefPrefix) {
+				continue
+			}
+			if p == nil {
+				return nil, fmt.Errorf("failed to resolve secret parameter %s: no secret provider configured", name)
+			}
+			secret, err := p.Resolve(strings.TrimPrefix(v, SecretRefPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve secret parameter %s: %w", name, err)
+			}
+			q[name][i], changed = secret, true
+		}
+	}
+	if !changed {
+		return u, nil
+	}
+	ret := *u
+	ret.RawQuery = q.Encode()
+	return &ret, nil
+}
+
+// secretParams returns the secret parameters of the mounts registered under
+// the supplied scheme or alias, and whether the scheme is registered at all.
+func (r *Registry) secretParams(scheme string) ([]string, bool) {
+	r.lk.RLock()
+	defer r.lk.RUnlock()
+
+	if target, ok := r.aliases[scheme]; ok {
+		scheme = target
+	}
+	reg, ok := r.byScheme[scheme]
+	return reg.secrets, ok
+}
+
+// maxSecretsDepth bounds the nesting of mount URLs that are searched for
+// secrets.
+const maxSecretsDepth = 8
+
+// rewriteSecrets returns a copy of u with the values of its secret parameters
+// rewritten by fn, descending into the parameters that hold the URLs of
+// registered mounts, as wrapping mounts do. It returns u itself if nothing
+// was rewritten.
+func (r *Registry) rewriteSecrets(u *url.URL, params []string, depth int, fn func(string) string) *url.URL {
+	q := u.Query()
+	var changed bool
+	for name, vals := range q {
+		secret := contains(params, name)
+		for i, v := range vals {
+			nv := v
+			if secret {
+				nv = fn(v)
+			} else if depth < maxSecretsDepth {
+				nested, err := url.Parse(v)
+				if err != nil || nested.Scheme == "" {
+					continue
+				}
+				nparams, ok := r.secretParams(nested.Scheme)
+				if !ok {
+					continue
+				}
+				if nu := r.rewriteSecrets(nested, nparams, depth+1, fn); nu != nested {
+					nv = nu.String()
+				}
+			}
+			if nv != v {
+				vals[i], changed = nv, true
+			}
+		}
+	}
+	if !changed {
+		return u
+	}
+	ret := *u
+	ret.RawQuery = q.Encode()
+	return &ret
+}
+
+// mountSecrets returns the values of the secret parameters of a mount, if it's
+// a SecretMount. Unlike Registry.Secrets, it doesn't find the secrets of the
+// mounts it wraps.
+func mountSecrets(m Mount) []string {
+	sm, ok := m.(SecretMount)
+	if !ok {
+		return nil
+	}
+	q := sm.Serialize().Query()
+	var ret []string
+	for _, name := range sm.SecretParams() {
+		for _, v := range q[name] {
+			if v != "" && !strings.HasPrefix(v, SecretRefPrefix) {
+				ret = append(ret, v)
+			}
+		}
+	}
+	return ret
+}
+
+// RedactError returns an error whose message has the supplied secrets, and
+// their URL-encoded forms, replaced. The returned error unwraps to err.
+func RedactError(err error, secrets ...string) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	redactedMsg := msg
+	for _, s := range secrets {
+		if s == "" {
+			continue
+		}
+		redactedMsg = strings.ReplaceAll(redactedMsg, s, redacted)
+		redactedMsg = strings.ReplaceAll(redactedMsg, url.QueryEscape(s), redacted)
+	}
+	if redactedMsg == msg {
+		return err
+	}
+	return &redactedError{err: err, msg: redactedMsg}
+}
+
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package mount
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistrySecrets(t *testing.T) {
+	r := NewRegistry()
+	require.NoError(t, r.Register("http", &HTTPMount{SecretQueryParams: []string{"token"}}))
+	require.NoError(t, r.Register("failover", &FailoverMount{Registry: r}))
+
+	mnt := &HTTPMount{URL: "http://example.com/file.car?token=s3cr3t&part=1"}
+	require.Equal(t, []string{"s3cr3t"}, r.Secrets(mnt))
+
+	// secrets can't be represented without a provider.
+	_, err := r.Represent(mnt)
+	require.ErrorIs(t, err, ErrSecretsUnprotected)
+
+	// nor with a provider that doesn't know them.
+	r.SetSecretProvider(StaticSecrets{"other": "other"})
+	_, err = r.Represent(mnt)
+	require.ErrorIs(t, err, ErrUnknownSecret)
+
+	r.SetSecretProvider(StaticSecrets{"tok": "s3cr3t"})
+	u, err := r.Represent(mnt)
+	require.NoError(t, err)
+	require.NotContains(t, u.String(), "s3cr3t")
+	require.Equal(t, "secret:tok", u.Query().Get("token"))
+	require.Equal(t, "1", u.Query().Get("part"))
+
+	// the reference is resolved upon instantiation.
+	u, err = url.Parse(u.String())
+	require.NoError(t, err)
+	m, err := r.Instantiate(u)
+	require.NoError(t, err)
+	require.Contains(t, m.(*HTTPMount).URL, "token=s3cr3t")
+
+	// secrets of wrapped mounts are protected too.
+	fm := &FailoverMount{Sources: []Mount{mnt}, Registry: r}
+	u, err = r.Represent(fm)
+	require.NoError(t, err)
+	require.NotContains(t, u.String(), "s3cr3t")
+	m, err = r.Instantiate(u)
+	require.NoError(t, err)
+	require.Contains(t, m.(*FailoverMount).Sources[0].(*HTTPMount).URL, "token=s3cr3t")
+
+	// unknown references fail instantiation.
+	u, err = url.Parse("http://example.com/file.car?token=secret:nope")
+	require.NoError(t, err)
+	_, err = r.Instantiate(u)
+	require.ErrorIs(t, err, ErrUnknownSecret)
+
+	// plain secrets are redacted from URLs, including nested ones.
+	u, err = url.Parse("http://example.com/file.car?token=s3cr3t&part=1")
+	require.NoError(t, err)
+	redacted := r.Redact(u)
+	require.Equal(t, "REDACTED", redacted.Query().Get("token"))
+	require.Equal(t, "1", redacted.Query().Get("part"))
+	require.Equal(t, "s3cr3t", u.Query().Get("token")) // the original is untouched.
+
+	nested := &url.URL{Scheme: "failover", Host: "failover", RawQuery: url.Values{"source": []string{u.String()}}.Encode()}
+	require.NotContains(t, r.Redact(nested).String(), "s3cr3t")
+}
+
+func TestRedactError(t *testing.T) {
+	base := errors.New("boom")
+	err := fmt.Errorf("GET %s failed with s3cr/t: %w", "http://example.com/?token=s3cr%2Ft", base)
+
+	redacted := RedactError(err, "s3cr/t")
+	require.False(t, strings.Contains(redacted.Error(), "s3cr"))
+	require.ErrorIs(t, redacted, base)
+
+	// errors without secrets are returned as-is.
+	require.Same(t, err, RedactError(err, "other"))
+	require.Nil(t, RedactError(nil, "s3cr/t"))
+}
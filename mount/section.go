@@ -0,0 +1,273 @@
+package mount
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/filecoin-project/dagstore/throttle"
+)
+
+// SectionMount is a mount that exposes the byte range [Offset, Offset+Length)
+// of an inner mount, e.g. a piece inside an unsealed sector file.
+//
+// If the inner mount supports seeking and random access, so does the
+// SectionMount. Otherwise:
+//
+//   - if Transients is set, a single transient copy of the inner mount is
+//     shared by all SectionMounts over the same inner mount, and the
+//     SectionMount serves random access reads from it.
+//   - if not, the SectionMount only supports sequential access (and ranged
+//     reads, if the inner mount does), and will be upgraded to a transient
+//     copy of the section alone.
+//
+// Its URL representation carries the URL of the inner mount, as well as the
+// range, in its query string. Representing and instantiating the inner mount
+// requires Registry to be set, both on the template registered in the
+// Registry, and on mounts constructed directly:
+//
+//	r.Register("section", &mount.SectionMount{Registry: r, Transients: t})
+type SectionMount struct {
+	Inner  Mount
+	Offset int64
+	Length int64
+
+	// Registry is used to represent and instantiate the inner mount.
+	Registry *Registry
+
+	// Transients, if set, shares transient copies of inner mounts that don't
+	// support random access.
+	Transients *SharedTransients
+}
+
+var (
+	_ Mount        = (*SectionMount)(nil)
+	_ RangeFetcher = (*SectionMount)(nil)
+)
+
+// NewFileSection returns a SectionMount over a range of a local file. The
+// registry is used to represent the mount, and must know about FileMount.
+func NewFileSection(r *Registry, path string, offset, length int64) *SectionMount {
+	return &SectionMount{Inner: &FileMount{Path: path}, Offset: offset, Length: length, Registry: r}
+}
+
+func (s *SectionMount) Fetch(ctx context.Context) (Reader, error) {
+	info := s.Inner.Info()
+	switch {
+	case info.AccessSeek && info.AccessRandom:
+		r, err := s.Inner.Fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return newSectionReader(r, s.Offset, s.Length), nil
+
+	case s.Transients != nil:
+		u, err := s.Transients.get(s.Inner)
+		if err != nil {
+			return nil, err
+		}
+		r, err := u.Fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return newSectionReader(r, s.Offset, s.Length), nil
+
+	case info.AccessRanged:
+		rc, err := s.FetchRange(ctx, 0, s.Length)
+		if err != nil {
+			return nil, err
+		}
+		return &sequentialReader{ReadCloser: rc}, nil
+	}
+
+	// sequential only; skip to the offset.
+	r, err := s.Inner.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, r, s.Offset); err != nil {
+		_ = r.Close()
+		return nil, fmt.Errorf("failed to skip to section offset %d: %w", s.Offset, err)
+	}
+	return &sequentialReader{ReadCloser: struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(r, s.Length), r}}, nil
+}
+
+// FetchRange fetches a range of the section from the inner mount, which must
+// be a RangeFetcher.
+func (s *SectionMount) FetchRange(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	rf, ok := s.Inner.(RangeFetcher)
+	if !ok || !s.Inner.Info().AccessRanged {
+		return nil, fmt.Errorf("inner mount of type %T does not support ranged reads", s.Inner)
+	}
+	if offset < 0 || offset+length > s.Length {
+		return nil, fmt.Errorf("range [%d, %d) out of section bounds [0, %d)", offset, offset+length, s.Length)
+	}
+	return rf.FetchRange(ctx, s.Offset+offset, length)
+}
+
+func (s *SectionMount) Info() Info {
+	info := s.Inner.Info()
+	if info.AccessSeek && info.AccessRandom {
+		return info
+	}
+	if s.Transients != nil {
+		return Info{
+			Kind:             info.Kind,
+			AccessSequential: true,
+			AccessSeek:       true,
+			AccessRandom:     true,
+		}
+	}
+	return Info{
+		Kind:             info.Kind,
+		AccessSequential: true,
+		AccessRanged:     info.AccessRanged,
+	}
+}
+
+// Stat stats the inner mount, and fails if the section lies beyond its end.
+func (s *SectionMount) Stat(ctx context.Context) (Stat, error) {
+	stat, err := s.Inner.Stat(ctx)
+	if err != nil || !stat.Exists {
+		return stat, err
+	}
+	if stat.Size > 0 && s.Offset+s.Length > stat.Size {
+		return Stat{}, fmt.Errorf("section [%d, %d) exceeds inner mount size %d", s.Offset, s.Offset+s.Length, stat.Size)
+	}
+	stat.Size = s.Length
+	return stat, nil
+}
+
+func (s *SectionMount) Serialize() *url.URL {
+	u, err := s.serialize()
+	if err != nil {
+		return &url.URL{Host: "irrecoverable"}
+	}
+	return u
+}
+
+func (s *SectionMount) serialize() (*url.URL, error) {
+	if s.Registry == nil {
+		return nil, fmt.Errorf("no registry to represent inner mount")
+	}
+	inner, err := s.Registry.Represent(s.Inner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to represent inner mount: %w", err)
+	}
+	q := url.Values{}
+	q.Set("inner", inner.String())
+	q.Set("offset", strconv.FormatInt(s.Offset, 10))
+	q.Set("length", strconv.FormatInt(s.Length, 10))
+	return &url.URL{Host: "section", RawQuery: q.Encode()}, nil
+}
+
+func (s *SectionMount) Deserialize(u *url.URL) error {
+	if u.Host == "irrecoverable" || u.Host == "" {
+		return fmt.Errorf("invalid host")
+	}
+	if s.Registry == nil {
+		return fmt.Errorf("no registry to instantiate inner mount")
+	}
+
+	q := u.Query()
+	inner, err := ParseURL(q.Get("inner"))
+	if err != nil {
+		return fmt.Errorf("invalid inner mount url: %w", err)
+	}
+	if s.Offset, err = strconv.ParseInt(q.Get("offset"), 10, 64); err != nil || s.Offset < 0 {
+		return fmt.Errorf("invalid offset: %q", q.Get("offset"))
+	}
+	if s.Length, err = strconv.ParseInt(q.Get("length"), 10, 64); err != nil || s.Length <= 0 {
+		return fmt.Errorf("invalid length: %q", q.Get("length"))
+	}
+	if s.Inner, err = s.Registry.Instantiate(inner); err != nil {
+		return fmt.Errorf("failed to instantiate inner mount: %w", err)
+	}
+	return nil
+}
+
+func (s *SectionMount) Close() error {
+	return s.Inner.Close()
+}
+
+// sectionReader is a Reader over a section of another Reader.
+type sectionReader struct {
+	*io.SectionReader
+	io.Closer
+}
+
+func newSectionReader(r Reader, offset, length int64) Reader {
+	return &sectionReader{SectionReader: io.NewSectionReader(r, offset, length), Closer: r}
+}
+
+// SharedTransients maintains transient copies of mounts, shared by all
+// SectionMounts over the same inner mount. Copies are identified by the type
+// and the URL representation of the inner mount.
+//
+// The transients are kept under their own root directory, which must not be
+// the TransientsDir of a DAG store, as the DAG store would consider them
+// orphaned.
+type SharedTransients struct {
+	rootdir   string
+	throttler throttle.Throttler
+	opts      []UpgradeOption
+
+	lk        sync.Mutex
+	upgraders map[string]*Upgrader
+}
+
+// NewSharedTransients creates a SharedTransients that keeps transient copies
+// under rootdir. If throttler is nil, fetches are not throttled.
+func NewSharedTransients(rootdir string, throttler throttle.Throttler, opts ...UpgradeOption) *SharedTransients {
+	if throttler == nil {
+		throttler = throttle.Noop()
+	}
+	return &SharedTransients{
+		rootdir:   rootdir,
+		throttler: throttler,
+		opts:      opts,
+		upgraders: make(map[string]*Upgrader),
+	}
+}
+
+// get returns the Upgrader shared by all mounts equivalent to mnt.
+func (t *SharedTransients) get(mnt Mount) (*Upgrader, error) {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%T:%s", mnt, mnt.Serialize())))
+	key := "shared-" + hex.EncodeToString(h[:16])
+
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	if u, ok := t.upgraders[key]; ok {
+		return u, nil
+	}
+	// reuse a transient left behind by a previous run, if any.
+	initial := filepath.Join(t.rootdir, "transient-"+key+".complete")
+	u, err := Upgrade(mnt, t.throttler, t.rootdir, key, initial, t.opts...)
+	if err != nil {
+		return nil, err
+	}
+	t.upgraders[key] = u
+	return u, nil
+}
+
+// Close closes all shared Upgraders. Their transients are kept on disk.
+func (t *SharedTransients) Close() error {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	for key, u := range t.upgraders {
+		_ = u.Close()
+		delete(t.upgraders, key)
+	}
+	return nil
+}
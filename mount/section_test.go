@@ -0,0 +1,164 @@
+package mount
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore/testdata"
+)
+
+func TestSectionMount(t *testing.T) {
+	ctx := context.Background()
+
+	// a "sector" with two CARs, surrounded by junk.
+	junk := bytes.Repeat([]byte{0xaa}, 127)
+	sector := append(append(append(append([]byte(nil), junk...), testdata.CarV1...), junk...), testdata.CarV2...)
+	off1, len1 := int64(len(junk)), int64(len(testdata.CarV1))
+	off2, len2 := off1+len1+int64(len(junk)), int64(len(testdata.CarV2))
+
+	path := filepath.Join(t.TempDir(), "sector")
+	require.NoError(t, ioutil.WriteFile(path, sector, 0644))
+
+	t.Run("file", func(t *testing.T) {
+		mnt := NewFileSection(nil, path, off1, len1)
+		info := mnt.Info()
+		require.True(t, info.AccessSequential && info.AccessSeek && info.AccessRandom)
+
+		stat, err := mnt.Stat(ctx)
+		require.NoError(t, err)
+		require.True(t, stat.Exists)
+		require.Equal(t, len1, stat.Size)
+
+		rd, err := mnt.Fetch(ctx)
+		require.NoError(t, err)
+		defer rd.Close()
+		bz, err := ioutil.ReadAll(rd)
+		require.NoError(t, err)
+		require.Equal(t, testdata.CarV1, bz)
+
+		// random access and seeking are relative to the section.
+		buf := make([]byte, 10)
+		_, err = rd.ReadAt(buf, 5)
+		require.NoError(t, err)
+		require.Equal(t, testdata.CarV1[5:15], buf)
+		n, err := rd.Seek(-10, io.SeekEnd)
+		require.NoError(t, err)
+		require.Equal(t, len1-10, n)
+		_, err = io.ReadFull(rd, buf)
+		require.NoError(t, err)
+		require.Equal(t, testdata.CarV1[len1-10:], buf)
+
+		// sections beyond the end of the inner mount.
+		_, err = NewFileSection(nil, path, off2, len2+1).Stat(ctx)
+		require.Error(t, err)
+	})
+
+	t.Run("sequential", func(t *testing.T) {
+		mnt := &SectionMount{Inner: &FSMount{FS: testdata.Sequential(fstest.MapFS{"sector": {Data: sector}}), Path: "sector"}, Offset: off2, Length: len2}
+		info := mnt.Info()
+		require.True(t, info.AccessSequential)
+		require.False(t, info.AccessSeek || info.AccessRandom)
+
+		rd, err := mnt.Fetch(ctx)
+		require.NoError(t, err)
+		defer rd.Close()
+		bz, err := ioutil.ReadAll(rd)
+		require.NoError(t, err)
+		require.Equal(t, testdata.CarV2, bz)
+	})
+
+	t.Run("ranged", func(t *testing.T) {
+		inner := &rangeMount{data: sector}
+		mnt := &SectionMount{Inner: inner, Offset: off2, Length: len2}
+		require.True(t, mnt.Info().AccessRanged)
+
+		rd, err := mnt.Fetch(ctx)
+		require.NoError(t, err)
+		defer rd.Close()
+		bz, err := ioutil.ReadAll(rd)
+		require.NoError(t, err)
+		require.Equal(t, testdata.CarV2, bz)
+		require.Equal(t, [][2]int64{{off2, len2}}, inner.ranges)
+
+		_, err = mnt.FetchRange(ctx, 1, len2)
+		require.Error(t, err)
+	})
+
+	t.Run("shared transient", func(t *testing.T) {
+		rootDir := t.TempDir()
+		transients := NewSharedTransients(rootDir, nil)
+		defer transients.Close()
+
+		inner := &Counting{Mount: &FSMount{FS: testdata.Sequential(fstest.MapFS{"sector": {Data: sector}}), Path: "sector"}}
+		mnt1 := &SectionMount{Inner: inner, Offset: off1, Length: len1, Transients: transients}
+		mnt2 := &SectionMount{Inner: inner, Offset: off2, Length: len2, Transients: transients}
+		require.True(t, mnt1.Info().AccessRandom)
+
+		for _, tc := range []struct {
+			mnt      *SectionMount
+			expected []byte
+		}{{mnt1, testdata.CarV1}, {mnt2, testdata.CarV2}, {mnt1, testdata.CarV1}} {
+			rd, err := tc.mnt.Fetch(ctx)
+			require.NoError(t, err)
+			buf := make([]byte, 20)
+			_, err = rd.ReadAt(buf, 3)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected[3:23], buf)
+			require.NoError(t, rd.Close())
+		}
+
+		// the inner mount was only fetched once, into a single transient.
+		require.Equal(t, 1, inner.Count())
+		fs, err := ioutil.ReadDir(rootDir)
+		require.NoError(t, err)
+		require.Len(t, fs, 1)
+
+		// the transient is reused after a restart.
+		require.NoError(t, transients.Close())
+		transients = NewSharedTransients(rootDir, nil)
+		mnt1.Transients = transients
+		rd, err := mnt1.Fetch(ctx)
+		require.NoError(t, err)
+		require.NoError(t, rd.Close())
+		require.Equal(t, 1, inner.Count())
+		_, err = os.Stat(filepath.Join(rootDir, fs[0].Name()))
+		require.NoError(t, err)
+	})
+}
+
+func TestSectionMountRegistry(t *testing.T) {
+	r := NewRegistry()
+	require.NoError(t, r.Register("file", new(FileMount)))
+	require.NoError(t, r.Register("section", &SectionMount{Registry: r}))
+
+	mnt := NewFileSection(r, "sector.bin", 1024, 2048)
+	u, err := r.Represent(mnt)
+	require.NoError(t, err)
+	require.Equal(t, "section", u.Scheme)
+
+	m, err := r.Instantiate(u)
+	require.NoError(t, err)
+	sm, ok := m.(*SectionMount)
+	require.True(t, ok)
+	require.Equal(t, &FileMount{Path: "sector.bin"}, sm.Inner)
+	require.EqualValues(t, 1024, sm.Offset)
+	require.EqualValues(t, 2048, sm.Length)
+
+	// nor can sections of mounts of unregistered types.
+	_, err = r.Represent(&SectionMount{Registry: r, Inner: &BytesMount{Bytes: []byte("foo")}, Length: 3})
+	require.ErrorIs(t, err, ErrUnrecognizedType)
+
+	// without a registry, the section can't be represented.
+	mnt.Registry = nil
+	require.Equal(t, "irrecoverable", mnt.Serialize().Host)
+	_, err = r.Represent(mnt)
+	require.Error(t, err)
+}
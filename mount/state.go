@@ -0,0 +1,72 @@
+package mount
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+)
+
+// StateQueryParam is the URL query parameter that carries the state of a
+// StatefulMount, when it's represented as a URL alone (e.g. when it's wrapped
+// by another mount).
+const StateQueryParam = "dagstore-state"
+
+// StatefulMount is implemented by mounts whose configuration doesn't fit in a
+// URL, such as nested or repeated structures. Their state is persisted as an
+// opaque blob alongside their URL, which then serves as a human-readable
+// summary.
+//
+// The Registry round-trips the state through RepresentWithState and
+// InstantiateWithState. Represent and Instantiate, which are used by mounts
+// that wrap other mounts, carry the state in the StateQueryParam parameter of
+// the URL instead.
+type StatefulMount interface {
+	Mount
+
+	// MarshalState returns the state of the mount. A nil state is not
+	// persisted.
+	MarshalState() ([]byte, error)
+
+	// UnmarshalState restores the state of the mount. It's called after
+	// Deserialize, and only if state was persisted.
+	UnmarshalState(state []byte) error
+}
+
+// mountState returns the state of the mount, if it's a StatefulMount.
+func mountState(m Mount) ([]byte, error) {
+	sm, ok := m.(StatefulMount)
+	if !ok {
+		return nil, nil
+	}
+	state, err := sm.MarshalState()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal state of mount with type %T: %w", m, err)
+	}
+	return state, nil
+}
+
+// embedState returns a copy of u with the state in StateQueryParam.
+func embedState(u *url.URL, state []byte) *url.URL {
+	q := u.Query()
+	q.Set(StateQueryParam, base64.RawURLEncoding.EncodeToString(state))
+	ret := *u
+	ret.RawQuery = q.Encode()
+	return &ret
+}
+
+// extractState returns a copy of u without StateQueryParam, and the state it
+// carried, if any.
+func extractState(u *url.URL) (*url.URL, []byte, error) {
+	q := u.Query()
+	if _, ok := q[StateQueryParam]; !ok {
+		return u, nil, nil
+	}
+	state, err := base64.RawURLEncoding.DecodeString(q.Get(StateQueryParam))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode mount state: %w", err)
+	}
+	q.Del(StateQueryParam)
+	ret := *u
+	ret.RawQuery = q.Encode()
+	return &ret, state, nil
+}
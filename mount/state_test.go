@@ -0,0 +1,101 @@
+package mount
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryState(t *testing.T) {
+	r := NewRegistry()
+	require.NoError(t, r.Register("state", new(stateMount)))
+	require.NoError(t, r.Register("bytes", new(BytesMount)))
+	require.NoError(t, r.Register("failover", &FailoverMount{Registry: r}))
+
+	mnt := &stateMount{Name: "sector", Sectors: []stateSector{{Number: 1, Offset: 128}, {Number: 7, Offset: 0}}}
+
+	// the state is returned separately from the URL, which is a summary.
+	u, state, err := r.RepresentWithState(mnt)
+	require.NoError(t, err)
+	require.Equal(t, "state://sector?sectors=2", u.String())
+	require.JSONEq(t, `{"sectors":[{"n":1,"o":128},{"n":7,"o":0}]}`, string(state))
+
+	m, err := r.InstantiateWithState(u, state)
+	require.NoError(t, err)
+	require.Equal(t, mnt, m)
+
+	// the state is embedded in the URL by Represent.
+	u, err = r.Represent(mnt)
+	require.NoError(t, err)
+	require.NotEmpty(t, u.Query().Get(StateQueryParam))
+	u, err = url.Parse(u.String())
+	require.NoError(t, err)
+	m, err = r.Instantiate(u)
+	require.NoError(t, err)
+	require.Equal(t, mnt, m)
+
+	// so that stateful mounts can be wrapped.
+	fm := &FailoverMount{Sources: []Mount{mnt, &BytesMount{Bytes: []byte("abc")}}, Registry: r}
+	u, state, err = r.RepresentWithState(fm)
+	require.NoError(t, err)
+	require.Nil(t, state)
+	m, err = r.InstantiateWithState(u, state)
+	require.NoError(t, err)
+	require.Equal(t, mnt, m.(*FailoverMount).Sources[0])
+
+	// state can't be restored into mounts that aren't stateful.
+	_, err = r.InstantiateWithState(&url.URL{Scheme: "bytes", Host: "YWJj"}, []byte("{}"))
+	require.Error(t, err)
+
+	// state errors are propagated.
+	_, err = r.InstantiateWithState(&url.URL{Scheme: "state", Host: "sector"}, []byte("not json"))
+	require.Error(t, err)
+	_, err = r.Instantiate(&url.URL{Scheme: "state", Host: "sector", RawQuery: StateQueryParam + "=!!!"})
+	require.Error(t, err)
+}
+
+// stateMount is a mount with state that doesn't fit in a URL.
+type stateMount struct {
+	BytesMount
+	Name    string
+	Sectors []stateSector
+}
+
+type stateSector struct {
+	Number int   `json:"n"`
+	Offset int64 `json:"o"`
+}
+
+var _ StatefulMount = (*stateMount)(nil)
+
+func (s *stateMount) Fetch(_ context.Context) (Reader, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (s *stateMount) Serialize() *url.URL {
+	return &url.URL{Host: s.Name, RawQuery: fmt.Sprintf("sectors=%d", len(s.Sectors))}
+}
+
+func (s *stateMount) Deserialize(u *url.URL) error {
+	s.Name = u.Host
+	return nil
+}
+
+func (s *stateMount) MarshalState() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{"sectors": s.Sectors})
+}
+
+func (s *stateMount) UnmarshalState(state []byte) error {
+	var st struct {
+		Sectors []stateSector `json:"sectors"`
+	}
+	if err := json.Unmarshal(state, &st); err != nil {
+		return err
+	}
+	s.Sectors = st.Sectors
+	return nil
+}
@@ -2,8 +2,11 @@ package mount
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -11,6 +14,7 @@ import (
 	"sync/atomic"
 
 	"github.com/filecoin-project/dagstore/throttle"
+	"github.com/filecoin-project/dagstore/transform"
 	logging "github.com/ipfs/go-log/v2"
 )
 
@@ -28,13 +32,16 @@ type Upgrader struct {
 	throttler   throttle.Throttler
 	key         string
 	passthrough bool
+	streaming   bool
 
 	// paths: pathComplete is the path of transients that are
 	// completely downloaded; pathPartial is the path where in-progress
 	// downloads are placed. Once fully downloaded, the file is renamed to
 	// pathComplete.
-	pathComplete string
-	pathPartial  string
+	pathComplete   string
+	pathPartial    string
+	pathPartialTag string // records the version (see resourceVersion) of the resource being downloaded into pathPartial.
+	pathSparse     string
 
 	lk    sync.Mutex
 	path  string // guarded by lk
@@ -46,26 +53,48 @@ type Upgrader struct {
 	onceErr error      // NOT guarded by lk; access coordinated by sync.Once
 
 	fetches int32 // guarded by atomic
+
+	// dl tracks the ongoing download in streaming mode; see WithStreaming.
+	dl *download // guarded by lk
+	// sparse is the sparse cache in sparse cache mode, opened on first fetch;
+	// see WithSparseCache. The mode is enabled if sparseChunkSize > 0.
+	sparse          *sparseCache // guarded by lk
+	sparseChunkSize int64
+	// encryption encrypts transients at rest, if not nil; see WithEncryption.
+	encryption *transform.AESGCM
+	// ctx is the context of downloads in streaming mode, which outlive the
+	// fetch that triggered them. It's cancelled by Close.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
+// UpgradeOption configures an Upgrader.
+type UpgradeOption func(*Upgrader)
+
 var _ Mount = (*Upgrader)(nil)
 
 // Upgrade constructs a new Upgrader for the underlying Mount. If provided, it
 // will reuse the file in path `initial` as the initial transient copy. Whenever
 // a new transient copy has to be created, it will be created under `rootdir`.
-func Upgrade(underlying Mount, throttler throttle.Throttler, rootdir, key string, initial string) (*Upgrader, error) {
+func Upgrade(underlying Mount, throttler throttle.Throttler, rootdir, key string, initial string, opts ...UpgradeOption) (*Upgrader, error) {
 	ret := &Upgrader{
-		underlying:   underlying,
-		key:          key,
-		rootdir:      rootdir,
-		once:         new(sync.Once),
-		throttler:    throttler,
-		pathComplete: filepath.Join(rootdir, "transient-"+key+".complete"),
-		pathPartial:  filepath.Join(rootdir, "transient-"+key+".partial"),
+		underlying:     underlying,
+		key:            key,
+		rootdir:        rootdir,
+		once:           new(sync.Once),
+		throttler:      throttler,
+		pathComplete:   filepath.Join(rootdir, "transient-"+key+".complete"),
+		pathPartial:    filepath.Join(rootdir, "transient-"+key+".partial"),
+		pathPartialTag: filepath.Join(rootdir, "transient-"+key+".partial.etag"),
+		pathSparse:     filepath.Join(rootdir, "transient-"+key+".sparse"),
 	}
 	if ret.rootdir == "" {
 		ret.rootdir = os.TempDir() // use the OS' default temp dir.
 	}
+	for _, opt := range opts {
+		opt(ret)
+	}
+	ret.ctx, ret.cancel = context.WithCancel(context.Background())
 
 	switch info := underlying.Info(); {
 	case !info.AccessSequential:
@@ -75,8 +104,21 @@ func Upgrade(underlying Mount, throttler throttle.Throttler, rootdir, key string
 		return ret, nil
 	}
 
+	// the sparse cache mode requires ranged reads, and neither it nor
+	// streaming mode can write encrypted transients.
+	if !ret.ranged() || ret.encryption != nil {
+		ret.sparseChunkSize = 0
+	}
+	if ret.encryption != nil {
+		ret.streaming = false
+	}
+
 	if initial != "" {
 		if _, err := os.Stat(initial); err == nil {
+			if err := ret.checkTransient(initial); err != nil {
+				log.Warnw("ignoring existing transient that can't be decrypted", "shard", key, "path", initial, "error", err)
+				return ret, nil
+			}
 			log.Debugw("initialized with existing transient that's alive", "shard", key, "path", initial)
 			ret.path = initial
 			ret.ready = true
@@ -92,6 +134,18 @@ func (u *Upgrader) Fetch(ctx context.Context) (Reader, error) {
 		log.Debugw("fully capable mount; fetching from underlying", "shard", u.key)
 		return u.underlying.Fetch(ctx)
 	}
+	if r, err := u.fetchDirect(ctx); r != nil || err != nil {
+		return r, err
+	}
+	if u.sparseChunkSize > 0 {
+		if r, err := u.fetchSparse(ctx); r != nil || err != nil {
+			return r, err
+		}
+		// the underlying mount turned out not to support ranged reads.
+	}
+	if u.streaming {
+		return u.fetchStreaming()
+	}
 
 	// determine if the transient is still alive.
 	// if not, delete it, get the current sync.Once and trigger a refresh.
@@ -102,7 +156,7 @@ func (u *Upgrader) Fetch(ctx context.Context) (Reader, error) {
 		if _, err := os.Stat(u.path); err == nil {
 			log.Debugw("transient copy alive; not refetching", "shard", u.key, "path", u.path)
 			defer u.lk.Unlock()
-			return os.Open(u.path)
+			return u.open(u.path)
 		} else {
 			u.ready = false
 			log.Debugw("transient copy dead; removing and refetching", "shard", u.key, "path", u.path, "error", err)
@@ -118,26 +172,14 @@ func (u *Upgrader) Fetch(ctx context.Context) (Reader, error) {
 	u.lk.Unlock()
 
 	once.Do(func() {
-		// Create a new file in the partial location.
-		// os.Create truncates existing files.
-		var partial *os.File
-		partial, u.onceErr = os.Create(u.pathPartial)
-		if u.onceErr != nil {
-			return
-		}
-		defer partial.Close()
-
-		// do the refetch; abort and remove/reset the partial if it fails.
+		// do the refetch into the partial location; the partial is removed
+		// if it fails, unless the download can be resumed.
 		// perform outside the lock as this is a long-running operation.
 		// u.onceErr is only written by the goroutine that gets to run sync.Once
 		// and it's only read after it finishes.
-
-		u.onceErr = u.refetch(ctx, partial)
+		u.onceErr = u.download(ctx, nil)
 		if u.onceErr != nil {
 			log.Warnw("failed to refetch", "shard", u.key, "error", u.onceErr)
-			if err := os.Remove(u.pathPartial); err != nil {
-				log.Warnw("failed to remove partial transient", "shard", u.key, "path", u.pathPartial, "error", err)
-			}
 			return
 		}
 
@@ -147,6 +189,7 @@ func (u *Upgrader) Fetch(ctx context.Context) (Reader, error) {
 		if err := os.Rename(u.pathPartial, u.pathComplete); err != nil {
 			log.Warnw("failed to rename partial transient", "shard", u.key, "from_path", u.pathPartial, "to_path", u.pathComplete, "error", err)
 		}
+		_ = os.Remove(u.pathPartialTag)
 
 		u.lk.Lock()
 		u.path = u.pathComplete
@@ -168,7 +211,40 @@ func (u *Upgrader) Fetch(ctx context.Context) (Reader, error) {
 	}
 
 	log.Debugw("refetched successfully", "shard", u.key, "path", u.pathComplete)
-	return os.Open(u.pathComplete)
+	return u.open(u.pathComplete)
+}
+
+// fetchDirect returns a reader fetched from the underlying mount if it
+// supports seeking and random access after all, even though it didn't report
+// so when the Upgrader was created (e.g. because the file it probes didn't
+// exist yet). It's only attempted if there's no transient copy, and if the
+// underlying mount currently reports full capabilities; errors fetching from
+// the mount are returned as is. It returns a nil Reader and a nil error
+// otherwise, in which case a transient copy is used.
+func (u *Upgrader) fetchDirect(ctx context.Context) (Reader, error) {
+	u.lk.Lock()
+	ready := u.ready
+	u.lk.Unlock()
+	if ready {
+		return nil, nil
+	}
+	if info := u.underlying.Info(); !info.AccessSeek || !info.AccessRandom {
+		return nil, nil
+	}
+
+	r, err := u.underlying.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// trust the actual reader over the mount.
+	if pr, ok := r.(PartialReader); ok {
+		if seek, random := pr.Capabilities(); !seek || !random {
+			_ = r.Close()
+			return nil, nil
+		}
+	}
+	log.Debugw("underlying mount is fully capable; not using a transient", "shard", u.key)
+	return r, nil
 }
 
 func (u *Upgrader) Info() Info {
@@ -182,14 +258,33 @@ func (u *Upgrader) Info() Info {
 
 func (u *Upgrader) Stat(ctx context.Context) (Stat, error) {
 	if u.path != "" {
-		if stat, err := os.Stat(u.path); err == nil {
-			ret := Stat{Exists: true, Size: stat.Size()}
+		if size, err := u.transientSize(u.path); err == nil {
+			ret := Stat{Exists: true, Size: size}
 			return ret, nil
 		}
 	}
 	return u.underlying.Stat(ctx)
 }
 
+// ManagedFiles returns the paths of the local files that this Upgrader may be
+// tracking, whether they exist or not.
+func (u *Upgrader) ManagedFiles() []string {
+	u.lk.Lock()
+	defer u.lk.Unlock()
+
+	var ret []string
+	if u.path != "" {
+		ret = append(ret, u.path)
+	}
+	if u.sparseChunkSize > 0 {
+		ret = append(ret, u.pathSparse, u.pathSparse+".bitmap")
+	} else if u.resumable() {
+		// partial downloads can be resumed.
+		ret = append(ret, u.pathPartial, u.pathPartialTag)
+	}
+	return ret
+}
+
 // TransientPath returns the local path of the transient file, if one exists.
 func (u *Upgrader) TransientPath() string {
 	u.lk.Lock()
@@ -198,6 +293,16 @@ func (u *Upgrader) TransientPath() string {
 	return u.path
 }
 
+// OpenTransient opens the transient copy for reading, decrypting it if
+// encryption is enabled. It fails if there's no transient copy.
+func (u *Upgrader) OpenTransient() (Reader, error) {
+	p := u.TransientPath()
+	if p == "" {
+		return nil, fmt.Errorf("no transient copy: %w", os.ErrNotExist)
+	}
+	return u.open(p)
+}
+
 // TimesFetched returns the number of times that the underlying has
 // been fetched.
 func (u *Upgrader) TimesFetched() int {
@@ -217,15 +322,46 @@ func (u *Upgrader) Deserialize(url *url.URL) error {
 	return u.underlying.Deserialize(url)
 }
 
-// TODO implement
+// Close aborts any ongoing download in streaming mode, waiting for it to wind
+// down so that it doesn't write to the transients directory afterwards, and
+// closes the sparse cache, if any. It does not close the underlying mount.
 func (u *Upgrader) Close() error {
-	log.Warnf("Upgrader.Close() not implemented yet; call will no-op")
+	if u.cancel != nil {
+		u.cancel()
+	}
+
+	u.lk.Lock()
+	dl := u.dl
+	u.lk.Unlock()
+	if dl != nil {
+		_, _ = dl.wait(math.MaxInt64)
+	}
+
+	u.lk.Lock()
+	defer u.lk.Unlock()
+	if u.sparse != nil {
+		err := u.sparse.f.Close()
+		u.sparse = nil
+		return err
+	}
 	return nil
 }
 
-func (u *Upgrader) refetch(ctx context.Context, into *os.File) error {
-	log.Debugw("actually refetching", "shard", u.key, "path", into.Name())
+// download fetches the underlying mount into the partial transient, resuming
+// a previous download if possible (see openPartial). If dl is not nil, it's
+// advanced as data is written. On failure, the partial transient is removed,
+// unless the download can be resumed. Secrets of the underlying mount are
+// redacted from the returned error.
+func (u *Upgrader) download(ctx context.Context, dl *download) error {
+	err := u.downloadPartial(ctx, dl)
+	if err != nil {
+		err = RedactError(err, mountSecrets(u.underlying)...)
+	}
+	return err
+}
 
+// downloadPartial implements download.
+func (u *Upgrader) downloadPartial(ctx context.Context, dl *download) error {
 	// sanity check on underlying mount.
 	stat, err := u.underlying.Stat(ctx)
 	if err != nil {
@@ -234,6 +370,135 @@ func (u *Upgrader) refetch(ctx context.Context, into *os.File) error {
 		return fmt.Errorf("underlying mount no longer exists")
 	}
 
+	partial, offset, err := u.openPartial(stat)
+	if err != nil {
+		return fmt.Errorf("failed to open partial transient: %w", err)
+	}
+
+	var into io.Writer = partial
+	if dl != nil {
+		into = &downloadWriter{f: partial, dl: dl}
+	}
+	var ew *transform.EncryptWriter
+	if u.encryption != nil {
+		if ew, err = u.encryption.NewWriter(partial); err != nil {
+			_ = partial.Close()
+			return fmt.Errorf("failed to encrypt partial transient: %w", err)
+		}
+		into = ew
+	}
+
+	// readers of the download can only read the data we resume from once
+	// we know we're able to resume.
+	resumed := func() {
+		if dl != nil {
+			dl.advance(offset)
+		}
+	}
+	err = u.refetch(ctx, into, stat, offset, resumed)
+	if errors.Is(err, ErrRangeUnsupported) && offset > 0 {
+		// offset > 0 implies that the transient isn't encrypted, so we can
+		// drop the partial and restart from the beginning.
+		log.Warnw("underlying mount can't resume download; restarting from the beginning", "shard", u.key, "offset", offset, "error", err)
+		if err = partial.Truncate(0); err == nil {
+			if err = os.Remove(u.pathPartialTag); os.IsNotExist(err) {
+				err = nil
+			}
+		}
+		if err == nil {
+			err = u.refetch(ctx, into, stat, 0, nil)
+		}
+	}
+	if err == nil && ew != nil {
+		err = ew.Close() // seals the final chunk.
+	}
+	if cerr := partial.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil && !u.resumable() {
+		if err := os.Remove(u.pathPartial); err != nil {
+			log.Warnw("failed to remove partial transient", "shard", u.key, "path", u.pathPartial, "error", err)
+		}
+	}
+	return err
+}
+
+// openPartial opens the partial transient for writing. If the download is
+// resumable, and the partial transient left by a previous
+// download of the same version of the resource exists, it's opened for
+// appending, and its size is returned as the offset to resume from. Otherwise,
+// the partial transient is truncated. Downloads of resources whose version
+// can't be determined are never resumed.
+func (u *Upgrader) openPartial(stat Stat) (*os.File, int64, error) {
+	version := resourceVersion(stat)
+	if u.resumable() && version != "" {
+		tag, _ := ioutil.ReadFile(u.pathPartialTag)
+		fi, err := os.Stat(u.pathPartial)
+		if err == nil && fi.Size() > 0 && fi.Size() <= stat.Size && string(tag) == version {
+			f, err := os.OpenFile(u.pathPartial, os.O_WRONLY|os.O_APPEND, 0644)
+			if err == nil {
+				log.Debugw("resuming download into partial transient", "shard", u.key, "path", u.pathPartial, "offset", fi.Size())
+				return f, fi.Size(), nil
+			}
+		}
+	}
+
+	// os.Create truncates existing files.
+	f, err := os.Create(u.pathPartial)
+	if err != nil {
+		return nil, 0, err
+	}
+	// record the version of the resource being downloaded.
+	if u.resumable() && version != "" {
+		err = ioutil.WriteFile(u.pathPartialTag, []byte(version), 0644)
+	} else if err = os.Remove(u.pathPartialTag); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, err
+	}
+	return f, 0, nil
+}
+
+// resourceVersion returns a validator of the version of the resource described
+// by stat: its ETag if it has one, or else its modification time and size. It
+// returns an empty string if neither is known, in which case data fetched
+// previously can't be trusted to match the current version.
+func resourceVersion(stat Stat) string {
+	switch {
+	case stat.ETag != "":
+		return stat.ETag
+	case !stat.ModTime.IsZero() && stat.Size > 0:
+		return fmt.Sprintf("mtime:%d;size:%d", stat.ModTime.UnixNano(), stat.Size)
+	default:
+		return ""
+	}
+}
+
+// ranged returns whether the underlying mount supports ranged reads.
+func (u *Upgrader) ranged() bool {
+	_, ok := u.underlying.(RangeFetcher)
+	return ok && u.underlying.Info().AccessRanged
+}
+
+// resumable returns whether interrupted downloads can be resumed, which
+// requires ranged reads, and plain transients that can be appended to.
+func (u *Upgrader) resumable() bool {
+	return u.ranged() && u.encryption == nil
+}
+
+// refetch copies the underlying mount into the supplied writer, starting at
+// offset. If offset > 0, resumed is called once the remaining range has
+// been successfully requested.
+func (u *Upgrader) refetch(ctx context.Context, into io.Writer, stat Stat, offset int64, resumed func()) error {
+	log.Debugw("actually refetching", "shard", u.key, "path", u.pathPartial, "offset", offset)
+
+	if offset > 0 && offset >= stat.Size {
+		resumed()
+		return nil // we already have everything.
+	}
+
 	// throttle only if the file is ready; if it's not ready, we would be
 	// throttling and then idling.
 	t := u.throttler
@@ -244,9 +509,19 @@ func (u *Upgrader) refetch(ctx context.Context, into *os.File) error {
 		log.Debugw("underlying mount is ready; will throttle fetch and copy", "shard", u.key)
 	}
 
-	err = t.Do(ctx, func(ctx context.Context) error {
-		// fetch from underlying and copy.
-		from, err := u.underlying.Fetch(ctx)
+	err := t.Do(ctx, func(ctx context.Context) error {
+		// fetch from underlying and copy, resuming from the offset if any.
+		var (
+			from io.ReadCloser
+			err  error
+		)
+		if offset > 0 {
+			if from, err = u.underlying.(RangeFetcher).FetchRange(ctx, offset, stat.Size-offset); err == nil {
+				resumed()
+			}
+		} else {
+			from, err = u.underlying.Fetch(ctx)
+		}
 		if err != nil {
 			return fmt.Errorf("failed to fetch from underlying mount: %w", err)
 		}
@@ -271,6 +546,19 @@ func (u *Upgrader) DeleteTransient() error {
 	u.lk.Lock()
 	defer u.lk.Unlock()
 
+	// remove the sparse cache, if any, even if it hasn't been opened.
+	if u.sparseChunkSize > 0 {
+		if u.sparse != nil {
+			_ = u.sparse.f.Close()
+			u.sparse = nil
+		}
+		for _, p := range []string{u.pathSparse, u.pathSparse + ".bitmap"} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				log.Warnw("failed to remove sparse cache", "shard", u.key, "path", p, "error", err)
+			}
+		}
+	}
+
 	if u.path == "" {
 		log.Debugw("transient is empty; nothing to remove", "shard", u.key)
 		return nil // nothing to do.
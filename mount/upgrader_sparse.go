@@ -0,0 +1,397 @@
+package mount
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// DefaultSparseChunkSize is the granularity at which sparse caches are
+// populated, if no chunk size is specified.
+const DefaultSparseChunkSize = 1 << 20 // 1MiB
+
+// WithSparseCache enables the sparse cache mode for mounts that can serve byte
+// ranges (see RangeFetcher). Instead of downloading a full transient copy,
+// the Upgrader keeps a sparse local cache file that's populated on demand, in
+// chunks of chunkSize bytes, as readers request data. A bitmap of the chunks
+// present in the cache is persisted next to it, so the cache survives
+// restarts.
+//
+// The option has no effect on mounts that don't support ranged reads. A
+// chunkSize of 0 selects DefaultSparseChunkSize.
+func WithSparseCache(chunkSize int64) UpgradeOption {
+	return func(u *Upgrader) {
+		if chunkSize <= 0 {
+			chunkSize = DefaultSparseChunkSize
+		}
+		u.sparseChunkSize = chunkSize
+	}
+}
+
+// fetchSparse returns a Reader backed by the sparse cache, opening the cache
+// if necessary. If a complete transient exists, it's used instead. It returns
+// a nil Reader and a nil error if the underlying mount reports that it
+// doesn't support ranged reads after all, in which case the caller falls back
+// to a full download.
+func (u *Upgrader) fetchSparse(ctx context.Context) (Reader, error) {
+	u.lk.Lock()
+	defer u.lk.Unlock()
+
+	if u.ready {
+		if _, err := os.Stat(u.path); err == nil {
+			return u.open(u.path)
+		}
+		u.ready = false
+	}
+
+	if u.sparse == nil {
+		stat, err := u.underlying.Stat(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("underlying mount stat returned error: %w", err)
+		} else if !stat.Exists {
+			return nil, fmt.Errorf("underlying mount no longer exists")
+		}
+		if !u.ranged() {
+			log.Debugw("underlying mount doesn't support ranged reads; not using sparse cache", "shard", u.key)
+			return nil, nil
+		}
+		if stat.Size <= 0 {
+			log.Debugw("size of underlying mount is unknown; not using sparse cache", "shard", u.key)
+			return nil, nil
+		}
+		c, err := openSparseCache(u.underlying.(RangeFetcher), u.pathSparse, u.pathSparse+".bitmap", stat, u.sparseChunkSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open sparse cache: %w", err)
+		}
+		u.sparse = c
+	}
+	return &sparseReader{ctx: u.ctx, c: u.sparse}, nil
+}
+
+// sparseCache is a local cache file that's populated on demand with chunks of
+// a resource fetched through a RangeFetcher.
+type sparseCache struct {
+	rf         RangeFetcher
+	f          *os.File
+	bitmapPath string
+
+	// lk guards the bitmap and the in-flight fetches. It's never held while
+	// fetching from the mount, so that reads of cached chunks aren't blocked
+	// by reads of missing ones.
+	lk       sync.Mutex
+	bitmap   sparseBitmap
+	inflight map[int64]*chunkFetch // keyed by chunk index.
+
+	// persistLk serializes writes of the bitmap.
+	persistLk sync.Mutex
+}
+
+// chunkFetch is an in-flight fetch of a run of chunks. done is closed when the
+// fetch finishes; readers of those chunks wait on it instead of fetching them
+// again.
+type chunkFetch struct {
+	done chan struct{}
+}
+
+// sparseBitmap is the persisted record of the chunks present in a sparse
+// cache.
+type sparseBitmap struct {
+	Size      int64  `json:"s"`
+	ChunkSize int64  `json:"c"`
+	Version   string `json:"e,omitempty"` // see resourceVersion.
+	Chunks    []byte `json:"b"`
+}
+
+func (b *sparseBitmap) has(i int64) bool {
+	return b.Chunks[i/8]&(1<<(i%8)) != 0
+}
+
+func (b *sparseBitmap) set(i int64) {
+	b.Chunks[i/8] |= 1 << (i % 8)
+}
+
+// openSparseCache opens the sparse cache at path, reusing its contents if the
+// bitmap at bitmapPath is consistent with the expected size, chunk size and
+// version of the resource. Caches of resources whose version can't be
+// determined are never reused.
+func openSparseCache(rf RangeFetcher, path, bitmapPath string, stat Stat, chunkSize int64) (*sparseCache, error) {
+	c := &sparseCache{rf: rf, bitmapPath: bitmapPath, inflight: make(map[int64]*chunkFetch)}
+
+	version := resourceVersion(stat)
+	reuse := false
+	if bz, err := ioutil.ReadFile(bitmapPath); err == nil && version != "" {
+		if err := json.Unmarshal(bz, &c.bitmap); err == nil {
+			reuse = c.bitmap.Size == stat.Size && c.bitmap.ChunkSize == chunkSize && c.bitmap.Version == version
+		}
+	}
+
+	flags := os.O_RDWR | os.O_CREATE
+	if !reuse {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// extending the file doesn't allocate blocks on filesystems that support
+	// sparse files.
+	if err := f.Truncate(stat.Size); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	c.f = f
+
+	if !reuse {
+		nchunks := (stat.Size + chunkSize - 1) / chunkSize
+		c.bitmap = sparseBitmap{Size: stat.Size, ChunkSize: chunkSize, Version: version, Chunks: make([]byte, (nchunks+7)/8)}
+		if err := c.persist(); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// ensure fetches the chunks overlapping [off, end) that are missing from the
+// cache. Chunks that are already being fetched by another reader are waited
+// on rather than fetched again.
+func (c *sparseCache) ensure(ctx context.Context, off, end int64) error {
+	cs := c.bitmap.ChunkSize // immutable.
+	first, last := off/cs, (end-1)/cs
+
+	for {
+		type claim struct {
+			i, j int64
+			f    *chunkFetch
+		}
+		var (
+			claims []claim
+			waits  []*chunkFetch
+		)
+
+		c.lk.Lock()
+		for i := first; i <= last; i++ {
+			if c.bitmap.has(i) {
+				continue
+			}
+			if f, ok := c.inflight[i]; ok {
+				if len(waits) == 0 || waits[len(waits)-1] != f {
+					waits = append(waits, f)
+				}
+				continue
+			}
+			// claim the longest run of missing chunks that nobody else is
+			// fetching, to fetch it in one go.
+			j := i
+			for j < last && !c.bitmap.has(j+1) && c.inflight[j+1] == nil {
+				j++
+			}
+			f := &chunkFetch{done: make(chan struct{})}
+			for k := i; k <= j; k++ {
+				c.inflight[k] = f
+			}
+			claims = append(claims, claim{i: i, j: j, f: f})
+			i = j
+		}
+		c.lk.Unlock()
+
+		if len(claims) == 0 && len(waits) == 0 {
+			return nil
+		}
+
+		var err error
+		fetched := false
+		for _, cl := range claims {
+			// once a fetch fails, release the remaining claims without
+			// fetching them.
+			if err == nil {
+				start, stop := cl.i*cs, (cl.j+1)*cs
+				if stop > c.bitmap.Size {
+					stop = c.bitmap.Size
+				}
+				err = c.fetch(ctx, start, stop)
+			}
+			c.lk.Lock()
+			for k := cl.i; k <= cl.j; k++ {
+				delete(c.inflight, k)
+				if err == nil {
+					c.bitmap.set(k)
+				}
+			}
+			c.lk.Unlock()
+			close(cl.f.done)
+			fetched = fetched || err == nil
+		}
+		if fetched {
+			if perr := c.persist(); perr != nil && err == nil {
+				err = perr
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, f := range waits {
+			select {
+			case <-f.done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if len(waits) == 0 {
+			return nil
+		}
+		// check the bitmap again; if a fetch we waited on failed, we retry it
+		// ourselves.
+	}
+}
+
+// fetch fetches [start, stop) from the mount into the cache file.
+func (c *sparseCache) fetch(ctx context.Context, start, stop int64) error {
+	rc, err := c.rf.FetchRange(ctx, start, stop-start)
+	if err != nil {
+		return fmt.Errorf("failed to fetch range [%d, %d): %w", start, stop, err)
+	}
+	defer rc.Close()
+
+	buf := make([]byte, 32<<10)
+	for off := start; off < stop; {
+		n, err := rc.Read(buf[:min64(int64(len(buf)), stop-off)])
+		if n > 0 {
+			if _, err := c.f.WriteAt(buf[:n], off); err != nil {
+				return fmt.Errorf("failed to write to sparse cache: %w", err)
+			}
+			off += int64(n)
+		}
+		if err == io.EOF && off < stop {
+			return fmt.Errorf("short read fetching range [%d, %d): got %d bytes", start, stop, off-start)
+		} else if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to fetch range [%d, %d): %w", start, stop, err)
+		}
+	}
+	return nil
+}
+
+// persist writes the bitmap to disk atomically. The cache file is synced
+// first, so that the bitmap never records chunks whose data could be lost in
+// a crash.
+func (c *sparseCache) persist() error {
+	c.persistLk.Lock()
+	defer c.persistLk.Unlock()
+
+	c.lk.Lock()
+	bz, err := json.Marshal(&c.bitmap)
+	c.lk.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := c.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync sparse cache: %w", err)
+	}
+	tmp := c.bitmapPath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to write sparse cache bitmap: %w", err)
+	}
+	if _, err := f.Write(bz); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write sparse cache bitmap: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to sync sparse cache bitmap: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write sparse cache bitmap: %w", err)
+	}
+	return os.Rename(tmp, c.bitmapPath)
+}
+
+// present returns the number of chunks present in the cache.
+func (c *sparseCache) present() int {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	var n int
+	for _, b := range c.bitmap.Chunks {
+		for ; b != 0; b &= b - 1 {
+			n++
+		}
+	}
+	return n
+}
+
+// sparseReader is a Reader over a sparse cache, fetching missing chunks as
+// they're read.
+type sparseReader struct {
+	ctx context.Context
+	c   *sparseCache
+	off int64 // offset for Read and Seek.
+}
+
+var _ Reader = (*sparseReader)(nil)
+
+func (r *sparseReader) ReadAt(p []byte, off int64) (int, error) {
+	size := r.c.bitmap.Size // immutable.
+	if off >= size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	var truncated bool
+	if end > size {
+		end, truncated = size, true
+		p = p[:end-off]
+	}
+	if err := r.c.ensure(r.ctx, off, end); err != nil {
+		return 0, err
+	}
+	n, err := r.c.f.ReadAt(p, off)
+	if err == nil && truncated {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *sparseReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.off)
+	r.off += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *sparseReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.c.bitmap.Size
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("invalid offset: %d", offset)
+	}
+	r.off = offset
+	return offset, nil
+}
+
+// Close is a no-op; the cache file is shared by all readers, and is owned by
+// the Upgrader.
+func (r *sparseReader) Close() error {
+	return nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
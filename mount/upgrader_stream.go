@@ -0,0 +1,212 @@
+package mount
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+)
+
+// WithStreaming enables streaming mode. In streaming mode, Fetch doesn't wait
+// for the transient copy to be downloaded. Instead, it returns a Reader over
+// the partial transient right away, whose reads block until the requested
+// range has been downloaded.
+//
+// Downloads started in streaming mode are not tied to the context of the
+// Fetch that triggered them, as they outlive it; they can be aborted by
+// calling Close.
+func WithStreaming() UpgradeOption {
+	return func(u *Upgrader) {
+		u.streaming = true
+	}
+}
+
+// fetchStreaming returns a Reader over the complete transient if it exists.
+// Otherwise, it returns a Reader over the partial transient, starting a
+// download if one isn't already in progress.
+func (u *Upgrader) fetchStreaming() (Reader, error) {
+	u.lk.Lock()
+	defer u.lk.Unlock()
+
+	if u.ready {
+		if _, err := os.Stat(u.path); err == nil {
+			log.Debugw("transient copy alive; not refetching", "shard", u.key, "path", u.path)
+			return u.open(u.path)
+		} else {
+			u.ready = false
+			log.Debugw("transient copy dead; removing and refetching", "shard", u.key, "path", u.path, "error", err)
+			if err := os.Remove(u.path); err != nil {
+				log.Warnw("refetch: failed to remove transient; garbage left behind", "shard", u.key, "dead_path", u.path, "error", err)
+			}
+		}
+	}
+
+	// open the partial for reading before the download starts, creating it
+	// if necessary; the download writes to the same file.
+	f, err := os.OpenFile(u.pathPartial, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open partial transient: %w", err)
+	}
+
+	dl := u.dl
+	if dl == nil {
+		dl = newDownload()
+		u.dl = dl
+		go u.stream(u.ctx, dl)
+	}
+	return &streamReader{f: f, dl: dl}, nil
+}
+
+// stream downloads the underlying mount into the partial transient, tracking
+// progress in dl. On success, the partial transient is promoted to the
+// complete transient.
+func (u *Upgrader) stream(ctx context.Context, dl *download) {
+	err := u.download(ctx, dl)
+
+	u.lk.Lock()
+	defer u.lk.Unlock()
+
+	// the download is over either way; the next fetch will start a new one if
+	// this one failed. Readers of this download can continue reading from
+	// the renamed file, as they hold it open.
+	u.dl = nil
+
+	if err != nil {
+		log.Warnw("failed to refetch", "shard", u.key, "error", err)
+		dl.finish(fmt.Errorf("mount fetch failed: %w", err))
+		return
+	}
+
+	// rename the partial file to a non-partial file, under the lock so that
+	// concurrent fetches always observe one of them.
+	if err := os.Rename(u.pathPartial, u.pathComplete); err != nil {
+		log.Warnw("failed to rename partial transient", "shard", u.key, "from_path", u.pathPartial, "to_path", u.pathComplete, "error", err)
+		dl.finish(fmt.Errorf("failed to rename partial transient: %w", err))
+		return
+	}
+	_ = os.Remove(u.pathPartialTag)
+	u.path = u.pathComplete
+	u.ready = true
+	dl.finish(nil)
+
+	log.Debugw("transient path updated after streaming", "shard", u.key, "new_path", u.pathComplete)
+}
+
+// download tracks the progress of a download, for readers to wait on.
+type download struct {
+	lk      sync.Mutex
+	cond    *sync.Cond
+	written int64 // guarded by lk
+	done    bool  // guarded by lk
+	err     error // guarded by lk
+}
+
+func newDownload() *download {
+	d := new(download)
+	d.cond = sync.NewCond(&d.lk)
+	return d
+}
+
+func (d *download) advance(n int64) {
+	d.lk.Lock()
+	d.written += n
+	d.lk.Unlock()
+	d.cond.Broadcast()
+}
+
+func (d *download) finish(err error) {
+	d.lk.Lock()
+	d.done = true
+	d.err = err
+	d.lk.Unlock()
+	d.cond.Broadcast()
+}
+
+// wait blocks until at least end bytes have been downloaded, or until the
+// download finishes. It returns the number of bytes downloaded so far, and
+// the error the download failed with, if any.
+func (d *download) wait(end int64) (int64, error) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	for d.written < end && !d.done {
+		d.cond.Wait()
+	}
+	return d.written, d.err
+}
+
+// downloadWriter writes to the partial transient, advancing the download.
+type downloadWriter struct {
+	f  *os.File
+	dl *download
+}
+
+func (w *downloadWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.dl.advance(int64(n))
+	return n, err
+}
+
+// streamReader is a Reader over a transient that's still being downloaded.
+type streamReader struct {
+	f   *os.File
+	dl  *download
+	off int64 // offset for Read and Seek.
+}
+
+var _ Reader = (*streamReader)(nil)
+
+func (r *streamReader) ReadAt(p []byte, off int64) (int, error) {
+	avail, err := r.dl.wait(off + int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	if off >= avail {
+		return 0, io.EOF // the download is complete.
+	}
+	var truncated bool
+	if max := avail - off; int64(len(p)) > max {
+		p, truncated = p[:max], true
+	}
+	n, err := r.f.ReadAt(p, off)
+	if err == nil && truncated {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.off)
+	r.off += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *streamReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		// we need to know the final size.
+		size, err := r.dl.wait(math.MaxInt64)
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("invalid offset: %d", offset)
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *streamReader) Close() error {
+	return r.f.Close()
+}
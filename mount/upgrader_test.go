@@ -18,6 +18,7 @@ import (
 
 	"github.com/filecoin-project/dagstore/testdata"
 	"github.com/filecoin-project/dagstore/throttle"
+	"github.com/filecoin-project/dagstore/transform"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
 )
@@ -46,11 +47,23 @@ func TestUpgrade(t *testing.T) {
 			expectedContentFilePath: "../" + testdata.RootPathCarV1,
 		},
 
+		"no transient file when fs.FS files have all capabilities": {
+			createMnt: func(t *testing.T, key string, rootDir string) Mount {
+				return &FSMount{FS: testdata.FS, Path: testdata.FSPathCarV1}
+			},
+			verify: func(t *testing.T, u *Upgrader, key string, rootDir string) {
+				fs, err := ioutil.ReadDir(rootDir)
+				require.NoError(t, err)
+				require.Empty(t, fs)
+			},
+			expectedContentFilePath: "../" + testdata.RootPathCarV1,
+		},
+
 		"transient file is copied from user's initial file": {
 			initial: "../" + testdata.RootPathCarV1,
 
 			createMnt: func(t *testing.T, key string, rootDir string) Mount {
-				return &FSMount{testdata.FS, testdata.FSPathCarV2} // purposely giving a different file here.
+				return &FSMount{FS: testdata.SequentialFS, Path: testdata.FSPathCarV2} // purposely giving a different file here.
 			},
 
 			verify: func(t *testing.T, u *Upgrader, key string, rootDir string) {
@@ -79,7 +92,7 @@ func TestUpgrade(t *testing.T) {
 		"delete transient": {
 			setup: nil,
 			createMnt: func(t *testing.T, key string, rootDir string) Mount {
-				return &FSMount{testdata.FS, testdata.FSPathCarV2}
+				return &FSMount{FS: testdata.SequentialFS, Path: testdata.FSPathCarV2}
 			},
 			verify: func(t *testing.T, u *Upgrader, key string, rootDir string) {
 				ustat, err := u.Stat(context.TODO())
@@ -142,7 +155,7 @@ func TestUpgrade(t *testing.T) {
 
 func TestUpgraderDeduplicatesRemote(t *testing.T) {
 	ctx := context.Background()
-	mnt := &Counting{Mount: &FSMount{testdata.FS, testdata.FSPathCarV2}}
+	mnt := &Counting{Mount: &FSMount{FS: testdata.SequentialFS, Path: testdata.FSPathCarV2}}
 
 	key := fmt.Sprintf("%d", rand.Uint64())
 	rootDir := t.TempDir()
@@ -361,3 +374,405 @@ func (b *blockingReaderMount) Serialize() *url.URL {
 func (b *blockingReaderMount) Deserialize(url *url.URL) error {
 	panic("implement me")
 }
+
+func TestUpgraderStreaming(t *testing.T) {
+	ctx := context.Background()
+	pr, pw := io.Pipe()
+	mnt := &pipeMount{r: pr}
+
+	u, err := Upgrade(mnt, throttle.Noop(), t.TempDir(), "foo", "", WithStreaming())
+	require.NoError(t, err)
+
+	// fetch returns right away, even though nothing has been downloaded.
+	rd, err := u.Fetch(ctx)
+	require.NoError(t, err)
+	require.Empty(t, u.TransientPath())
+
+	_, err = pw.Write(testdata.CarV2[:100])
+	require.NoError(t, err)
+
+	// data that has been downloaded can be read.
+	buf := make([]byte, 100)
+	n, err := rd.ReadAt(buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, 100, n)
+	require.Equal(t, testdata.CarV2[:100], buf)
+
+	// reads beyond the downloaded data block until it arrives.
+	var (
+		rn   int
+		rerr error
+		done = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		rn, rerr = rd.ReadAt(buf[:10], 100)
+	}()
+	select {
+	case <-done:
+		t.Fatal("read returned before data was downloaded")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// a concurrent fetch joins the ongoing download.
+	rd2, err := u.Fetch(ctx)
+	require.NoError(t, err)
+
+	_, err = pw.Write(testdata.CarV2[100:])
+	require.NoError(t, err)
+	<-done
+	require.NoError(t, rerr)
+	require.Equal(t, 10, rn)
+	require.NoError(t, pw.Close())
+
+	for _, r := range []Reader{rd, rd2} {
+		bz, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, testdata.CarV2, bz)
+		size, err := r.Seek(0, io.SeekEnd)
+		require.NoError(t, err)
+		require.EqualValues(t, len(testdata.CarV2), size)
+		require.NoError(t, r.Close())
+	}
+
+	// the transient is now complete, and served from disk.
+	require.NotEmpty(t, u.TransientPath())
+	rd, err = u.Fetch(ctx)
+	require.NoError(t, err)
+	_, ok := rd.(*os.File)
+	require.True(t, ok)
+	require.NoError(t, rd.Close())
+	require.EqualValues(t, 1, mnt.fetches)
+
+	t.Run("failure", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		u, err := Upgrade(&pipeMount{r: pr}, throttle.Noop(), t.TempDir(), "foo", "", WithStreaming())
+		require.NoError(t, err)
+		rd, err := u.Fetch(ctx)
+		require.NoError(t, err)
+		defer rd.Close()
+
+		pw.CloseWithError(errors.New("boom"))
+		_, err = rd.ReadAt(make([]byte, 10), 0)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "boom")
+		require.Empty(t, u.TransientPath())
+	})
+}
+
+// pipeMount is a remote mount that serves the data written to a pipe.
+type pipeMount struct {
+	r       *io.PipeReader
+	fetches int32
+}
+
+var _ Mount = (*pipeMount)(nil)
+
+func (p *pipeMount) Close() error {
+	return nil
+}
+
+func (p *pipeMount) Fetch(_ context.Context) (Reader, error) {
+	atomic.AddInt32(&p.fetches, 1)
+	return &blockingReader{r: p.r}, nil
+}
+
+func (p *pipeMount) Info() Info {
+	return Info{
+		Kind:             KindRemote,
+		AccessSequential: true,
+	}
+}
+
+func (p *pipeMount) Stat(_ context.Context) (Stat, error) {
+	return Stat{Exists: true}, nil
+}
+
+func (p *pipeMount) Serialize() *url.URL {
+	panic("implement me")
+}
+
+func (p *pipeMount) Deserialize(_ *url.URL) error {
+	panic("implement me")
+}
+
+func TestUpgraderSparseCache(t *testing.T) {
+	ctx := context.Background()
+	rootDir := t.TempDir()
+	mnt := &rangeMount{data: testdata.CarV2, etag: "v1"}
+
+	u, err := Upgrade(mnt, throttle.Noop(), rootDir, "foo", "", WithSparseCache(16))
+	require.NoError(t, err)
+
+	rd, err := u.Fetch(ctx)
+	require.NoError(t, err)
+	defer rd.Close()
+
+	// only the chunk containing the requested range is fetched.
+	buf := make([]byte, 10)
+	_, err = rd.ReadAt(buf, 100)
+	require.NoError(t, err)
+	require.Equal(t, testdata.CarV2[100:110], buf)
+	require.Equal(t, [][2]int64{{96, 16}}, mnt.ranges)
+	require.Equal(t, 1, u.sparse.present())
+
+	// adjacent missing chunks are fetched together; present chunks are not
+	// fetched again.
+	buf = make([]byte, 40)
+	_, err = rd.ReadAt(buf, 100)
+	require.NoError(t, err)
+	require.Equal(t, testdata.CarV2[100:140], buf)
+	require.Equal(t, [][2]int64{{96, 16}, {112, 32}}, mnt.ranges)
+
+	// no full transient is created.
+	require.Empty(t, u.TransientPath())
+	require.Len(t, u.ManagedFiles(), 2)
+
+	// the cache survives a restart.
+	require.NoError(t, u.Close())
+	u, err = Upgrade(mnt, throttle.Noop(), rootDir, "foo", "", WithSparseCache(16))
+	require.NoError(t, err)
+	rd, err = u.Fetch(ctx)
+	require.NoError(t, err)
+	_, err = rd.ReadAt(buf, 100)
+	require.NoError(t, err)
+	require.Equal(t, testdata.CarV2[100:140], buf)
+	require.Len(t, mnt.ranges, 2)
+
+	// but not a change of version of the resource.
+	require.NoError(t, u.Close())
+	mnt.etag = "v2"
+	u, err = Upgrade(mnt, throttle.Noop(), rootDir, "foo", "", WithSparseCache(16))
+	require.NoError(t, err)
+	rd, err = u.Fetch(ctx)
+	require.NoError(t, err)
+	_, err = rd.ReadAt(buf, 100)
+	require.NoError(t, err)
+	require.Equal(t, testdata.CarV2[100:140], buf)
+	require.Equal(t, [][2]int64{{96, 16}, {112, 32}, {96, 48}}, mnt.ranges)
+
+	// nor restarts if the version of the resource is unknown.
+	mnt.etag = ""
+	for i := 0; i < 2; i++ {
+		require.NoError(t, u.Close())
+		u, err = Upgrade(mnt, throttle.Noop(), rootDir, "foo", "", WithSparseCache(16))
+		require.NoError(t, err)
+		rd, err = u.Fetch(ctx)
+		require.NoError(t, err)
+		_, err = rd.ReadAt(buf, 100)
+		require.NoError(t, err)
+		require.Equal(t, testdata.CarV2[100:140], buf)
+	}
+	require.Equal(t, [][2]int64{{96, 16}, {112, 32}, {96, 48}, {96, 48}, {96, 48}}, mnt.ranges)
+
+	// reading everything works.
+	bz, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, testdata.CarV2, bz)
+
+	// deleting the transient removes the cache.
+	require.NoError(t, u.DeleteTransient())
+	for _, p := range u.ManagedFiles() {
+		_, err := os.Stat(p)
+		require.True(t, os.IsNotExist(err))
+	}
+
+	// resources of unknown size are fetched in full.
+	u, err = Upgrade(&rangeMount{data: testdata.CarV2, unknownSize: true}, throttle.Noop(), rootDir, "baz", "", WithSparseCache(16))
+	require.NoError(t, err)
+	rd, err = u.Fetch(ctx)
+	require.NoError(t, err)
+	bz, err = ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	require.Equal(t, testdata.CarV2, bz)
+	require.NotEmpty(t, u.TransientPath())
+	require.NoError(t, u.Close())
+
+	// the mode is ignored for mounts that don't support ranged reads.
+	u, err = Upgrade(&FSMount{FS: testdata.SequentialFS, Path: testdata.FSPathCarV2}, throttle.Noop(), rootDir, "bar", "", WithSparseCache(16))
+	require.NoError(t, err)
+	require.Zero(t, u.sparseChunkSize)
+}
+
+func TestUpgraderSparseCacheConcurrentReads(t *testing.T) {
+	ctx := context.Background()
+	mnt := &rangeMount{data: testdata.CarV2}
+
+	u, err := Upgrade(mnt, throttle.Noop(), t.TempDir(), "foo", "", WithSparseCache(16))
+	require.NoError(t, err)
+	defer u.Close()
+
+	rd, err := u.Fetch(ctx)
+	require.NoError(t, err)
+	defer rd.Close()
+
+	buf := make([]byte, 10)
+	_, err = rd.ReadAt(buf, 0)
+	require.NoError(t, err)
+
+	// block fetches from now on.
+	gate := make(chan struct{})
+	mnt.lk.Lock()
+	mnt.gate = gate
+	mnt.lk.Unlock()
+
+	// two readers of the same missing chunk.
+	errCh := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			buf := make([]byte, 10)
+			_, err := rd.ReadAt(buf, 100)
+			errCh <- err
+		}()
+	}
+	require.Eventually(t, func() bool {
+		mnt.lk.Lock()
+		defer mnt.lk.Unlock()
+		return len(mnt.ranges) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	// reads of cached chunks are not blocked by the pending fetch.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 10)
+		_, err := rd.ReadAt(buf, 0)
+		require.NoError(t, err)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("read of cached chunk blocked by pending fetch")
+	}
+
+	// release the fetch; both readers complete, and the chunk was fetched
+	// only once.
+	close(gate)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, <-errCh)
+	}
+	require.Equal(t, [][2]int64{{0, 16}, {96, 16}}, mnt.ranges)
+}
+
+// rangeMount is a remote mount serving a byte slice, which supports ranged
+// reads, and records the ranges requested.
+type rangeMount struct {
+	data        []byte
+	etag        string
+	unknownSize bool // if set, Stat reports a size of 0.
+
+	lk     sync.Mutex
+	ranges [][2]int64
+	gate   chan struct{} // if set, fetches block until it's closed.
+}
+
+var _ RangeFetcher = (*rangeMount)(nil)
+
+func (r *rangeMount) FetchRange(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	r.lk.Lock()
+	r.ranges = append(r.ranges, [2]int64{offset, length})
+	gate := r.gate
+	r.lk.Unlock()
+	if gate != nil {
+		select {
+		case <-gate:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return ioutil.NopCloser(bytes.NewReader(r.data[offset : offset+length])), nil
+}
+
+func (r *rangeMount) Close() error {
+	return nil
+}
+
+func (r *rangeMount) Fetch(_ context.Context) (Reader, error) {
+	return &NopCloser{Reader: bytes.NewReader(r.data)}, nil
+}
+
+func (r *rangeMount) Info() Info {
+	return Info{
+		Kind:             KindRemote,
+		AccessSequential: true,
+		AccessRanged:     true,
+	}
+}
+
+func (r *rangeMount) Stat(_ context.Context) (Stat, error) {
+	stat := Stat{Exists: true, Size: int64(len(r.data)), ETag: r.etag}
+	if r.unknownSize {
+		stat.Size = 0
+	}
+	return stat, nil
+}
+
+func (r *rangeMount) Serialize() *url.URL {
+	panic("implement me")
+}
+
+func (r *rangeMount) Deserialize(_ *url.URL) error {
+	panic("implement me")
+}
+
+func TestUpgraderEncryption(t *testing.T) {
+	ctx := context.Background()
+	rootDir := t.TempDir()
+	mnt := &FSMount{FS: testdata.SequentialFS, Path: testdata.FSPathCarV2}
+
+	enc, err := transform.NewAESGCM(bytes.Repeat([]byte{1}, 32), 1024)
+	require.NoError(t, err)
+
+	// streaming and sparse cache modes are disabled.
+	u, err := Upgrade(mnt, throttle.Noop(), rootDir, "foo", "", WithEncryption(enc), WithStreaming(), WithSparseCache(16))
+	require.NoError(t, err)
+	require.False(t, u.streaming)
+	require.Zero(t, u.sparseChunkSize)
+
+	rd, err := u.Fetch(ctx)
+	require.NoError(t, err)
+	bz, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, testdata.CarV2, bz)
+
+	// random access is served through decryption.
+	buf := make([]byte, 3000)
+	_, err = rd.ReadAt(buf, 1000)
+	require.NoError(t, err)
+	require.Equal(t, testdata.CarV2[1000:4000], buf)
+	require.NoError(t, rd.Close())
+
+	// the transient doesn't contain the plaintext, but reports its size.
+	path := u.TransientPath()
+	onDisk, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(onDisk, testdata.CarV2[1000:1100]))
+	stat, err := u.Stat(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, len(testdata.CarV2), stat.Size)
+
+	// the transient is reused by an upgrader with the same key.
+	u, err = Upgrade(mnt, throttle.Noop(), rootDir, "foo", path, WithEncryption(enc))
+	require.NoError(t, err)
+	require.Equal(t, path, u.TransientPath())
+
+	// but not by one with a different key.
+	other, err := transform.NewAESGCM(bytes.Repeat([]byte{2}, 32), 1024)
+	require.NoError(t, err)
+	u, err = Upgrade(mnt, throttle.Noop(), rootDir, "foo", path, WithEncryption(other))
+	require.NoError(t, err)
+	require.Empty(t, u.TransientPath())
+
+	// plain transients are ignored too.
+	u, err = Upgrade(mnt, throttle.Noop(), rootDir, "foo", "../"+testdata.RootPathCarV2, WithEncryption(enc))
+	require.NoError(t, err)
+	require.Empty(t, u.TransientPath())
+	rd, err = u.Fetch(ctx)
+	require.NoError(t, err)
+	bz, err = ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, testdata.CarV2, bz)
+	require.NoError(t, rd.Close())
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"sync"
 
+	"github.com/ipfs/go-cid"
+
 	"github.com/filecoin-project/dagstore/mount"
 	"github.com/filecoin-project/dagstore/shard"
 )
@@ -35,18 +37,27 @@ type Shard struct {
 
 	// Immutable fields.
 	// Safe to read outside the event loop without a lock.
-	d     *DAGStore       // backreference
-	key   shard.Key       // persisted in PersistedShard.Key
-	mount *mount.Upgrader // persisted in PersistedShard.URL (underlying)
-	lazy  bool            // persisted in PersistedShard.Lazy; whether this shard has lazy indexing
+	d    *DAGStore // backreference
+	key  shard.Key // persisted in PersistedShard.Key
+	lazy bool      // persisted in PersistedShard.Lazy; whether this shard has lazy indexing
+
+	expectedRoots []cid.Cid // persisted in PersistedShard.ExpectedRoots; roots to verify upon initialization.
+	expectedSize  int64     // persisted in PersistedShard.ExpectedSize; size to verify upon initialization.
+
+	indexing  *IndexingOpts // persisted in PersistedShard.Indexing; overrides Config.Indexing if set.
+	transform string        // persisted in PersistedShard.Transform; name of the transform applied on read, if any.
 
 	// Mutable fields.
 	// Cannot read/write outside event loop.
-	state ShardState // persisted in PersistedShard.State
-	err   error      // persisted in PersistedShard.Error; populated if shard state is errored.
+	state ShardState      // persisted in PersistedShard.State
+	err   error           // persisted in PersistedShard.Error; populated if shard state is errored.
+	mount *mount.Upgrader // persisted in PersistedShard.URL (underlying); only replaced by OpShardUpdateMount.
 
 	recoverOnNextAcquire bool // a shard marked in error state during initialization can be recovered on its first acquire.
 
+	cancelInit context.CancelFunc // cancels the ongoing (or last) initialization job.
+	destroyed  bool               // set once the shard is destroyed; later tasks for it are dropped.
+
 	// Waiters.
 	wRegister *waiter   // waiter for registration result.
 	wRecover  *waiter   // waiter for recovering an errored shard.
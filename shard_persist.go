@@ -4,10 +4,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net/url"
 
 	"github.com/filecoin-project/dagstore/mount"
 	"github.com/filecoin-project/dagstore/shard"
+	"github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
 )
 
@@ -19,22 +19,36 @@ type PersistedShard struct {
 	State         ShardState `json:"s"`
 	Lazy          bool       `json:"l"`
 	Error         string     `json:"e"`
+	ExpectedRoots []cid.Cid  `json:"r,omitempty"`
+	ExpectedSize  int64      `json:"z,omitempty"`
+
+	Indexing  *IndexingOpts `json:"x,omitempty"`
+	Transform string        `json:"f,omitempty"`
+
+	// MountState is the state of mounts implementing mount.StatefulMount,
+	// persisted alongside URL.
+	MountState []byte `json:"m,omitempty"`
 }
 
 // MarshalJSON returns a serialized representation of the state. It must be
 // called with a shard lock (read, at least), such as from inside the event
 // loop, as it accesses mutable state.
 func (s *Shard) MarshalJSON() ([]byte, error) {
-	u, err := s.d.mounts.Represent(s.mount)
+	u, state, err := s.d.mounts.RepresentWithState(s.mount)
 	if err != nil {
 		return nil, fmt.Errorf("failed to encode mount: %w", err)
 	}
 	ps := PersistedShard{
 		Key:           s.key.String(),
 		URL:           u.String(),
+		MountState:    state,
 		State:         s.state,
 		Lazy:          s.lazy,
 		TransientPath: s.mount.TransientPath(),
+		ExpectedRoots: s.expectedRoots,
+		ExpectedSize:  s.expectedSize,
+		Indexing:      s.indexing,
+		Transform:     s.transform,
 	}
 	if s.err != nil {
 		ps.Error = s.err.Error()
@@ -54,30 +68,53 @@ func (s *Shard) UnmarshalJSON(b []byte) error {
 	if err := json.Unmarshal(b, &ps); err != nil {
 		return err
 	}
+	return s.restore(&ps)
+}
+
+// restore restores the shard from its persisted representation, including
+// the mount.
+func (s *Shard) restore(ps *PersistedShard) error {
+	s.restoreFields(ps)
+
+	// restore mount.
+	mnt, err := s.d.instantiateMount(ps)
+	if err != nil {
+		return err
+	}
+	s.mount, err = s.d.upgradeMount(mnt, s.key, ps.TransientPath)
+	if err != nil {
+		return fmt.Errorf("failed to apply mount upgrader: %w", err)
+	}
+
+	return nil
+}
 
-	// restore basics.
+// restoreFields restores every persisted field of the shard other than the
+// mount, which requires instantiation (see instantiateMount).
+func (s *Shard) restoreFields(ps *PersistedShard) {
 	s.key = shard.KeyFromString(ps.Key)
 	s.state = ps.State
 	s.lazy = ps.Lazy
+	s.expectedRoots = ps.ExpectedRoots
+	s.expectedSize = ps.ExpectedSize
+	s.indexing = ps.Indexing
+	s.transform = ps.Transform
 	if ps.Error != "" {
 		s.err = errors.New(ps.Error)
 	}
+}
 
-	// restore mount.
-	u, err := url.Parse(ps.URL)
+// instantiateMount instantiates the mount of a persisted shard.
+func (d *DAGStore) instantiateMount(ps *PersistedShard) (mount.Mount, error) {
+	u, err := mount.ParseURL(ps.URL)
 	if err != nil {
-		return fmt.Errorf("failed to parse mount URL: %w", err)
+		return nil, fmt.Errorf("failed to parse mount URL: %w", err)
 	}
-	mnt, err := s.d.mounts.Instantiate(u)
+	mnt, err := d.mounts.InstantiateWithState(u, ps.MountState)
 	if err != nil {
-		return fmt.Errorf("failed to instantiate mount from URL: %w", err)
+		return nil, fmt.Errorf("failed to instantiate mount from URL: %w", err)
 	}
-	s.mount, err = mount.Upgrade(mnt, s.d.throttleReaadyFetch, s.d.config.TransientsDir, s.key.String(), ps.TransientPath)
-	if err != nil {
-		return fmt.Errorf("failed to apply mount upgrader: %w", err)
-	}
-
-	return nil
+	return mnt, nil
 }
 
 // persist persists the shard's state into the supplied Datastore. It calls
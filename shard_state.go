@@ -1,5 +1,12 @@
 package dagstore
 
+import (
+	"errors"
+	"fmt"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
 type ShardState byte
 
 const (
@@ -19,6 +26,12 @@ const (
 	// currently actively serving requests.
 	ShardStateServing
 
+	// ShardStateUnavailable indicates that the shard has been initialized, but
+	// its mount is temporarily unreachable, and it has no transient copy to
+	// serve from. The shard becomes available again once the mount is
+	// reachable. See Config.MountCheckInterval.
+	ShardStateUnavailable
+
 	// ShardStateRecovering indicates that the shard is recovering from an
 	// errored state. Such recoveries are always initiated by the user through
 	// DAGStore.RecoverShard().
@@ -34,18 +47,154 @@ const (
 )
 
 func (ss ShardState) String() string {
-	strs := [...]string{
-		ShardStateNew:          "ShardStateNew",
-		ShardStateInitializing: "ShardStateInitializing",
-		ShardStateAvailable:    "ShardStateAvailable",
-		ShardStateServing:      "ShardStateServing",
-		ShardStateRecovering:   "ShardStateRecovering",
-		ShardStateErrored:      "ShardStateErrored",
-		ShardStateUnknown:      "ShardStateUnknown",
+	switch ss {
+	case ShardStateNew:
+		return "ShardStateNew"
+	case ShardStateInitializing:
+		return "ShardStateInitializing"
+	case ShardStateAvailable:
+		return "ShardStateAvailable"
+	case ShardStateServing:
+		return "ShardStateServing"
+	case ShardStateUnavailable:
+		return "ShardStateUnavailable"
+	case ShardStateRecovering:
+		return "ShardStateRecovering"
+	case ShardStateErrored:
+		return "ShardStateErrored"
+	case ShardStateUnknown:
+		return "ShardStateUnknown"
+	default:
+		return fmt.Sprintf("ShardState(%d)", byte(ss))
 	}
-	if ss < 0 || int(ss) >= len(strs) {
-		// safety comes first.
-		return "__undefined__"
+}
+
+// ErrIllegalTransition is matched by every *TransitionError.
+var ErrIllegalTransition = errors.New("illegal shard state transition")
+
+// TransitionError is the error delivered to the application when it requests
+// an operation that can't be performed in the current state of the shard,
+// e.g. recovering a shard that isn't errored. See transitions.
+type TransitionError struct {
+	Op    OpType
+	State ShardState
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("%s: %s in state %s", ErrIllegalTransition, e.Op, e.State)
+}
+
+func (e *TransitionError) Unwrap() error {
+	return ErrIllegalTransition
+}
+
+// ShardTransition is an event describing a change in the state of a shard
+// caused by an operation. See Config.TransitionCh.
+type ShardTransition struct {
+	Key  shard.Key
+	Op   OpType
+	From ShardState
+	To   ShardState
+}
+
+// transitions is the table of legal shard state transitions. For every
+// operation, it maps the states in which the operation can be processed to
+// the states the shard may be in once it has been processed. Operations are
+// illegal in the states that aren't listed.
+//
+// Some operations are further restricted by the references to the shard; e.g.
+// shards with active references can't be destroyed.
+var transitions = map[OpType]map[ShardState][]ShardState{
+	OpShardRegister: {
+		// lazy shards remain new until acquired; others queue initialization.
+		ShardStateNew: {ShardStateNew},
+	},
+	OpShardInitialize: {
+		ShardStateNew: {ShardStateInitializing},
+	},
+	OpShardMakeAvailable: {
+		// shards with waiting acquirers become serving right away.
+		ShardStateInitializing: {ShardStateAvailable, ShardStateServing},
+		ShardStateRecovering:   {ShardStateAvailable, ShardStateServing},
+		ShardStateUnavailable:  {ShardStateAvailable, ShardStateServing},
+	},
+	OpShardAcquire: {
+		// acquirers wait for shards that aren't ready yet.
+		ShardStateNew:          {ShardStateNew},
+		ShardStateInitializing: {ShardStateInitializing},
+		ShardStateRecovering:   {ShardStateRecovering},
+		ShardStateAvailable:    {ShardStateServing},
+		ShardStateServing:      {ShardStateServing},
+		// acquirers fail, or wait for recovery or for the mount.
+		ShardStateUnavailable: {ShardStateUnavailable},
+		ShardStateErrored:     {ShardStateErrored},
+	},
+	OpShardRelease: {
+		ShardStateServing: {ShardStateServing, ShardStateAvailable},
+		// references acquired before the shard failed or started recovering
+		// (which may have completed in the meantime).
+		ShardStateErrored:    {ShardStateErrored},
+		ShardStateRecovering: {ShardStateRecovering},
+		ShardStateAvailable:  {ShardStateAvailable},
+	},
+	OpShardFail: {
+		ShardStateNew:          {ShardStateErrored},
+		ShardStateInitializing: {ShardStateErrored},
+		ShardStateAvailable:    {ShardStateErrored},
+		ShardStateServing:      {ShardStateErrored},
+		ShardStateUnavailable:  {ShardStateErrored},
+		ShardStateRecovering:   {ShardStateErrored},
+		ShardStateErrored:      {ShardStateErrored},
+	},
+	OpShardRecover: {
+		ShardStateErrored: {ShardStateRecovering},
+	},
+	OpShardDestroy: {
+		// the shard is removed from the DAG store in its current state.
+		ShardStateNew:          {ShardStateNew},
+		ShardStateInitializing: {ShardStateInitializing},
+		ShardStateAvailable:    {ShardStateAvailable},
+		ShardStateUnavailable:  {ShardStateUnavailable},
+		ShardStateRecovering:   {ShardStateRecovering},
+		ShardStateErrored:      {ShardStateErrored},
+	},
+	OpShardUpdateMount: {
+		// shards are reset to new, unless their index is kept.
+		ShardStateNew:         {ShardStateNew},
+		ShardStateAvailable:   {ShardStateNew, ShardStateAvailable},
+		ShardStateUnavailable: {ShardStateNew, ShardStateUnavailable},
+		ShardStateErrored:     {ShardStateNew, ShardStateErrored},
+	},
+	OpShardMountUnreachable: {
+		// shards that were acquired or fetched in the meantime stay available.
+		ShardStateAvailable: {ShardStateUnavailable, ShardStateAvailable},
+	},
+	OpShardMountReachable: {
+		// the shard is made available by a subsequent OpShardMakeAvailable.
+		ShardStateUnavailable: {ShardStateUnavailable},
+	},
+}
+
+// checkTransition returns a *TransitionError if op is illegal in state.
+func checkTransition(op OpType, state ShardState) error {
+	if _, ok := transitions[op][state]; !ok {
+		return &TransitionError{Op: op, State: state}
+	}
+	return nil
+}
+
+// panicOnIllegalTransition makes the event loop panic when a shard performs a
+// transition missing from the transition table, instead of logging an error.
+// Tests set it, so that such bugs fail them.
+var panicOnIllegalTransition = false
+
+// legalTransition returns whether processing op in state from may leave the
+// shard in state to.
+func legalTransition(op OpType, from, to ShardState) bool {
+	for _, s := range transitions[op][from] {
+		if s == to {
+			return true
+		}
 	}
-	return strs[ss]
+	return false
 }
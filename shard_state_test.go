@@ -1,11 +1,43 @@
 package dagstore
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"testing/quick"
+	"time"
 
+	"github.com/ipfs/go-datastore"
 	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+	"github.com/filecoin-project/dagstore/testdata"
 )
 
+var randomOpsSeed = flag.Int64("random-ops-seed", 1, "seed of TestTransitionsRandomOps")
+
+func init() {
+	// transitions missing from the transition table fail tests.
+	panicOnIllegalTransition = true
+}
+
+// allStates are the states that shards can be in.
+var allStates = []ShardState{
+	ShardStateNew,
+	ShardStateInitializing,
+	ShardStateAvailable,
+	ShardStateServing,
+	ShardStateUnavailable,
+	ShardStateRecovering,
+	ShardStateErrored,
+}
+
 func TestShardStates(t *testing.T) {
 	ss := ShardStateRecovering
 	require.Equal(t, "ShardStateRecovering", ss.String())
@@ -14,5 +46,164 @@ func TestShardStates(t *testing.T) {
 	require.Equal(t, "ShardStateInitializing", ss.String())
 
 	ss = ShardState(201)
-	require.Equal(t, "", ss.String())
+	require.Equal(t, "ShardState(201)", ss.String())
+}
+
+func TestTransitionTable(t *testing.T) {
+	known := map[ShardState]bool{}
+	for _, s := range allStates {
+		known[s] = true
+	}
+
+	for op := OpShardRegister; op <= OpShardMountReachable; op++ {
+		from, ok := transitions[op]
+		require.True(t, ok, "no transitions for %s", op)
+		require.NotEmpty(t, from, "no transitions for %s", op)
+		for state, to := range from {
+			require.True(t, known[state], "unknown state %s for %s", state, op)
+			require.NotEmpty(t, to, "no target states for %s in %s", op, state)
+			for _, s := range to {
+				require.True(t, known[s], "unknown target state %s for %s in %s", s, op, state)
+			}
+		}
+	}
+
+	// operations are legal exactly in the states listed in the table, and
+	// illegal ones fail with a *TransitionError.
+	check := func(op uint8, state byte) bool {
+		o, s := OpType(op%uint8(OpShardMountReachable+1)), ShardState(state)
+		_, listed := transitions[o][s]
+		err := checkTransition(o, s)
+		if listed {
+			return err == nil
+		}
+		var terr *TransitionError
+		return errors.Is(err, ErrIllegalTransition) && errors.As(err, &terr) && terr.Op == o && terr.State == s
+	}
+	require.NoError(t, quick.Check(check, &quick.Config{MaxCount: 10000}))
+
+	// every state is reachable from ShardStateNew, and every state can lead
+	// back to ShardStateAvailable, i.e. there are no dead ends.
+	reachable := func(from ShardState) map[ShardState]bool {
+		seen := map[ShardState]bool{from: true}
+		for queue := []ShardState{from}; len(queue) > 0; queue = queue[1:] {
+			for _, to := range transitions {
+				for _, s := range to[queue[0]] {
+					if !seen[s] {
+						seen[s] = true
+						queue = append(queue, s)
+					}
+				}
+			}
+		}
+		return seen
+	}
+	for _, s := range allStates {
+		require.True(t, reachable(ShardStateNew)[s], "%s is unreachable", s)
+		require.True(t, reachable(s)[ShardStateAvailable], "%s can't become available", s)
+	}
+}
+
+func TestTransitionsRandomOps(t *testing.T) {
+	// override the seed with -args -random-ops-seed=<seed>.
+	t.Logf("seed: %d", *randomOpsSeed)
+	rnd := rand.New(rand.NewSource(*randomOpsSeed))
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sample.car")
+	moved := filepath.Join(dir, "moved.car")
+	require.NoError(t, os.WriteFile(path, testdata.CarV2, 0644))
+
+	transitionsCh := make(chan ShardTransition, 128)
+	var events []ShardTransition
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for e := range transitionsCh {
+			events = append(events, e)
+		}
+	}()
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:      testRegistry(t),
+		TransientsDir:      t.TempDir(),
+		Datastore:          datastore.NewMapDatastore(),
+		TransitionCh:       transitionsCh,
+		MountCheckInterval: 5 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+
+	k := shard.KeyFromString("foo")
+	ch := make(chan ShardResult, 1)
+	require.NoError(t, dagst.RegisterShard(context.Background(), k, &mount.FileMount{Path: path}, ch, RegisterOpts{}))
+	require.NoError(t, (<-ch).Error)
+
+	// collect the accessors of successful acquisitions.
+	var (
+		lk        sync.Mutex
+		accessors []*ShardAccessor
+	)
+	results := make(chan ShardResult, 1024)
+	acquired := make(chan struct{})
+	go func() {
+		defer close(acquired)
+		for res := range results {
+			if res.Accessor != nil {
+				lk.Lock()
+				accessors = append(accessors, res.Accessor)
+				lk.Unlock()
+			}
+		}
+	}()
+
+	ctx := context.Background()
+	for i := 0; i < 300; i++ {
+		switch rnd.Intn(9) {
+		case 0:
+			require.NoError(t, dagst.AcquireShard(ctx, k, results, AcquireOpts{}))
+		case 1:
+			ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+			defer cancel()
+			require.NoError(t, dagst.AcquireShard(ctx, k, results, AcquireOpts{WaitUnavailable: true}))
+		case 2:
+			lk.Lock()
+			if n := len(accessors); n > 0 {
+				i := rnd.Intn(n)
+				require.NoError(t, accessors[i].Close())
+				accessors = append(accessors[:i], accessors[i+1:]...)
+			}
+			lk.Unlock()
+		case 3:
+			_ = os.Rename(path, moved)
+		case 4:
+			_ = os.Rename(moved, path)
+		case 5:
+			require.NoError(t, dagst.RecoverShard(ctx, k, nil, RecoverOpts{}))
+		case 6:
+			// fails synchronously if the file is missing.
+			_ = dagst.UpdateMount(ctx, k, &mount.FileMount{Path: path}, nil, UpdateMountOpts{KeepIndex: rnd.Intn(2) == 0})
+		case 7:
+			_, err := dagst.GC(ctx)
+			require.NoError(t, err)
+		case 8:
+			time.Sleep(time.Duration(rnd.Intn(5)) * time.Millisecond)
+		}
+	}
+
+	require.NoError(t, dagst.Close())
+	close(transitionsCh)
+	close(results)
+	<-collected
+	<-acquired
+
+	// every transition is in the table, and no transition went unreported.
+	require.NotEmpty(t, events)
+	prev := ShardStateNew
+	for _, e := range events {
+		require.Equal(t, k, e.Key)
+		require.True(t, legalTransition(e.Op, e.From, e.To), "illegal transition: %s from %s to %s", e.Op, e.From, e.To)
+		require.Equal(t, prev, e.From, "unreported transition to %s", e.From)
+		prev = e.To
+	}
 }
@@ -0,0 +1,45 @@
+package dagstore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/transform"
+)
+
+// fetch fetches the data of a shard from the supplied mount, applying the
+// transform of the shard, if any.
+func (d *DAGStore) fetch(ctx context.Context, s *Shard, mnt mount.Mount) (mount.Reader, error) {
+	var tf transform.Transform
+	if s.transform != "" {
+		var err error
+		if tf, err = d.config.TransformRegistry.Get(s.transform); err != nil {
+			return nil, err
+		}
+	}
+	r, err := fetchTransformed(ctx, mnt, tf)
+	if err != nil {
+		// keep the secrets of the mount out of logs and results.
+		return nil, mount.RedactError(err, d.mounts.Secrets(mnt)...)
+	}
+	return r, nil
+}
+
+// fetchTransformed fetches from the mount, and applies the transform to the
+// reader if it's not nil.
+func fetchTransformed(ctx context.Context, mnt mount.Mount, tf transform.Transform) (mount.Reader, error) {
+	r, err := mnt.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if tf == nil {
+		return r, nil
+	}
+	tr, err := tf.Apply(r)
+	if err != nil {
+		_ = r.Close()
+		return nil, fmt.Errorf("failed to apply transform: %w", err)
+	}
+	return tr, nil
+}
@@ -0,0 +1,181 @@
+package dagstore
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore/index"
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+	"github.com/filecoin-project/dagstore/testdata"
+	"github.com/filecoin-project/dagstore/transform"
+)
+
+func TestRegisterWithTransform(t *testing.T) {
+	aes, err := transform.NewAESGCM(bytes.Repeat([]byte{7}, 32), 1024)
+	require.NoError(t, err)
+
+	// encrypt the CARv2 into a directory served by the fs mount.
+	dir := t.TempDir()
+	var enc bytes.Buffer
+	require.NoError(t, aes.Encrypt(&enc, bytes.NewReader(testdata.CarV2)))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sealed.car"), enc.Bytes(), 0644))
+
+	fsys := os.DirFS(dir)
+	idx, err := index.NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+	newDAGStore := func(store datastore.Batching, transients string) *DAGStore {
+		mounts := mount.NewRegistry()
+		require.NoError(t, mounts.Register("fs", &mount.FSMount{FS: fsys}))
+		transforms := transform.NewRegistry()
+		require.NoError(t, transforms.Register("aes", aes))
+
+		dagst, err := NewDAGStore(Config{
+			MountRegistry:     mounts,
+			TransformRegistry: transforms,
+			TransientsDir:     transients,
+			Datastore:         store,
+			IndexRepo:         idx,
+		})
+		require.NoError(t, err)
+		require.NoError(t, dagst.Start(context.Background()))
+		return dagst
+	}
+
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	transients := t.TempDir()
+	dagst := newDAGStore(store, transients)
+
+	mnt := &mount.FSMount{FS: fsys, Path: "sealed.car"}
+	k := shard.KeyFromString("sealed")
+
+	// unknown transforms are rejected upfront.
+	err = dagst.RegisterShard(context.Background(), k, mnt, nil, RegisterOpts{Transform: "rot13"})
+	require.ErrorIs(t, err, transform.ErrUnknownTransform)
+
+	ch := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), k, mnt, ch, RegisterOpts{Transform: "aes"})
+	require.NoError(t, err)
+	res := <-ch
+	require.NoError(t, res.Error)
+
+	// the transform is persisted along with the shard.
+	info, err := dagst.GetShardInfo(k)
+	require.NoError(t, err)
+	require.Equal(t, ShardStateAvailable, info.ShardState)
+	bz, err := dagst.shards[k].MarshalJSON()
+	require.NoError(t, err)
+	require.Contains(t, string(bz), `"f":"aes"`)
+
+	acquire := func(dagst *DAGStore) {
+		ch := make(chan ShardResult, 1)
+		err := dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{})
+		require.NoError(t, err)
+		res := <-ch
+		require.NoError(t, res.Error)
+		defer res.Accessor.Close()
+
+		bs, err := res.Accessor.Blockstore()
+		require.NoError(t, err)
+		blk, err := bs.Get(testdata.RootCID)
+		require.NoError(t, err)
+		require.Equal(t, testdata.RootCID, blk.Cid())
+	}
+	acquire(dagst)
+
+	// exporting the shard with its data and importing it elsewhere keeps it
+	// readable; the bundle holds the data as served by the mount, so the
+	// transform is applied once. The mount is removed to ensure that the
+	// bundled data is used.
+	var bundle bytes.Buffer
+	require.NoError(t, dagst.ExportShard(context.Background(), k, &bundle, ExportShardOpts{IncludeData: true}))
+	require.NoError(t, os.Rename(filepath.Join(dir, "sealed.car"), filepath.Join(dir, "moved.car")))
+	imported := newDAGStore(dssync.MutexWrap(datastore.NewMapDatastore()), t.TempDir())
+	defer imported.Close()
+	require.NoError(t, imported.ImportShard(context.Background(), bytes.NewReader(bundle.Bytes()), ch, ImportShardOpts{}))
+	res = <-ch
+	require.NoError(t, res.Error)
+	acquire(imported)
+	require.NoError(t, os.Rename(filepath.Join(dir, "moved.car"), filepath.Join(dir, "sealed.car")))
+
+	// the shard is still decrypted after a restart.
+	require.NoError(t, dagst.Close())
+	dagst = newDAGStore(store, t.TempDir())
+	defer dagst.Close()
+	acquire(dagst)
+}
+
+func TestEncryptedTransients(t *testing.T) {
+	_, err := NewDAGStore(Config{
+		TransientsDir: t.TempDir(),
+		TransientsKey: []byte("too short"),
+	})
+	require.Error(t, err)
+
+	_, err = NewDAGStore(Config{
+		TransientsDir:       t.TempDir(),
+		TransientsKey:       bytes.Repeat([]byte{7}, 32),
+		StreamingTransients: true,
+	})
+	require.Error(t, err)
+
+	dir := t.TempDir()
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: dir,
+		TransientsKey: bytes.Repeat([]byte{7}, 32),
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+	defer dagst.Close()
+
+	k := shard.KeyFromString("foo")
+	ch := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), k, carv2mnt, ch, RegisterOpts{})
+	require.NoError(t, err)
+	res := <-ch
+	require.NoError(t, res.Error)
+
+	err = dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{})
+	require.NoError(t, err)
+	res = <-ch
+	require.NoError(t, res.Error)
+	defer res.Accessor.Close()
+
+	bs, err := res.Accessor.Blockstore()
+	require.NoError(t, err)
+	blk, err := bs.Get(testdata.RootCID)
+	require.NoError(t, err)
+	require.Equal(t, testdata.RootCID, blk.Cid())
+
+	// the transient is encrypted.
+	p := dagst.shards[k].mount.TransientPath()
+	require.NotEmpty(t, p)
+	bz, err := os.ReadFile(p)
+	require.NoError(t, err)
+	require.NotEqual(t, testdata.CarV2[:64], bz[:64])
+
+	// transients of the same data are encrypted with different keys.
+	k2 := shard.KeyFromString("bar")
+	err = dagst.RegisterShard(context.Background(), k2, carv2mnt, ch, RegisterOpts{})
+	require.NoError(t, err)
+	res = <-ch
+	require.NoError(t, res.Error)
+	accessors := acquireShard(t, dagst, k2, 1)
+	defer releaseAll(t, dagst, k2, accessors)
+
+	p2 := dagst.shards[k2].mount.TransientPath()
+	require.NotEmpty(t, p2)
+	bz2, err := os.ReadFile(p2)
+	require.NoError(t, err)
+	require.Equal(t, len(bz), len(bz2))
+	require.NotEqual(t, bz[:64], bz2[:64])
+	require.NotEqual(t, bz[len(bz)-64:], bz2[len(bz2)-64:])
+}
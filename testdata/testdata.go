@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"embed"
 	"fmt"
+	"io/fs"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-car/v2"
@@ -23,6 +24,10 @@ var (
 	//go:embed files/*
 	FS embed.FS
 
+	// SequentialFS serves the test files sequentially: they don't support
+	// seeking or random access, so mounts over it need to be upgraded.
+	SequentialFS = Sequential(FS)
+
 	CarV1 []byte
 	CarV2 []byte
 	Junk  []byte
@@ -63,3 +68,21 @@ func init() {
 	}
 	RootCID = roots[0]
 }
+
+// Sequential returns an fs.FS whose files only support sequential reads,
+// backed by fsys.
+func Sequential(fsys fs.FS) fs.FS {
+	return sequentialFS{fsys}
+}
+
+type sequentialFS struct {
+	fs fs.FS
+}
+
+func (s sequentialFS) Open(name string) (fs.File, error) {
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ fs.File }{f}, nil
+}
@@ -0,0 +1,365 @@
+package transform
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// DefaultChunkSize is the plaintext size of the chunks that AESGCM encrypts
+// data in, if no chunk size is specified.
+const DefaultChunkSize = 64 << 10 // 64KiB
+
+// aesgcmMagic identifies data encrypted by AESGCM, and the version of the
+// format. Version 1 used a 32-bit random nonce prefix under the supplied key,
+// and is no longer supported.
+var aesgcmMagic = []byte("DAGSGCM2")
+
+// aesgcmKeyInfo binds the keys derived by AESGCM to their purpose.
+var aesgcmKeyInfo = []byte("dagstore/transform/aesgcm stream key")
+
+const (
+	// aesgcmSaltLen is the length of the random salt that the key of every
+	// stream is derived from.
+	aesgcmSaltLen = 32
+	// aesgcmHeaderLen is the length of the header: magic, chunk size, and
+	// salt.
+	aesgcmHeaderLen = 8 + 4 + aesgcmSaltLen
+	// aesgcmTagLen is the length of the authentication tag of every chunk.
+	aesgcmTagLen = 16
+)
+
+// ErrAuthentication is returned when encrypted data fails authentication,
+// i.e. it was tampered with, truncated, or encrypted with a different key.
+var ErrAuthentication = errors.New("encrypted data failed authentication")
+
+// AESGCM is a Transform that decrypts data encrypted in chunks with AES-GCM,
+// preserving random access: every chunk is authenticated and decrypted
+// independently.
+//
+// The encrypted format consists of a header, followed by the chunks. The
+// header holds a magic string, the plaintext chunk size, and a random 256-bit
+// salt. Every encrypted stream uses its own key, derived from the supplied key
+// and the salt with HKDF-SHA256. Every chunk is sealed under the stream key
+// with a nonce made of the chunk index, and with the header and a flag marking
+// the final chunk as additional data, so that reordering, truncating, or
+// splicing chunks is detected.
+//
+// Deriving a key per stream means that nonces only need to be unique within a
+// stream, which the chunk index guarantees. The supplied key can therefore
+// encrypt any practical number of streams: two streams only share a key if
+// their salts collide, which is negligibly likely until about 2^100 streams.
+// A stream is limited to 2^64 chunks.
+//
+// Use NewWriter or Encrypt to produce encrypted data.
+type AESGCM struct {
+	key       []byte
+	chunkSize int
+}
+
+var _ Transform = (*AESGCM)(nil)
+
+// NewAESGCM creates an AESGCM transform with the supplied AES key, which must
+// be 16, 24 or 32 bytes long. chunkSize is the plaintext chunk size used when
+// encrypting; 0 selects DefaultChunkSize. Decryption uses the chunk size
+// recorded in the encrypted data.
+func NewAESGCM(key []byte, chunkSize int) (*AESGCM, error) {
+	if _, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	return &AESGCM{key: append([]byte(nil), key...), chunkSize: chunkSize}, nil
+}
+
+// streamAEAD returns the AEAD of the stream with the supplied salt, keyed
+// with a key of the same length as the supplied key.
+func (a *AESGCM) streamAEAD(salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, len(a.key))
+	if _, err := io.ReadFull(hkdf.New(sha256.New, a.key, salt, aesgcmKeyInfo), key); err != nil {
+		return nil, fmt.Errorf("failed to derive stream key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Apply returns a reader over the decrypted data. r must support seeking and
+// random access.
+func (a *AESGCM) Apply(r Reader) (Reader, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine size of encrypted data: %w", err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind encrypted data: %w", err)
+	}
+	dr, err := a.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	dr.closer = r
+	return dr, nil
+}
+
+// NewReader returns a reader over the decrypted contents of the size bytes of
+// encrypted data in ra.
+func (a *AESGCM) NewReader(ra io.ReaderAt, size int64) (*DecryptReader, error) {
+	hdr := make([]byte, aesgcmHeaderLen)
+	if _, err := ra.ReadAt(hdr, 0); err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	if !bytes.Equal(hdr[:len(aesgcmMagic)], aesgcmMagic) {
+		return nil, fmt.Errorf("unrecognized encryption header")
+	}
+	chunkSize := int64(binary.BigEndian.Uint32(hdr[8:12]))
+	if chunkSize == 0 {
+		return nil, fmt.Errorf("invalid chunk size in encryption header")
+	}
+	aead, err := a.streamAEAD(hdr[12:])
+	if err != nil {
+		return nil, err
+	}
+
+	// every chunk but the last is full; the last one may be empty.
+	payload := size - aesgcmHeaderLen
+	n, rem := payload/(chunkSize+aesgcmTagLen), payload%(chunkSize+aesgcmTagLen)
+	r := &DecryptReader{aead: aead, ra: ra, hdr: hdr, chunkSize: chunkSize, cached: -1}
+	switch {
+	case payload < aesgcmTagLen:
+		return nil, fmt.Errorf("%w: encrypted data too short", ErrAuthentication)
+	case rem == 0:
+		r.nchunks, r.size = n, n*chunkSize
+	case rem >= aesgcmTagLen:
+		r.nchunks, r.size = n+1, n*chunkSize+rem-aesgcmTagLen
+	default:
+		return nil, fmt.Errorf("%w: invalid encrypted data size %d", ErrAuthentication, size)
+	}
+	return r, nil
+}
+
+// Encrypt encrypts all data from r into w.
+func (a *AESGCM) Encrypt(w io.Writer, r io.Reader) error {
+	ew, err := a.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(ew, r); err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+// NewWriter returns a writer that encrypts data into w. The writer must be
+// closed to write the final chunk; it doesn't close w.
+func (a *AESGCM) NewWriter(w io.Writer) (*EncryptWriter, error) {
+	hdr := make([]byte, aesgcmHeaderLen)
+	copy(hdr, aesgcmMagic)
+	binary.BigEndian.PutUint32(hdr[8:12], uint32(a.chunkSize))
+	if _, err := rand.Read(hdr[12:]); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	aead, err := a.streamAEAD(hdr[12:])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &EncryptWriter{
+		aead: aead,
+		w:    w,
+		hdr:  hdr,
+		buf:  make([]byte, 0, a.chunkSize),
+	}, nil
+}
+
+// EncryptWriter encrypts data written to it in chunks.
+type EncryptWriter struct {
+	aead  cipher.AEAD
+	w     io.Writer
+	hdr   []byte
+	buf   []byte
+	out   []byte
+	index uint64
+	err   error
+}
+
+func (e *EncryptWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 && e.err == nil {
+		// only seal a full chunk once more data arrives, as we don't know
+		// whether it's the final one until then.
+		if len(e.buf) == cap(e.buf) {
+			e.err = e.seal(false)
+			continue
+		}
+		c := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p, n = p[c:], n+c
+	}
+	return n, e.err
+}
+
+// Close seals the final chunk.
+func (e *EncryptWriter) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	e.err = e.seal(true)
+	if e.err == nil {
+		e.err = errors.New("writer closed")
+		return nil
+	}
+	return e.err
+}
+
+func (e *EncryptWriter) seal(final bool) error {
+	e.out = e.aead.Seal(e.out[:0], nonce(e.index), e.buf, aad(e.hdr, final))
+	e.buf = e.buf[:0]
+	e.index++
+	_, err := e.w.Write(e.out)
+	return err
+}
+
+// DecryptReader is a Reader over data encrypted by AESGCM. It's safe for
+// concurrent use through ReadAt.
+type DecryptReader struct {
+	aead      cipher.AEAD
+	ra        io.ReaderAt
+	closer    io.Closer
+	hdr       []byte
+	chunkSize int64
+	nchunks   int64
+	size      int64 // of the plaintext.
+
+	off int64 // for Read and Seek.
+
+	// lk guards the last decrypted chunk.
+	lk     sync.Mutex
+	cached int64
+	plain  []byte
+	sealed []byte
+}
+
+var _ Reader = (*DecryptReader)(nil)
+
+// Size returns the size of the decrypted data.
+func (d *DecryptReader) Size() int64 {
+	return d.size
+}
+
+func (d *DecryptReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("invalid offset: %d", off)
+	}
+	d.lk.Lock()
+	defer d.lk.Unlock()
+
+	var n int
+	for n < len(p) {
+		if off >= d.size {
+			return n, io.EOF
+		}
+		i := off / d.chunkSize
+		if err := d.decrypt(i); err != nil {
+			return n, err
+		}
+		c := copy(p[n:], d.plain[off-i*d.chunkSize:])
+		n, off = n+c, off+int64(c)
+	}
+	return n, nil
+}
+
+// decrypt decrypts chunk i into d.plain, unless it's already there.
+func (d *DecryptReader) decrypt(i int64) error {
+	if d.cached == i {
+		return nil
+	}
+	plainLen := d.chunkSize
+	if i == d.nchunks-1 {
+		plainLen = d.size - i*d.chunkSize
+	}
+	if cap(d.sealed) < int(plainLen)+aesgcmTagLen {
+		d.sealed = make([]byte, plainLen+aesgcmTagLen)
+	}
+	d.sealed = d.sealed[:plainLen+aesgcmTagLen]
+	if n, err := d.ra.ReadAt(d.sealed, aesgcmHeaderLen+i*(d.chunkSize+aesgcmTagLen)); n < len(d.sealed) {
+		return fmt.Errorf("failed to read encrypted chunk %d: %w", i, err)
+	}
+
+	d.cached = -1
+	var err error
+	d.plain, err = d.aead.Open(d.plain[:0], nonce(uint64(i)), d.sealed, aad(d.hdr, i == d.nchunks-1))
+	if err != nil {
+		return fmt.Errorf("%w: chunk %d", ErrAuthentication, i)
+	}
+	d.cached = i
+	return nil
+}
+
+func (d *DecryptReader) Read(p []byte) (int, error) {
+	n, err := d.ReadAt(p, d.off)
+	d.off += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (d *DecryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.off
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("invalid offset: %d", offset)
+	}
+	d.off = offset
+	return offset, nil
+}
+
+// Close closes the underlying reader, if the DecryptReader was obtained
+// through Apply.
+func (d *DecryptReader) Close() error {
+	if d.closer == nil {
+		return nil
+	}
+	return d.closer.Close()
+}
+
+// nonce returns the nonce of chunk i: four zero bytes, followed by the chunk
+// index. It's only unique within a stream, which has its own key.
+func nonce(i uint64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], i)
+	return n
+}
+
+// aad returns the additional data of a chunk: the header, followed by a flag
+// marking the final chunk.
+func aad(hdr []byte, final bool) []byte {
+	ret := make([]byte, len(hdr)+1)
+	copy(ret, hdr)
+	if final {
+		ret[len(hdr)] = 1
+	}
+	return ret
+}
@@ -0,0 +1,150 @@
+package transform
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAESGCM(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+
+	const chunkSize = 64
+	a, err := NewAESGCM(key, chunkSize)
+	require.NoError(t, err)
+
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize, 1000} {
+		plain := make([]byte, size)
+		_, err := rand.Read(plain)
+		require.NoError(t, err)
+
+		var enc bytes.Buffer
+		require.NoError(t, a.Encrypt(&enc, bytes.NewReader(plain)))
+
+		r, err := a.Apply(nopCloser{bytes.NewReader(enc.Bytes())})
+		require.NoError(t, err)
+		require.EqualValues(t, size, r.(*DecryptReader).Size())
+
+		// sequential access.
+		bz, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, plain, bz, "size %d", size)
+
+		// random access across chunk boundaries.
+		if size > 10 {
+			buf := make([]byte, size-10)
+			_, err = r.ReadAt(buf, 5)
+			require.NoError(t, err)
+			require.Equal(t, plain[5:size-5], buf)
+
+			n, err := r.Seek(-3, io.SeekEnd)
+			require.NoError(t, err)
+			require.EqualValues(t, size-3, n)
+			bz, err = ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, plain[size-3:], bz)
+		}
+		require.NoError(t, r.Close())
+	}
+}
+
+func TestAESGCMTampering(t *testing.T) {
+	key := make([]byte, 16)
+	a, err := NewAESGCM(key, 64)
+	require.NoError(t, err)
+
+	plain := bytes.Repeat([]byte("0123456789"), 50)
+	var buf bytes.Buffer
+	require.NoError(t, a.Encrypt(&buf, bytes.NewReader(plain)))
+	enc := buf.Bytes()
+
+	readAll := func(a *AESGCM, enc []byte) error {
+		r, err := a.NewReader(bytes.NewReader(enc), int64(len(enc)))
+		if err != nil {
+			return err
+		}
+		_, err = ioutil.ReadAll(r)
+		return err
+	}
+	require.NoError(t, readAll(a, enc))
+
+	// flipped bit.
+	corrupted := append([]byte(nil), enc...)
+	corrupted[100] ^= 1
+	require.ErrorIs(t, readAll(a, corrupted), ErrAuthentication)
+
+	// truncated at a chunk boundary.
+	truncated := enc[:aesgcmHeaderLen+2*(64+aesgcmTagLen)]
+	require.ErrorIs(t, readAll(a, truncated), ErrAuthentication)
+
+	// swapped chunks.
+	swapped := append([]byte(nil), enc...)
+	c0 := swapped[aesgcmHeaderLen : aesgcmHeaderLen+64+aesgcmTagLen]
+	c1 := append([]byte(nil), swapped[aesgcmHeaderLen+64+aesgcmTagLen:aesgcmHeaderLen+2*(64+aesgcmTagLen)]...)
+	copy(swapped[aesgcmHeaderLen+64+aesgcmTagLen:], c0)
+	copy(swapped[aesgcmHeaderLen:], c1)
+	require.ErrorIs(t, readAll(a, swapped), ErrAuthentication)
+
+	// wrong key.
+	other, err := NewAESGCM(bytes.Repeat([]byte{1}, 16), 64)
+	require.NoError(t, err)
+	require.ErrorIs(t, readAll(other, enc), ErrAuthentication)
+
+	// tampered salt.
+	salted := append([]byte(nil), enc...)
+	salted[aesgcmHeaderLen-1] ^= 1
+	require.ErrorIs(t, readAll(a, salted), ErrAuthentication)
+
+	// not encrypted at all.
+	require.Error(t, readAll(a, plain))
+}
+
+func TestAESGCMStreamKeys(t *testing.T) {
+	a, err := NewAESGCM(make([]byte, 16), 64)
+	require.NoError(t, err)
+
+	// encrypting the same data twice under the same key uses different
+	// stream keys, so no chunk is sealed with the same key and nonce twice.
+	plain := bytes.Repeat([]byte{0}, 64)
+	var enc1, enc2 bytes.Buffer
+	require.NoError(t, a.Encrypt(&enc1, bytes.NewReader(plain)))
+	require.NoError(t, a.Encrypt(&enc2, bytes.NewReader(plain)))
+	require.NotEqual(t, enc1.Bytes()[12:aesgcmHeaderLen], enc2.Bytes()[12:aesgcmHeaderLen])
+	require.NotEqual(t, enc1.Bytes()[aesgcmHeaderLen:], enc2.Bytes()[aesgcmHeaderLen:])
+
+	// data in the version 1 format is rejected.
+	v1 := append([]byte("DAGSGCM1"), enc1.Bytes()[8:]...)
+	_, err = a.NewReader(bytes.NewReader(v1), int64(len(v1)))
+	require.Error(t, err)
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	a, err := NewAESGCM(make([]byte, 16), 0)
+	require.NoError(t, err)
+
+	require.NoError(t, r.Register("aes", a))
+	require.Error(t, r.Register("aes", a))
+	require.Error(t, r.Register("", a))
+
+	tf, err := r.Get("aes")
+	require.NoError(t, err)
+	require.Equal(t, a, tf)
+
+	_, err = r.Get("rot13")
+	require.ErrorIs(t, err, ErrUnknownTransform)
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,4 @@
+// Package transform includes transforms applied to the data of shards as
+// it's read from their mounts, such as decryption, and the registry through
+// which the DAG store refers to them by name.
+package transform
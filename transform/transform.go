@@ -0,0 +1,75 @@
+package transform
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrUnknownTransform is returned when looking up a transform that hasn't
+// been registered.
+var ErrUnknownTransform = errors.New("unknown transform")
+
+// Reader is the reader that transforms consume and produce. It has the same
+// method set as mount.Reader, so values of either type are interchangeable.
+type Reader interface {
+	io.Closer
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
+// Transform transforms the data of a shard as it's read from its mount, e.g.
+// to decrypt or unseal it.
+//
+// Transforms are registered by name in a Registry, and shards refer to them
+// by name, so that the association survives restarts. Instances can carry
+// environmental configuration, such as keys, which is therefore never
+// persisted.
+type Transform interface {
+	// Apply wraps a reader over the original data in a reader over the
+	// transformed data. The returned reader takes ownership of r, and closes
+	// it when closed. Transforms that require random access or seeking fail
+	// when invoked with a reader that doesn't support them.
+	Apply(r Reader) (Reader, error)
+}
+
+// Registry is a registry of named transforms.
+type Registry struct {
+	lk     sync.RWMutex
+	byName map[string]Transform
+}
+
+// NewRegistry constructs a blank registry.
+func NewRegistry() *Registry {
+	return &Registry{byName: map[string]Transform{}}
+}
+
+// Register adds a transform to the registry under the specified name.
+func (r *Registry) Register(name string, t Transform) error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if name == "" {
+		return fmt.Errorf("transform name must not be empty")
+	}
+	if _, ok := r.byName[name]; ok {
+		return fmt.Errorf("transform already registered with name: %s", name)
+	}
+	r.byName[name] = t
+	return nil
+}
+
+// Get returns the transform registered under the specified name, or
+// ErrUnknownTransform.
+func (r *Registry) Get(name string) (Transform, error) {
+	r.lk.RLock()
+	defer r.lk.RUnlock()
+
+	t, ok := r.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTransform, name)
+	}
+	return t, nil
+}
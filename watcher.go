@@ -0,0 +1,457 @@
+package dagstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// defaultWatchInterval is the default interval at which a DirWatcher polls its
+// directories.
+const defaultWatchInterval = time.Minute
+
+// KeyFunc derives the key of the shard for a CAR file picked up by a
+// DirWatcher, given its path.
+type KeyFunc func(path string) (shard.Key, error)
+
+// KeyByFileName keys shards by the name of their file, without the .car
+// extension.
+func KeyByFileName(path string) (shard.Key, error) {
+	return shard.KeyFromString(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))), nil
+}
+
+// KeyByRootCID keys shards by the first root CID of their CAR.
+func KeyByRootCID(path string) (shard.Key, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return shard.Key{}, err
+	}
+	defer f.Close()
+
+	hdr, err := readCARHeader(f)
+	if err != nil {
+		return shard.Key{}, err
+	}
+	if len(hdr.Roots) == 0 {
+		return shard.Key{}, fmt.Errorf("CAR has no roots")
+	}
+	return shard.KeyFromCID(hdr.Roots[0]), nil
+}
+
+// KeyByContentHash keys shards by the hex-encoded SHA-256 hash of their file.
+func KeyByContentHash(path string) (shard.Key, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return shard.Key{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return shard.Key{}, fmt.Errorf("failed to hash file: %w", err)
+	}
+	return shard.KeyFromString(hex.EncodeToString(h.Sum(nil))), nil
+}
+
+// RemovePolicy specifies what a DirWatcher does with the shards whose files
+// disappear from the watched directories.
+type RemovePolicy int
+
+const (
+	// RemoveDestroy destroys the shards whose files disappear. Shards in use
+	// are destroyed once they're released.
+	RemoveDestroy RemovePolicy = iota
+
+	// RemoveMarkUnavailable moves the shards whose files disappear to
+	// ShardStateUnavailable, and back to ShardStateAvailable if the files
+	// reappear. Shards in use remain available.
+	RemoveMarkUnavailable
+)
+
+type WatchOpts struct {
+	// Dirs are the directories to watch. Only the *.car files directly
+	// inside them are picked up.
+	Dirs []string
+
+	// Interval is the interval at which the directories are polled. Defaults
+	// to 1 minute.
+	Interval time.Duration
+
+	// Key derives the key of the shard for a file. Defaults to
+	// KeyByFileName.
+	Key KeyFunc
+
+	// OnRemove specifies what to do with the shards whose files disappear.
+	OnRemove RemovePolicy
+
+	// RegisterOpts are the options with which shards are registered.
+	RegisterOpts RegisterOpts
+
+	// Datastore is the datastore where the files that have been picked up
+	// are recorded, so that they're not processed again after a restart. It
+	// must not be the datastore of the DAG store, unless namespaced
+	// differently. If nil, an in-memory datastore is used.
+	Datastore ds.Datastore
+}
+
+// DirWatcher registers the CAR files dropped into a set of directories as
+// shards of a DAG store, by polling the directories. The shards are mounted
+// through mount.FileMount, which must be registered in the mount registry of
+// the DAG store.
+//
+// Files are picked up once their size and modification time are unchanged
+// across two consecutive polls, so that files that are still being written
+// aren't registered. They're expected to remain unchanged afterwards.
+//
+// Files are only processed once, even if their registration fails, unless
+// they disappear and are dropped again.
+type DirWatcher struct {
+	d     *DAGStore
+	opts  WatchOpts
+	store ds.Datastore
+
+	// lk serializes polls.
+	lk sync.Mutex
+	// files are the files that have been picked up, by path.
+	files map[string]*watchedFile // guarded by lk
+	// pending are the files that have been seen once, waiting for their
+	// stamp to remain unchanged.
+	pending map[string]fileStamp // guarded by lk
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// watchedFile is the persisted record of a file picked up by a DirWatcher.
+type watchedFile struct {
+	Path string `json:"p"`
+	// Key is the key of the shard registered for the file; empty if it
+	// couldn't be derived, or if a shard with that key already existed, in
+	// which case the watcher leaves it alone.
+	Key string `json:"k,omitempty"`
+	// Error is the error with which the registration failed, if any.
+	Error string `json:"e,omitempty"`
+	// Missing indicates that the file has disappeared, and the shard was
+	// marked unavailable.
+	Missing bool `json:"m,omitempty"`
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// NewDirWatcher creates a DirWatcher for the supplied DAG store, which must
+// be started before the watcher.
+func NewDirWatcher(d *DAGStore, opts WatchOpts) (*DirWatcher, error) {
+	if len(opts.Dirs) == 0 {
+		return nil, fmt.Errorf("no directories to watch")
+	}
+	dirs := make([]string, 0, len(opts.Dirs))
+	for _, dir := range opts.Dirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid directory %s: %w", dir, err)
+		}
+		dirs = append(dirs, abs)
+	}
+	opts.Dirs = dirs
+
+	if opts.Interval <= 0 {
+		opts.Interval = defaultWatchInterval
+	}
+	if opts.Key == nil {
+		opts.Key = KeyByFileName
+	}
+	if opts.Datastore == nil {
+		log.Warnf("no datastore provided to directory watcher; falling back to in-mem datastore; watched files will be processed again after restarts")
+		opts.Datastore = dssync.MutexWrap(ds.NewMapDatastore())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &DirWatcher{
+		d:       d,
+		opts:    opts,
+		store:   opts.Datastore,
+		files:   make(map[string]*watchedFile),
+		pending: make(map[string]fileStamp),
+		ctx:     ctx,
+		cancel:  cancel,
+	}, nil
+}
+
+// Start restores the records of the files that have been picked up, and
+// starts polling the directories, right away and then at every interval.
+func (w *DirWatcher) Start(_ context.Context) error {
+	if err := w.restore(); err != nil {
+		return fmt.Errorf("failed to restore watched files: %w", err)
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+
+		ticker := time.NewTicker(w.opts.Interval)
+		defer ticker.Stop()
+		for {
+			if err := w.Poll(w.ctx); err != nil && w.ctx.Err() == nil {
+				log.Warnw("failed to poll watched directories", "error", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-w.ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Close stops polling, waiting for an ongoing poll to finish.
+func (w *DirWatcher) Close() error {
+	w.cancel()
+	w.wg.Wait()
+	return nil
+}
+
+func (w *DirWatcher) restore() error {
+	results, err := w.store.Query(query.Query{})
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	for res := range results.Next() {
+		if res.Error != nil {
+			return res.Error
+		}
+		var f watchedFile
+		if err := json.Unmarshal(res.Value, &f); err != nil {
+			log.Warnf("failed to recover watched file %s: %s; skipping", res.Key, err)
+			continue
+		}
+		w.files[f.Path] = &f
+	}
+	return nil
+}
+
+// Poll polls the watched directories once, registering new files and
+// processing the removed ones. It's called periodically once the watcher is
+// started, but it can also be called directly.
+func (w *DirWatcher) Poll(ctx context.Context) error {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	// files present in the directories, and the directories that we were
+	// able to list; we don't process the removal of files in other
+	// directories, as they may be temporarily unreachable.
+	present := make(map[string]fileStamp)
+	listed := make(map[string]bool)
+	for _, dir := range w.opts.Dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			log.Warnw("failed to list watched directory", "dir", dir, "error", err)
+			continue
+		}
+		listed[dir] = true
+		for _, e := range entries {
+			if ok, _ := filepath.Match("*.car", e.Name()); !ok || e.IsDir() {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue // removed in the meantime.
+			}
+			present[filepath.Join(dir, e.Name())] = fileStamp{size: info.Size(), modTime: info.ModTime()}
+		}
+	}
+
+	for path := range w.pending {
+		if _, ok := present[path]; !ok {
+			delete(w.pending, path)
+		}
+	}
+
+	for path, stamp := range present {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if f, ok := w.files[path]; ok {
+			w.reappeared(f)
+			continue
+		}
+		// wait for the file to settle.
+		if prev, ok := w.pending[path]; !ok || prev != stamp {
+			w.pending[path] = stamp
+			continue
+		}
+		delete(w.pending, path)
+		w.register(ctx, path)
+	}
+
+	for path, f := range w.files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, ok := present[path]; ok || !listed[filepath.Dir(path)] {
+			continue
+		}
+		w.removed(ctx, f)
+	}
+	return nil
+}
+
+// register registers the shard of a new file, and records the file.
+func (w *DirWatcher) register(ctx context.Context, path string) {
+	f := &watchedFile{Path: path}
+	defer w.persist(f)
+
+	key, err := w.opts.Key(path)
+	if err != nil {
+		log.Warnw("failed to derive shard key of watched file", "path", path, "error", err)
+		f.Error = err.Error()
+		return
+	}
+
+	ch := make(chan ShardResult, 1)
+	err = w.d.RegisterShard(ctx, key, &mount.FileMount{Path: path}, ch, w.opts.RegisterOpts)
+	if errors.Is(err, ErrShardExists) {
+		// the shard isn't ours; the file's removal won't affect it.
+		log.Infow("shard of watched file already exists", "path", path, "shard", key)
+		return
+	}
+	if err == nil {
+		// the shard is ours from now on, even if it fails to initialize.
+		f.Key = key.String()
+		select {
+		case res := <-ch:
+			err = res.Error
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		log.Warnw("failed to register shard of watched file", "path", path, "shard", key, "error", err)
+		f.Error = err.Error()
+		return
+	}
+	log.Infow("registered shard of watched file", "path", path, "shard", key)
+}
+
+// reappeared makes the shard of a file that had disappeared available again.
+func (w *DirWatcher) reappeared(f *watchedFile) {
+	if !f.Missing {
+		return
+	}
+	log.Infow("watched file reappeared", "path", f.Path, "shard", f.Key)
+	if s := w.shard(f); s != nil {
+		s.lk.RLock()
+		state := s.state
+		s.lk.RUnlock()
+		if state == ShardStateUnavailable {
+			_ = w.d.queueTask(&task{op: OpShardMountReachable, shard: s}, w.d.externalCh)
+		}
+	}
+	f.Missing = false
+	w.persist(f)
+}
+
+// removed processes the removal of a file according to the RemovePolicy.
+func (w *DirWatcher) removed(ctx context.Context, f *watchedFile) {
+	s := w.shard(f)
+	if s == nil {
+		// the shard was never registered, or it has been destroyed.
+		w.forget(f)
+		return
+	}
+
+	switch w.opts.OnRemove {
+	case RemoveDestroy:
+		ch := make(chan ShardResult, 1)
+		err := w.d.DestroyShard(ctx, s.key, ch, DestroyOpts{})
+		if err == nil {
+			select {
+			case res := <-ch:
+				err = res.Error
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+		if err != nil && !errors.Is(err, ErrShardUnknown) {
+			log.Warnw("failed to destroy shard of removed watched file; will retry", "path", f.Path, "shard", f.Key, "error", err)
+			return
+		}
+		log.Infow("destroyed shard of removed watched file", "path", f.Path, "shard", f.Key)
+		w.forget(f)
+
+	case RemoveMarkUnavailable:
+		// the shard is reset to available on restarts, or may have been in
+		// use, so we mark it on every poll until the file reappears.
+		s.lk.RLock()
+		state := s.state
+		s.lk.RUnlock()
+		if state == ShardStateAvailable {
+			log.Infow("marking shard of removed watched file unavailable", "path", f.Path, "shard", f.Key)
+			err := fmt.Errorf("file %s removed from watched directory", f.Path)
+			_ = w.d.queueTask(&task{op: OpShardMountUnreachable, shard: s, err: err}, w.d.externalCh)
+		}
+		if !f.Missing {
+			f.Missing = true
+			w.persist(f)
+		}
+	}
+}
+
+// shard returns the shard of a file, or nil if it's unknown.
+func (w *DirWatcher) shard(f *watchedFile) *Shard {
+	if f.Key == "" {
+		return nil
+	}
+	w.d.lk.RLock()
+	defer w.d.lk.RUnlock()
+	return w.d.shards[shard.KeyFromString(f.Key)]
+}
+
+func (w *DirWatcher) persist(f *watchedFile) {
+	w.files[f.Path] = f
+	b, err := json.Marshal(f)
+	if err != nil {
+		log.Warnw("failed to serialize watched file", "path", f.Path, "error", err)
+		return
+	}
+	if err := w.store.Put(watchedFileKey(f.Path), b); err != nil {
+		log.Warnw("failed to persist watched file", "path", f.Path, "error", err)
+	}
+}
+
+func (w *DirWatcher) forget(f *watchedFile) {
+	delete(w.files, f.Path)
+	if err := w.store.Delete(watchedFileKey(f.Path)); err != nil {
+		log.Warnw("failed to delete watched file", "path", f.Path, "error", err)
+	}
+}
+
+// watchedFileKey returns the datastore key of the record of a file.
+func watchedFileKey(path string) ds.Key {
+	return ds.NewKey(filepath.ToSlash(path))
+}
@@ -0,0 +1,190 @@
+package dagstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore/shard"
+	"github.com/filecoin-project/dagstore/testdata"
+)
+
+func TestDirWatcher(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "v1.car"), testdata.CarV1, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "v2.car"), testdata.CarV2, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "junk.dat"), testdata.Junk, 0644))
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		Datastore:     datastore.NewMapDatastore(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+	defer dagst.Close()
+
+	var keyed int
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	opts := WatchOpts{
+		Dirs: []string{dir},
+		Key: func(path string) (shard.Key, error) {
+			keyed++
+			return KeyByFileName(path)
+		},
+		Datastore: store,
+	}
+	ctx := context.Background()
+	w, err := NewDirWatcher(dagst, opts)
+	require.NoError(t, err)
+
+	// files are registered once they've settled.
+	require.NoError(t, w.Poll(ctx))
+	require.Empty(t, dagst.AllShardsInfo())
+	require.NoError(t, w.Poll(ctx))
+	info := dagst.AllShardsInfo()
+	require.Len(t, info, 2)
+	for _, k := range []string{"v1", "v2"} {
+		require.Equal(t, ShardStateAvailable, info[shard.KeyFromString(k)].ShardState)
+	}
+	require.Equal(t, 2, keyed)
+
+	// files aren't processed again after a restart.
+	w, err = NewDirWatcher(dagst, opts)
+	require.NoError(t, err)
+	require.NoError(t, w.restore())
+	require.NoError(t, w.Poll(ctx))
+	require.NoError(t, w.Poll(ctx))
+	require.Equal(t, 2, keyed)
+
+	// the shards of removed files are destroyed.
+	require.NoError(t, os.Remove(filepath.Join(dir, "v1.car")))
+	require.NoError(t, w.Poll(ctx))
+	_, err = dagst.GetShardInfo(shard.KeyFromString("v1"))
+	require.ErrorIs(t, err, ErrShardUnknown)
+	require.Len(t, dagst.AllShardsInfo(), 1)
+	_, err = store.Get(watchedFileKey(filepath.Join(dir, "v1.car")))
+	require.ErrorIs(t, err, datastore.ErrNotFound)
+
+	// and registered again if dropped again.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "v1.car"), testdata.CarV1, 0644))
+	require.NoError(t, w.Poll(ctx))
+	require.NoError(t, w.Poll(ctx))
+	require.Len(t, dagst.AllShardsInfo(), 2)
+	require.Equal(t, 3, keyed)
+}
+
+func TestDirWatcherExistingShard(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "v2.car")
+	require.NoError(t, os.WriteFile(path, testdata.CarV2, 0644))
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		Datastore:     datastore.NewMapDatastore(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+	defer dagst.Close()
+
+	// the application registered the shard beforehand.
+	k := shard.KeyFromString("v2")
+	ch := make(chan ShardResult, 1)
+	require.NoError(t, dagst.RegisterShard(context.Background(), k, carv2mnt, ch, RegisterOpts{}))
+	require.NoError(t, (<-ch).Error)
+
+	for _, policy := range []RemovePolicy{RemoveMarkUnavailable, RemoveDestroy} {
+		require.NoError(t, os.WriteFile(path, testdata.CarV2, 0644))
+		w, err := NewDirWatcher(dagst, WatchOpts{
+			Dirs:     []string{dir},
+			Key:      KeyByFileName,
+			OnRemove: policy,
+		})
+		require.NoError(t, err)
+		ctx := context.Background()
+		require.NoError(t, w.Poll(ctx))
+		require.NoError(t, w.Poll(ctx))
+
+		// removing the file leaves the shard alone.
+		require.NoError(t, os.Remove(path))
+		require.NoError(t, w.Poll(ctx))
+		require.NoError(t, w.Poll(ctx))
+		require.Never(t, func() bool {
+			info, err := dagst.GetShardInfo(k)
+			return err != nil || info.ShardState != ShardStateAvailable
+		}, 100*time.Millisecond, 10*time.Millisecond)
+	}
+}
+
+func TestDirWatcherMarkUnavailable(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "v2.car")
+	require.NoError(t, os.WriteFile(path, testdata.CarV2, 0644))
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		Datastore:     datastore.NewMapDatastore(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+	defer dagst.Close()
+
+	w, err := NewDirWatcher(dagst, WatchOpts{
+		Dirs:     []string{dir},
+		Interval: 10 * time.Millisecond,
+		Key:      KeyByRootCID,
+		OnRemove: RemoveMarkUnavailable,
+	})
+	require.NoError(t, err)
+	require.NoError(t, w.Start(context.Background()))
+	defer w.Close()
+
+	k := shard.KeyFromCID(testdata.RootCID)
+	waitState := func(state ShardState) {
+		require.Eventually(t, func() bool {
+			info, err := dagst.GetShardInfo(k)
+			return err == nil && info.ShardState == state
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	waitState(ShardStateAvailable)
+
+	moved := filepath.Join(t.TempDir(), "v2.car")
+	require.NoError(t, os.Rename(path, moved))
+	waitState(ShardStateUnavailable)
+
+	require.NoError(t, os.Rename(moved, path))
+	waitState(ShardStateAvailable)
+}
+
+func TestKeyFuncs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sample.car")
+	require.NoError(t, os.WriteFile(path, testdata.CarV2, 0644))
+
+	k, err := KeyByFileName(path)
+	require.NoError(t, err)
+	require.Equal(t, "sample", k.String())
+
+	k, err = KeyByRootCID(path)
+	require.NoError(t, err)
+	require.Equal(t, shard.KeyFromCID(testdata.RootCID), k)
+
+	k, err = KeyByContentHash(path)
+	require.NoError(t, err)
+	h := sha256.Sum256(testdata.CarV2)
+	require.Equal(t, hex.EncodeToString(h[:]), k.String())
+
+	junk := filepath.Join(t.TempDir(), "junk.car")
+	require.NoError(t, os.WriteFile(junk, testdata.Junk, 0644))
+	_, err = KeyByRootCID(junk)
+	require.Error(t, err)
+}